@@ -0,0 +1,409 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const bulkMaxBackoff = 30 * time.Second
+
+// bulkBackoff is the exponential backoff before the retry of attempt, capped by bulkMaxBackoff,
+// a random half of it is taken off, so the workers rejected together don't retry at the same time
+func bulkBackoff(attempt int) time.Duration {
+	backoff := time.Second
+	for i := 0; i < attempt && backoff < bulkMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > bulkMaxBackoff {
+		backoff = bulkMaxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// BulkRecord is one action of a bulk request body: the action line and the source line
+// which follows it, delete actions have no source line
+type BulkRecord struct {
+	Action string
+	Meta   map[string]interface{}
+	Source []byte
+}
+
+// ParseBulkRecords splits a bulk request body into records, empty lines are ignored
+func ParseBulkRecords(data []byte) ([]BulkRecord, error) {
+	records := make([]BulkRecord, 0)
+	lines := bytes.Split(data, []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+
+		action := map[string]map[string]interface{}{}
+		if err := DecodeJsonBytes(line, &action); err != nil {
+			return nil, err
+		}
+		if len(action) != 1 {
+			return nil, fmt.Errorf("invalid bulk action line: %s", line)
+		}
+
+		record := BulkRecord{}
+		for name, meta := range action {
+			record.Action = name
+			record.Meta = meta
+		}
+
+		if record.Action != "delete" {
+			i++
+			if i >= len(lines) {
+				return nil, fmt.Errorf("missing source line for bulk action: %s", line)
+			}
+			record.Source = lines[i]
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// WriteBulkRecords encodes records back into the bulk request format
+func WriteBulkRecords(buf *bytes.Buffer, records []BulkRecord) error {
+	enc := json.NewEncoder(buf)
+	// keep the ids as they are, ie: <&>
+	enc.SetEscapeHTML(false)
+	for _, record := range records {
+		if err := enc.Encode(map[string]interface{}{record.Action: record.Meta}); err != nil {
+			return err
+		}
+		if record.Action != "delete" {
+			buf.Write(record.Source)
+			buf.WriteByte('\n')
+		}
+	}
+	return nil
+}
+
+// BulkFailure is a bulk record which was not accepted by the target
+type BulkFailure struct {
+	Record BulkRecord
+	// position of the record in the bulk request
+	Item   int
+	Status int
+	Reason interface{}
+}
+
+// BulkError is returned by doBulk if some of the records were not accepted by the target after retries
+type BulkError struct {
+	Failures []BulkFailure
+	Total    int
+	// all the failures were written to the dead letter file, they can be replayed by `-i`
+	DeadLettered bool
+}
+
+func (e *BulkError) Error() string {
+	reason, _ := json.Marshal(e.Failures[0].Reason)
+	return fmt.Sprintf("%d of %d bulk items failed, first error: %s", len(e.Failures), e.Total, reason)
+}
+
+// Failed return the positions of the failed records in the bulk request
+func (e *BulkError) Failed() map[int]bool {
+	failed := make(map[int]bool, len(e.Failures))
+	for _, failure := range e.Failures {
+		failed[failure.Item] = true
+	}
+	return failed
+}
+
+// ackBulk acknowledge the documents of a bulk request to the checkpoint, seqs are in the order of records,
+// the failed ones are only acknowledged once written to the dead letter file, so the checkpoint doesn't move over the lost ones
+func (m *Migrator) ackBulk(seqs []uint64, err error) {
+	if err == nil {
+		m.Checkpoint.Ack(seqs...)
+		return
+	}
+	bulkErr, ok := err.(*BulkError)
+	if !ok {
+		return
+	}
+	if bulkErr.DeadLettered {
+		m.Checkpoint.Ack(seqs...)
+		return
+	}
+	failed := bulkErr.Failed()
+	acked := make([]uint64, 0, len(seqs))
+	for i, seq := range seqs {
+		if !failed[i] {
+			acked = append(acked, seq)
+		}
+	}
+	m.Checkpoint.Ack(acked...)
+}
+
+// isRetryableBulkItem check whether the item was rejected because the target is too busy
+func isRetryableBulkItem(action Action) bool {
+	if action.Status == 429 || action.Status == 503 {
+		return true
+	}
+	if reason, ok := action.Error.(map[string]interface{}); ok {
+		return reason["type"] == "es_rejected_execution_exception"
+	}
+	return false
+}
+
+// doBulk send the bulk request, items rejected by a busy target are retried with backoff,
+// others failed permanently are written to the dead letter file and returned as *BulkError
+func (m *Migrator) doBulk(api ESAPI, data *bytes.Buffer) error {
+	if data == nil || data.Len() == 0 {
+		return nil
+	}
+
+	// the buffer is consumed by the request, keep a copy to pick up failed items
+	raw := make([]byte, data.Len())
+	copy(raw, data.Bytes())
+
+	var records []BulkRecord
+	// position of records in the first request
+	var items []int
+	total := 0
+	failed := make([]BulkFailure, 0)
+	deadLettered := true
+	for attempt := 0; ; attempt++ {
+		response, err := api.Bulk(data)
+		if err == nil && !response.Errors {
+			break
+		}
+
+		if records == nil {
+			var parseErr error
+			records, parseErr = ParseBulkRecords(raw)
+			if parseErr != nil {
+				log.Error(parseErr)
+				return parseErr
+			}
+			total = len(records)
+			items = make([]int, len(records))
+			for i := range items {
+				items[i] = i
+			}
+		}
+
+		retries := make([]BulkFailure, 0)
+		failures := make([]BulkFailure, 0)
+		if err != nil {
+			// the whole request failed, retry all of them
+			for i, record := range records {
+				retries = append(retries, BulkFailure{Record: record, Item: items[i], Reason: err.Error()})
+			}
+		} else {
+			if len(response.Items) != len(records) {
+				log.Errorf("bulk response has %d items, but %d were sent", len(response.Items), len(records))
+				return fmt.Errorf("unexpected bulk response")
+			}
+			conflicts := 0
+			for i, item := range response.Items {
+				for _, action := range item {
+					if action.Error == nil {
+						continue
+					}
+					// the document exists, or the target has a newer version
+					if action.Status == 409 {
+						conflicts++
+						continue
+					}
+					failure := BulkFailure{Record: records[i], Item: items[i], Status: action.Status, Reason: action.Error}
+					if isRetryableBulkItem(action) {
+						retries = append(retries, failure)
+					} else {
+						failures = append(failures, failure)
+					}
+				}
+			}
+			if conflicts > 0 {
+				log.Debugf("%d bulk items have version conflicts", conflicts)
+				atomic.AddInt64(&m.BulkStats.Conflicts, int64(conflicts))
+			}
+		}
+
+		if len(retries) > 0 && attempt < m.Config.BulkRetries {
+			backoff := bulkBackoff(attempt)
+			log.Debugf("%d bulk items were rejected, retry after %s", len(retries), backoff)
+			atomic.AddInt64(&m.BulkStats.Retried, int64(len(retries)))
+
+			if !m.handleBulkFailures(failures) {
+				deadLettered = false
+			}
+			failed = append(failed, failures...)
+			records = make([]BulkRecord, 0, len(retries))
+			items = make([]int, 0, len(retries))
+			for _, retry := range retries {
+				records = append(records, retry.Record)
+				items = append(items, retry.Item)
+			}
+			data.Reset()
+			if err := WriteBulkRecords(data, records); err != nil {
+				log.Error(err)
+				return err
+			}
+			time.Sleep(backoff)
+			continue
+		}
+
+		failures = append(failures, retries...)
+		if !m.handleBulkFailures(failures) {
+			deadLettered = false
+		}
+		failed = append(failed, failures...)
+		break
+	}
+
+	if len(failed) > 0 {
+		return &BulkError{Failures: failed, Total: total, DeadLettered: deadLettered}
+	}
+	return nil
+}
+
+// handleBulkFailures count the failures and write them to the dead letter file,
+// return whether all of them were written, the failed deletes are only logged
+func (m *Migrator) handleBulkFailures(failures []BulkFailure) bool {
+	if len(failures) == 0 {
+		return true
+	}
+
+	atomic.AddInt64(&m.BulkStats.Failed, int64(len(failures)))
+	reason, _ := json.Marshal(failures[0].Reason)
+	log.Warnf("%d bulk items failed, first error: %s", len(failures), reason)
+
+	if m.DeadLetter == nil {
+		return false
+	}
+	if err := m.DeadLetter.Write(failures); err != nil {
+		log.Error(err)
+		return false
+	}
+	for _, failure := range failures {
+		if failure.Record.Action == "delete" {
+			return false
+		}
+	}
+	return true
+}
+
+// BulkStats count bulk items which were not accepted at the first time
+type BulkStats struct {
+	Retried int64
+	Failed  int64
+	// rejected by --bulk_action=create or --version_type, not failures
+	Conflicts int64
+}
+
+// DeadLetterWriter write failed bulk items in the dump format, so they can be replayed by `-i`
+type DeadLetterWriter struct {
+	lock sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+func NewDeadLetterWriter(path string) (*DeadLetterWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterWriter{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (d *DeadLetterWriter) Write(failures []BulkFailure) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	enc := json.NewEncoder(d.w)
+	for _, failure := range failures {
+		record := failure.Record
+		if record.Action == "delete" {
+			log.Errorf("failed to delete document: %v, reason: %v", record.Meta, failure.Reason)
+			continue
+		}
+
+		// `_id` is required by `-i`, an empty one will be generated by the target
+		doc := map[string]interface{}{
+			"_id":     "",
+			"_source": json.RawMessage(record.Source),
+			"_error": map[string]interface{}{
+				"status": failure.Status,
+				"reason": failure.Reason,
+			},
+		}
+		for _, key := range []string{"_index", "_type", "_id"} {
+			if v, ok := record.Meta[key]; ok {
+				doc[key] = v
+			}
+		}
+		if v, ok := record.Meta["routing"]; ok {
+			doc["_routing"] = v
+		}
+
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+	return d.w.Flush()
+}
+
+// WriteRejected write a document failed before output, with the reason in `_error`
+func (d *DeadLetterWriter) WriteRejected(original []byte, reason string) error {
+	hit := map[string]interface{}{}
+	if err := DecodeJsonBytes(original, &hit); err != nil {
+		return err
+	}
+
+	doc := map[string]interface{}{
+		"_id": "",
+		"_error": map[string]interface{}{
+			"reason": reason,
+		},
+	}
+	for _, key := range []string{"_index", "_type", "_id", "_routing", "_source"} {
+		if v, ok := hit[key]; ok {
+			doc[key] = v
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := json.NewEncoder(d.w).Encode(doc); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+func (d *DeadLetterWriter) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	return d.file.Close()
+}
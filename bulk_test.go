@@ -0,0 +1,200 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeBulkES answer bulk requests with the status of every _id, the ones not in statuses are accepted
+type fakeBulkES struct {
+	ESAPI
+	statuses map[string][]int
+	err      error
+	requests int
+	bodies   []string
+}
+
+func (f *fakeBulkES) Bulk(data *bytes.Buffer) (*BulkResponse, error) {
+	f.requests++
+	f.bodies = append(f.bodies, data.String())
+	if f.err != nil {
+		return nil, f.err
+	}
+	records, err := ParseBulkRecords(data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	response := &BulkResponse{}
+	for _, record := range records {
+		action := Action{Id: record.Meta["_id"].(string), Status: 200}
+		if statuses := f.statuses[action.Id]; len(statuses) > 0 {
+			action.Status = statuses[0]
+			f.statuses[action.Id] = statuses[1:]
+		}
+		if action.Status >= 300 {
+			response.Errors = true
+			action.Error = map[string]interface{}{"type": fmt.Sprintf("error_%d", action.Status)}
+		}
+		response.Items = append(response.Items, map[string]Action{record.Action: action})
+	}
+	return response, nil
+}
+
+func TestDoBulk(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses map[string][]int
+		err      error
+		retries  int
+		failed   []int
+		requests int
+		// failed items are written to the dead letter file
+		deadLetter bool
+	}{
+		{name: "all accepted", requests: 1},
+		{name: "conflicts are not failures", statuses: map[string][]int{"b": {409}}, requests: 1},
+		{name: "failed permanently", statuses: map[string][]int{"b": {400}, "d": {400}}, failed: []int{1, 3}, requests: 1},
+		{name: "accepted after retry", statuses: map[string][]int{"c": {429}}, retries: 1, requests: 2},
+		{name: "still busy after retries", statuses: map[string][]int{"a": {400}, "c": {429, 429}}, retries: 1, failed: []int{0, 2}, requests: 2},
+		{name: "request failed", err: errors.New("connection refused"), failed: []int{0, 1, 2, 3}, requests: 1},
+		{name: "failed into dead letter", statuses: map[string][]int{"a": {400}, "c": {429, 429}}, retries: 1, failed: []int{0, 2}, requests: 2, deadLetter: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			api := &fakeBulkES{statuses: c.statuses, err: c.err}
+			m := &Migrator{Config: &Config{BulkRetries: c.retries}}
+			if c.deadLetter {
+				deadLetter, err := NewDeadLetterWriter(filepath.Join(t.TempDir(), "failed.json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer deadLetter.Close()
+				m.DeadLetter = deadLetter
+			}
+			data := bytes.Buffer{}
+			for _, id := range []string{"a", "b", "c", "d"} {
+				data.WriteString(`{"index":{"_index":"idx","_id":"` + id + `"}}` + "\n" + `{"v":1}` + "\n")
+			}
+
+			err := m.doBulk(api, &data)
+			if api.requests != c.requests {
+				t.Errorf("sent %d requests, want %d", api.requests, c.requests)
+			}
+			if len(c.failed) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			bulkErr, ok := err.(*BulkError)
+			if !ok {
+				t.Fatalf("got error %v, want *BulkError", err)
+			}
+			var failed []int
+			for i := 0; i < 4; i++ {
+				if bulkErr.Failed()[i] {
+					failed = append(failed, i)
+				}
+			}
+			if !reflect.DeepEqual(failed, c.failed) {
+				t.Errorf("got failed items %v, want %v", failed, c.failed)
+			}
+			if m.BulkStats.Failed != int64(len(c.failed)) {
+				t.Errorf("counted %d failures, want %d", m.BulkStats.Failed, len(c.failed))
+			}
+			if bulkErr.DeadLettered != c.deadLetter {
+				t.Errorf("got dead lettered %v, want %v", bulkErr.DeadLettered, c.deadLetter)
+			}
+		})
+	}
+}
+
+func TestBulkBackoff(t *testing.T) {
+	cases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{4, 16 * time.Second},
+		{5, bulkMaxBackoff},
+		{100, bulkMaxBackoff},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			if got := bulkBackoff(c.attempt); got < c.max/2 || got > c.max {
+				t.Fatalf("attempt %d: got backoff %s, want between %s and %s", c.attempt, got, c.max/2, c.max)
+			}
+		}
+	}
+}
+
+func TestAckBulk(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		count  int
+		lastId string
+	}{
+		{name: "accepted", count: 4, lastId: "d"},
+		{name: "some failed", err: &BulkError{Failures: []BulkFailure{{Item: 2}}, Total: 4}, count: 0},
+		{name: "last failed", err: &BulkError{Failures: []BulkFailure{{Item: 3}}, Total: 4}, count: 0},
+		{name: "failed into dead letter", err: &BulkError{Failures: []BulkFailure{{Item: 2}}, Total: 4, DeadLettered: true}, count: 4, lastId: "d"},
+		{name: "request failed", err: errors.New("unexpected bulk response"), count: 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cp, err := NewCheckpoint(filepath.Join(t.TempDir(), "checkpoint"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slice, err := cp.Slice("idx", "ts", 0, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var docs []interface{}
+			for _, id := range []string{"a", "b", "c", "d"} {
+				docs = append(docs, map[string]interface{}{"_id": id, "sort": []interface{}{id}})
+			}
+			slice.Track(docs)
+			var seqs []uint64
+			for _, doc := range docs {
+				seqs = append(seqs, takeCheckpointSeq(doc.(map[string]interface{})))
+				if _, ok := doc.(map[string]interface{})[checkpointSeqField]; ok {
+					t.Fatal("the sequence number is not taken off")
+				}
+			}
+
+			m := &Migrator{Checkpoint: cp}
+			m.ackBulk(seqs, c.err)
+			if slice.Count != c.count || slice.LastId != c.lastId {
+				t.Errorf("checkpoint at %d(%s), want %d(%s)", slice.Count, slice.LastId, c.count, c.lastId)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"os"
+	"sync"
+	"time"
+)
+
+const checkpointSaveInterval = 3 * time.Second
+
+// Checkpoint persist the progress of scroll to disk, per source indexes and per slice.
+// The position of a scroll batch is only saved after all of its documents were
+// acknowledged by the output, so resuming from it never loses documents, though
+// some of them may be copied twice
+type Checkpoint struct {
+	lock     sync.Mutex
+	path     string
+	lastSave time.Time
+
+	Sources map[string]*SourceCheckpoint `json:"sources"`
+
+	// sequence number of document => batch it belongs to
+	batches map[uint64]*checkpointBatch
+	seq     uint64
+}
+
+// checkpointSeqField carry the sequence number of a tracked document from the scroll to the output,
+// it's taken off by takeCheckpointSeq before the document is transformed or written
+const checkpointSeqField = "_checkpoint_seq"
+
+// takeCheckpointSeq remove the sequence number from the document, 0 if it's not tracked
+func takeCheckpointSeq(doc map[string]interface{}) uint64 {
+	seq, _ := doc[checkpointSeqField].(uint64)
+	delete(doc, checkpointSeqField)
+	return seq
+}
+
+type SourceCheckpoint struct {
+	SortField string                   `json:"sort_field"`
+	MaxSlices int                      `json:"max_slices"`
+	Slices    map[int]*SliceCheckpoint `json:"slices"`
+}
+
+type SliceCheckpoint struct {
+	LastSort []interface{} `json:"last_sort,omitempty"`
+	LastId   string        `json:"last_id,omitempty"`
+	Count    int           `json:"count"`
+	Done     bool          `json:"done"`
+
+	owner    *Checkpoint
+	pending  []*checkpointBatch
+	finished bool
+}
+
+type checkpointBatch struct {
+	slice     *SliceCheckpoint
+	count     int
+	remaining int
+	lastSort  []interface{}
+	lastId    string
+}
+
+// NewCheckpoint create a checkpoint saved to path, if resume is true, the previous
+// progress is loaded from it
+func NewCheckpoint(path string, resume bool) (*Checkpoint, error) {
+	cp := &Checkpoint{
+		path:    path,
+		Sources: map[string]*SourceCheckpoint{},
+		batches: map[uint64]*checkpointBatch{},
+	}
+
+	if !resume {
+		return cp, nil
+	}
+
+	if !checkFileIsExist(path) {
+		log.Infof("checkpoint file %s not exists, start from the beginning", path)
+		return cp, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := DecodeJsonBytes(data, cp); err != nil {
+		return nil, err
+	}
+	for _, source := range cp.Sources {
+		for _, slice := range source.Slices {
+			slice.owner = cp
+		}
+	}
+	return cp, nil
+}
+
+// Slice return the progress of the slice, the checkpoint must be created with the
+// same sort field and number of slices to resume from it
+func (cp *Checkpoint) Slice(indexNames string, sortField string, slicedId int, maxSlicedCount int) (*SliceCheckpoint, error) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	source, ok := cp.Sources[indexNames]
+	if !ok {
+		source = &SourceCheckpoint{
+			SortField: sortField,
+			MaxSlices: maxSlicedCount,
+			Slices:    map[int]*SliceCheckpoint{},
+		}
+		cp.Sources[indexNames] = source
+	}
+
+	if source.SortField != sortField || source.MaxSlices != maxSlicedCount {
+		return nil, fmt.Errorf("checkpoint of %s was created with --sort=%s --sliced_scroll_size=%d, can't resume with --sort=%s --sliced_scroll_size=%d",
+			indexNames, source.SortField, source.MaxSlices, sortField, maxSlicedCount)
+	}
+
+	slice, ok := source.Slices[slicedId]
+	if !ok {
+		slice = &SliceCheckpoint{owner: cp}
+		source.Slices[slicedId] = slice
+	}
+	return slice, nil
+}
+
+// ResumeFilter return the range filter on the first sort field to skip documents before the checkpoint,
+// documents at the checkpoint are included, as there may be more of them with the same sort value
+func (slice *SliceCheckpoint) ResumeFilter(sort string) map[string]interface{} {
+	spec := sortSpecOf(sort)
+	if len(slice.LastSort) == 0 || len(spec) == 0 {
+		return nil
+	}
+	op := "gte"
+	if spec[0].Desc {
+		op = "lte"
+	}
+	return map[string]interface{}{
+		"range": map[string]interface{}{
+			spec[0].Field: map[string]interface{}{
+				op: slice.LastSort[0],
+			},
+		},
+	}
+}
+
+// ResumeSearchAfter return the sort values to search after, _shard_doc is dropped by NewSearchAfter, as it only
+// makes sense in the same point in time
+func (slice *SliceCheckpoint) ResumeSearchAfter() []interface{} {
+	if len(slice.LastSort) == 0 {
+		return nil
+	}
+	return slice.LastSort
+}
+
+// Track register a scroll batch before its documents are sent to the output
+func (slice *SliceCheckpoint) Track(docs []interface{}) {
+	if slice == nil || len(docs) == 0 {
+		return
+	}
+	cp := slice.owner
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	last := docs[len(docs)-1].(map[string]interface{})
+	batch := &checkpointBatch{
+		slice:     slice,
+		count:     len(docs),
+		remaining: len(docs),
+	}
+	if sort, ok := last["sort"].([]interface{}); ok {
+		batch.lastSort = sort
+	}
+	if id, ok := last["_id"].(string); ok {
+		batch.lastId = id
+	}
+	slice.pending = append(slice.pending, batch)
+
+	for _, doc := range docs {
+		cp.seq++
+		doc.(map[string]interface{})[checkpointSeqField] = cp.seq
+		cp.batches[cp.seq] = batch
+	}
+}
+
+// Finish mark the scroll of slice is over, the slice is done once all of its documents were acknowledged
+func (slice *SliceCheckpoint) Finish() {
+	if slice == nil {
+		return
+	}
+	cp := slice.owner
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	slice.finished = true
+	slice.advance()
+	cp.saveIfNeeded(false)
+}
+
+// advance move the position of slice forward over the batches which were fully acknowledged
+func (slice *SliceCheckpoint) advance() {
+	for len(slice.pending) > 0 && slice.pending[0].remaining == 0 {
+		batch := slice.pending[0]
+		slice.pending = slice.pending[1:]
+		if batch.lastSort != nil {
+			slice.LastSort = batch.lastSort
+		}
+		slice.LastId = batch.lastId
+		slice.Count += batch.count
+	}
+	if slice.finished && len(slice.pending) == 0 {
+		slice.Done = true
+	}
+}
+
+// Ack acknowledge documents which were accepted by the output, by their sequence numbers
+func (cp *Checkpoint) Ack(seqs ...uint64) {
+	if cp == nil || len(seqs) == 0 {
+		return
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	slices := map[*SliceCheckpoint]bool{}
+	for _, seq := range seqs {
+		if batch, ok := cp.batches[seq]; ok {
+			delete(cp.batches, seq)
+			batch.remaining--
+			slices[batch.slice] = true
+		}
+	}
+	for slice := range slices {
+		slice.advance()
+	}
+	cp.saveIfNeeded(false)
+}
+
+// Save write the checkpoint to disk
+func (cp *Checkpoint) Save() error {
+	if cp == nil {
+		return nil
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.saveIfNeeded(true)
+}
+
+func (cp *Checkpoint) saveIfNeeded(force bool) error {
+	if !force && time.Since(cp.lastSave) < checkpointSaveInterval {
+		return nil
+	}
+	cp.lastSave = time.Now()
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	// write to a temp file first, so a crash never leaves a broken checkpoint
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Error(err)
+		return err
+	}
+	if err := os.Rename(tmp, cp.path); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Trace("checkpoint saved, ", cp.path)
+	return nil
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	goflags "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigFile is the content of --config, the keys are the long names of command line flags,
+// top-level keys are shared by all the jobs, ie:
+//
+//	source: http://localhost:9200
+//	source_auth: ${ES_USER}:${ES_PASS}
+//	jobs:
+//	  users:
+//	    src_indexes: users
+//	    dest_index: users_v2
+//
+// jobs can also be a list, named by the `name` key, or by their position: job-1, job-2...
+type ConfigFile struct {
+	Defaults map[string]interface{}
+	Jobs     map[string]map[string]interface{}
+	order    []string
+}
+
+// Job is the config of one migration
+type Job struct {
+	Name   string
+	Config *Config
+}
+
+// LoadConfigFile read the yaml or toml config file, decided by the extension
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("unknown config file type: %s, should be .yml, .yaml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	file := &ConfigFile{Defaults: values, Jobs: map[string]map[string]interface{}{}}
+	jobs, ok := values["jobs"]
+	if !ok {
+		return file, nil
+	}
+	delete(values, "jobs")
+
+	addJob := func(name string, job interface{}) error {
+		options, ok := job.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("job %s of config file %s should be a map of options", name, path)
+		}
+		if _, ok := file.Jobs[name]; ok {
+			return fmt.Errorf("duplicated job %s in config file %s", name, path)
+		}
+		file.Jobs[name] = options
+		file.order = append(file.order, name)
+		return nil
+	}
+
+	switch v := jobs.(type) {
+	case map[string]interface{}:
+		for name, job := range v {
+			if err := addJob(name, job); err != nil {
+				return nil, err
+			}
+		}
+		sort.Strings(file.order)
+	case []interface{}:
+		for i, job := range v {
+			name := fmt.Sprintf("job-%d", i+1)
+			if options, ok := job.(map[string]interface{}); ok {
+				if v, ok := options["name"].(string); ok {
+					name = v
+					delete(options, "name")
+				}
+			}
+			if err := addJob(name, job); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("jobs of config file %s should be a map or a list of jobs", path)
+	}
+	return file, nil
+}
+
+// JobNames return the names of jobs, in the order of list, or sorted for map
+func (file *ConfigFile) JobNames() []string {
+	return file.order
+}
+
+// JobValues return the options of job, merged with the shared ones. The job name can be
+// omitted when there is no more than one job
+func (file *ConfigFile) JobValues(name string) (map[string]interface{}, error) {
+	if len(name) == 0 {
+		if len(file.Jobs) > 1 {
+			return nil, fmt.Errorf("config file has multiple jobs, choose one by --job: %s", strings.Join(file.JobNames(), ", "))
+		}
+		for jobName := range file.Jobs {
+			name = jobName
+		}
+	}
+
+	values := map[string]interface{}{}
+	for k, v := range file.Defaults {
+		values[k] = v
+	}
+	if len(name) > 0 {
+		job, ok := file.Jobs[name]
+		if !ok {
+			return nil, fmt.Errorf("job %s not found in config file, available jobs: %s", name, strings.Join(file.JobNames(), ", "))
+		}
+		for k, v := range job {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replace ${NAME} or ${NAME:-default} with the environment variables, `$1` is kept
+// as it is, it may be a capture group of index rename rules
+func expandEnv(value string) (string, error) {
+	var err error
+	result := envPattern.ReplaceAllStringFunc(value, func(s string) string {
+		match := envPattern.FindStringSubmatch(s)
+		if v, ok := os.LookupEnv(match[1]); ok {
+			return v
+		}
+		if len(match[2]) > 0 {
+			return match[3]
+		}
+		err = fmt.Errorf("environment variable %s is not set", match[1])
+		return s
+	})
+	return result, err
+}
+
+// configArgs convert the values of config file into command line arguments, the flags which
+// were already set by the command line are skipped, so they override the config file
+func configArgs(parser *goflags.Parser, values map[string]interface{}) ([]string, error) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0)
+	for _, key := range keys {
+		if key == "config" || key == "job" || key == "all_jobs" {
+			return nil, fmt.Errorf("option %s is not allowed in config file", key)
+		}
+		option := parser.FindOptionByLongName(key)
+		if option == nil {
+			return nil, fmt.Errorf("unknown option in config file: %s", key)
+		}
+		if option.IsSet() && !option.IsSetDefault() {
+			continue
+		}
+
+		// a bool flag takes no argument, false is set by leaving it out, as the bool flags are false by default,
+		// it can be a string too, like `${ESM_SYNC:-false}`
+		if option.Field().Type.Kind() == reflect.Bool {
+			value := values[key]
+			if s, ok := value.(string); ok {
+				s, err := expandEnv(s)
+				if err != nil {
+					return nil, fmt.Errorf("option %s of config file: %v", key, err)
+				}
+				if value, err = strconv.ParseBool(strings.TrimSpace(s)); err != nil {
+					return nil, fmt.Errorf("invalid value of option %s in config file: %s, should be true or false", key, s)
+				}
+			}
+			enabled, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("invalid value of option %s in config file: %v, should be true or false", key, values[key])
+			}
+			if enabled {
+				args = append(args, "--"+key)
+			}
+			continue
+		}
+
+		items, ok := values[key].([]interface{})
+		if !ok {
+			items = []interface{}{values[key]}
+		}
+		for _, item := range items {
+			switch v := item.(type) {
+			case string:
+				s, err := expandEnv(v)
+				if err != nil {
+					return nil, fmt.Errorf("option %s of config file: %v", key, err)
+				}
+				args = append(args, "--"+key+"="+s)
+			case int, int64, uint64, float64:
+				args = append(args, fmt.Sprintf("--%s=%v", key, v))
+			default:
+				return nil, fmt.Errorf("invalid value of option %s in config file: %v", key, item)
+			}
+		}
+	}
+	return args, nil
+}
+
+// parseJobs parse the command line flags, merged with the selected jobs of --config file if specified
+func parseJobs(args []string) ([]Job, error) {
+	c := &Config{}
+	parser := goflags.NewParser(c, goflags.Default)
+	if _, err := parser.ParseArgs(args); err != nil {
+		return nil, err
+	}
+	if len(c.ConfigFile) == 0 {
+		if len(c.JobName) > 0 || c.AllJobs {
+			return nil, fmt.Errorf("--job and --all_jobs need the --config file")
+		}
+		return []Job{{Config: c}}, nil
+	}
+
+	file, err := LoadConfigFile(c.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{c.JobName}
+	if c.AllJobs {
+		names = file.JobNames()
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no jobs in config file %s", c.ConfigFile)
+		}
+	} else if strings.Contains(c.JobName, ",") {
+		names = strings.Split(c.JobName, ",")
+	}
+
+	jobs := make([]Job, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		values, err := file.JobValues(name)
+		if err != nil {
+			return nil, err
+		}
+		fileArgs, err := configArgs(parser, values)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %v", name, err)
+		}
+
+		// parse again with the config file in front, the defaults of flags are kept
+		jobConfig := &Config{}
+		if _, err := goflags.NewParser(jobConfig, goflags.Default).ParseArgs(append(fileArgs, args...)); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, Job{Name: name, Config: jobConfig})
+	}
+	return jobs, nil
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	goflags "github.com/jessevdk/go-flags"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		data     string
+		defaults map[string]interface{}
+		jobs     []string
+		err      string
+	}{
+		{
+			name:     "yaml without jobs",
+			file:     "esm.yml",
+			data:     "source: http://localhost:9200\nworkers: 4\n",
+			defaults: map[string]interface{}{"source": "http://localhost:9200", "workers": 4},
+		},
+		{
+			name:     "yaml map of jobs",
+			file:     "esm.yaml",
+			data:     "source: http://localhost:9200\njobs:\n  users:\n    src_indexes: users\n  logs:\n    src_indexes: logs-*\n",
+			defaults: map[string]interface{}{"source": "http://localhost:9200"},
+			jobs:     []string{"logs", "users"},
+		},
+		{
+			name:     "yaml list of jobs",
+			file:     "esm.yml",
+			data:     "jobs:\n  - name: users\n    src_indexes: users\n  - src_indexes: logs-*\n",
+			defaults: map[string]interface{}{},
+			jobs:     []string{"users", "job-2"},
+		},
+		{
+			name:     "toml",
+			file:     "esm.TOML",
+			data:     "source = \"http://localhost:9200\"\nsync = true\n[jobs.users]\nsrc_indexes = \"users\"\n",
+			defaults: map[string]interface{}{"source": "http://localhost:9200", "sync": true},
+			jobs:     []string{"users"},
+		},
+		{name: "unknown type", file: "esm.json", data: "{}", err: "unknown config file type"},
+		{name: "invalid yaml", file: "esm.yml", data: "source: [", err: "failed to parse config file"},
+		{name: "invalid job", file: "esm.yml", data: "jobs:\n  users: users\n", err: "job users of config file"},
+		{name: "duplicated job", file: "esm.yml", data: "jobs:\n  - name: a\n  - name: a\n", err: "duplicated job a"},
+		{name: "invalid jobs", file: "esm.yml", data: "jobs: users\n", err: "should be a map or a list of jobs"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), c.file)
+			if err := os.WriteFile(path, []byte(c.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := LoadConfigFile(path)
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(file.Defaults) != len(c.defaults) {
+				t.Errorf("got defaults %v, want %v", file.Defaults, c.defaults)
+			}
+			for k, v := range c.defaults {
+				if !reflect.DeepEqual(file.Defaults[k], v) && !reflect.DeepEqual(file.Defaults[k], int64(v.(int))) {
+					t.Errorf("got %s of %v, want %v", k, file.Defaults[k], v)
+				}
+			}
+			if !reflect.DeepEqual(file.JobNames(), c.jobs) {
+				t.Errorf("got jobs %v, want %v", file.JobNames(), c.jobs)
+			}
+		})
+	}
+}
+
+func TestJobValues(t *testing.T) {
+	file := &ConfigFile{
+		Defaults: map[string]interface{}{"source": "http://localhost:9200", "workers": 4},
+		Jobs: map[string]map[string]interface{}{
+			"users": {"src_indexes": "users", "workers": 8},
+			"logs":  {"src_indexes": "logs-*"},
+		},
+		order: []string{"logs", "users"},
+	}
+
+	values, err := file.JobValues("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"source": "http://localhost:9200", "workers": 8, "src_indexes": "users"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+	if _, err := file.JobValues(""); err == nil || !strings.Contains(err.Error(), "choose one by --job: logs, users") {
+		t.Errorf("got error %v, want choose one by --job", err)
+	}
+	if _, err := file.JobValues("tenants"); err == nil || !strings.Contains(err.Error(), "job tenants not found") {
+		t.Errorf("got error %v, want job not found", err)
+	}
+
+	// the only job is chosen without --job
+	delete(file.Jobs, "logs")
+	if values, err := file.JobValues(""); err != nil || values["src_indexes"] != "users" {
+		t.Errorf("got %v, %v, want the values of users", values, err)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("ESM_TEST_USER", "elastic")
+	t.Setenv("ESM_TEST_EMPTY", "")
+
+	cases := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{value: "${ESM_TEST_USER}:pass", want: "elastic:pass"},
+		{value: "${ESM_TEST_EMPTY:-default}", want: ""},
+		{value: "${ESM_TEST_MISSING:-default}", want: "default"},
+		{value: "${ESM_TEST_MISSING:-}", want: ""},
+		{value: "logs-*=>archive-$1", want: "logs-*=>archive-$1"},
+		{value: "$ESM_TEST_USER", want: "$ESM_TEST_USER"},
+		{value: "${ESM_TEST_MISSING}", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := expandEnv(c.value)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: got %s, want error", c.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.value, err)
+		} else if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.value, got, c.want)
+		}
+	}
+}
+
+func TestConfigArgs(t *testing.T) {
+	t.Setenv("ESM_TEST_SYNC", "true")
+
+	cases := []struct {
+		name   string
+		args   []string
+		values map[string]interface{}
+		want   []string
+		err    string
+	}{
+		{
+			name:   "values",
+			values: map[string]interface{}{"source": "http://localhost:9200", "workers": 4, "bulk_size": int64(10), "rename_index": []interface{}{"a=>b", "c=>d"}},
+			want:   []string{"--bulk_size=10", "--rename_index=a=>b", "--rename_index=c=>d", "--source=http://localhost:9200", "--workers=4"},
+		},
+		{
+			name:   "invalid bool",
+			values: map[string]interface{}{"sync": true, "refresh": false, "compress": "${ESM_TEST_SYNC}", "green": "false", "verify": "${ESM_TEST_VERIFY:-no}"},
+			err:    "invalid value of option verify in config file: no",
+		},
+		{
+			name:   "bools from env",
+			values: map[string]interface{}{"sync": true, "refresh": false, "compress": "${ESM_TEST_SYNC}", "green": "false", "verify": "${ESM_TEST_VERIFY:-0}"},
+			want:   []string{"--compress", "--sync"},
+		},
+		{
+			name:   "command line overrides",
+			args:   []string{"-w", "8", "--sync"},
+			values: map[string]interface{}{"workers": 4, "sync": false, "source": "http://localhost:9200"},
+			want:   []string{"--source=http://localhost:9200"},
+		},
+		{name: "number of bool", values: map[string]interface{}{"sync": 1}, err: "invalid value of option sync"},
+		{name: "bool of number", values: map[string]interface{}{"workers": true}, err: "invalid value of option workers"},
+		{name: "unknown option", values: map[string]interface{}{"sources": "a"}, err: "unknown option in config file: sources"},
+		{name: "nested config", values: map[string]interface{}{"config": "b.yml"}, err: "option config is not allowed"},
+		{name: "missing env", values: map[string]interface{}{"source_auth": "${ESM_TEST_MISSING}"}, err: "option source_auth of config file"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			parser := goflags.NewParser(&Config{}, goflags.Default)
+			if _, err := parser.ParseArgs(c.args); err != nil {
+				t.Fatal(err)
+			}
+			args, err := configArgs(parser, c.values)
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, c.want) {
+				t.Errorf("got %v, want %v", args, c.want)
+			}
+		})
+	}
+}
+
+func TestParseJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "esm.yml")
+	data := `
+source: http://localhost:9200
+dest: http://localhost:9201
+workers: 4
+sync: true
+jobs:
+  users:
+    src_indexes: users
+    dest_index: users_v2
+  logs:
+    src_indexes: logs-*
+    sync: false
+    rename_index: ["logs-*=>archive-$1"]
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type job struct {
+		Name    string
+		Source  string
+		Indexes string
+		Workers int
+		Sync    bool
+		Rename  []string
+	}
+	cases := []struct {
+		name string
+		args []string
+		want []job
+		err  string
+	}{
+		{
+			name: "one job",
+			args: []string{"--config", path, "--job", "users"},
+			want: []job{{Name: "users", Source: "http://localhost:9200", Indexes: "users", Workers: 4, Sync: true}},
+		},
+		{
+			name: "command line overrides",
+			args: []string{"--config", path, "--job", "logs", "-w", "8", "-s", "http://other:9200"},
+			want: []job{{Name: "logs", Source: "http://other:9200", Indexes: "logs-*", Workers: 8, Rename: []string{"logs-*=>archive-$1"}}},
+		},
+		{
+			name: "all jobs",
+			args: []string{"--config", path, "--all_jobs"},
+			want: []job{
+				{Name: "logs", Source: "http://localhost:9200", Indexes: "logs-*", Workers: 4, Rename: []string{"logs-*=>archive-$1"}},
+				{Name: "users", Source: "http://localhost:9200", Indexes: "users", Workers: 4, Sync: true},
+			},
+		},
+		{
+			name: "listed jobs",
+			args: []string{"--config", path, "--job", "users, logs"},
+			want: []job{
+				{Name: "users", Source: "http://localhost:9200", Indexes: "users", Workers: 4, Sync: true},
+				{Name: "logs", Source: "http://localhost:9200", Indexes: "logs-*", Workers: 4, Rename: []string{"logs-*=>archive-$1"}},
+			},
+		},
+		{
+			name: "without config",
+			args: []string{"-s", "http://localhost:9200", "-x", "users"},
+			want: []job{{Source: "http://localhost:9200", Indexes: "users", Workers: 1}},
+		},
+		{name: "job without config", args: []string{"--job", "users"}, err: "--job and --all_jobs need the --config file"},
+		{name: "missing job", args: []string{"--config", path, "--job", "tenants"}, err: "job tenants not found"},
+		{name: "multiple jobs", args: []string{"--config", path}, err: "choose one by --job"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			jobs, err := parseJobs(c.args)
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []job
+			for _, j := range jobs {
+				got = append(got, job{Name: j.Name, Source: j.Config.SourceEs, Indexes: j.Config.SourceIndexNames,
+					Workers: j.Config.Workers, Sync: j.Config.Sync, Rename: j.Config.RenameIndexes})
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// DiffEntry is one document which is different between source and target,
+// op is the change sync applies to the target: add, update or delete
+type DiffEntry struct {
+	Index   string        `json:"_index"`
+	Id      string        `json:"_id"`
+	Op      string        `json:"op"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// FieldChange is a field of `_source` which is different, the side without the field is omitted
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Source interface{} `json:"source,omitempty"`
+	Target interface{} `json:"target,omitempty"`
+}
+
+// DiffReport write the differences found by sync into file, as json lines or a json array
+type DiffReport struct {
+	lock   sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	format string
+	fields bool
+	count  int
+}
+
+// NewDiffReport create the report file, `-` for stdout
+func NewDiffReport(path string, format string, fields bool) (*DiffReport, error) {
+	if format != "ndjson" && format != "json" {
+		return nil, fmt.Errorf("unknown diff report format: %s, options: ndjson, json", format)
+	}
+
+	file := os.Stdout
+	if path != "-" {
+		var err error
+		file, err = os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := &DiffReport{file: file, w: bufio.NewWriter(file), format: format, fields: fields}
+	if format == "json" {
+		report.w.WriteString("[")
+	}
+	return report, nil
+}
+
+// IsStdout tell whether the report is written to stdout, where nothing else should be printed
+func (r *DiffReport) IsStdout() bool {
+	return r != nil && r.file == os.Stdout
+}
+
+// Add write a different document, the field-level changes are only computed for updates
+func (r *DiffReport) Add(index string, op string, id string, srcSource interface{}, dstSource interface{}) {
+	if r == nil {
+		return
+	}
+
+	entry := DiffEntry{Index: index, Id: id, Op: op}
+	if r.fields && srcSource != nil && dstSource != nil {
+		entry.Changes = make([]FieldChange, 0)
+		diffSource("", srcSource, dstSource, &entry.Changes)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.format == "json" {
+		if r.count > 0 {
+			r.w.WriteString(",")
+		}
+		r.w.WriteString("\n")
+	}
+	r.w.Write(data)
+	if r.format == "ndjson" {
+		r.w.WriteString("\n")
+	}
+	r.count++
+}
+
+// Close flush the report, the json array is closed
+func (r *DiffReport) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.format == "json" {
+		r.w.WriteString("\n]\n")
+	}
+	if err := r.w.Flush(); err != nil {
+		return err
+	}
+	if r.file == os.Stdout {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// diffSource collect the different fields of two `_source`, nested objects are compared field by field,
+// with dotted paths, other values are compared as a whole
+func diffSource(prefix string, src interface{}, dst interface{}, changes *[]FieldChange) {
+	srcMap, srcOk := src.(map[string]interface{})
+	dstMap, dstOk := dst.(map[string]interface{})
+	if !srcOk || !dstOk {
+		if !reflect.DeepEqual(src, dst) {
+			*changes = append(*changes, FieldChange{Field: prefix, Source: src, Target: dst})
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(srcMap)+len(dstMap))
+	for k := range srcMap {
+		keys = append(keys, k)
+	}
+	for k := range dstMap {
+		if _, ok := srcMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		field := k
+		if len(prefix) > 0 {
+			field = prefix + "." + k
+		}
+		srcValue, srcFound := srcMap[k]
+		dstValue, dstFound := dstMap[k]
+		if !srcFound || !dstFound {
+			*changes = append(*changes, FieldChange{Field: field, Source: srcValue, Target: dstValue})
+			continue
+		}
+		diffSource(field, srcValue, dstValue, changes)
+	}
+}
@@ -16,7 +16,12 @@ limitations under the License.
 
 package main
 
-import "sync"
+import (
+	"github.com/cheggaaa/pb"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 type Indexes map[string]interface{}
 
@@ -24,13 +29,17 @@ type Document struct {
 	Index   string                 `json:"_index,omitempty"`
 	Type    string                 `json:"_type,omitempty"`
 	Id      string                 `json:"_id,omitempty"`
-	source  map[string]interface{} `json:"_source,omitempty"`
+	source  map[string]interface{} `json:"-"`
 	Routing string                 `json:"routing,omitempty"` //after 6, only `routing` was supported
+
+	Version     interface{} `json:"version,omitempty"`
+	VersionType string      `json:"version_type,omitempty"`
 }
 
 type Scroll struct {
 	Took     int    `json:"took,omitempty"`
 	ScrollId string `json:"_scroll_id,omitempty"`
+	PitId    string `json:"pit_id,omitempty"`
 	TimedOut bool   `json:"timed_out,omitempty"`
 	Hits     struct {
 		MaxScore float32       `json:"max_score,omitempty"`
@@ -49,6 +58,8 @@ type Scroll struct {
 			Reason interface{} `json:"reason,omitempty"`
 		} `json:"failures,omitempty"`
 	} `json:"_shards,omitempty"`
+
+	checkpoint *SliceCheckpoint
 }
 
 type ScrollV7 struct {
@@ -69,9 +80,37 @@ type ClusterVersion struct {
 	Version     struct {
 		Number        string `json:"number,omitempty"`
 		LuceneVersion string `json:"lucene_version,omitempty"`
+		Distribution  string `json:"distribution,omitempty"` //only reported by opensearch
 	} `json:"version,omitempty"`
 }
 
+// IsAtLeast check whether the version is not older than major.minor
+func (v *ClusterVersion) IsAtLeast(major int, minor int) bool {
+	parts := strings.SplitN(v.Version.Number, ".", 3)
+	if v.MajorVersion() != major || len(parts) < 2 {
+		return v.MajorVersion() > major
+	}
+	vMinor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return vMinor >= minor
+}
+
+// IsOpenSearch check whether the cluster is opensearch, instead of elasticsearch
+func (v *ClusterVersion) IsOpenSearch() bool {
+	return strings.EqualFold(v.Version.Distribution, "opensearch")
+}
+
+// MajorVersion return the major part of version number, ie: 7 for 7.10.2
+func (v *ClusterVersion) MajorVersion() int {
+	major, err := strconv.Atoi(strings.SplitN(v.Version.Number, ".", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return major
+}
+
 type ClusterHealth struct {
 	Name   string `json:"cluster_name,omitempty"`
 	Status string `json:"status,omitempty"`
@@ -100,6 +139,21 @@ type Migrator struct {
 	SourceAuth  *Auth
 	TargetAuth  *Auth
 	Config      *Config
+	DeadLetter  *DeadLetterWriter
+	BulkStats   BulkStats
+	Checkpoint  *Checkpoint
+
+	IndexRenameRules []IndexRenameRule
+	DiffReport       *DiffReport
+	Pipeline         *Pipeline
+	Rejected         *DeadLetterWriter
+	TransformStats   TransformStats
+	LogstashStats    LogstashStats
+
+	// name of the job, and the progress bar pool shared by batch jobs
+	Name  string
+	Pool  *pb.Pool
+	Stats JobStats
 }
 
 type Config struct {
@@ -107,7 +161,7 @@ type Config struct {
 	// config options
 	SourceEs            string `short:"s" long:"source"  description:"source elasticsearch instance, ie: http://localhost:9200"`
 	Query               string `short:"q" long:"query"  description:"query against source elasticsearch instance, filter data before migrate, ie: name:medcl"`
-	SortField           string `long:"sort" description:"sort field when scroll, ie: _id" default:"_id"`
+	SortField           string `long:"sort" description:"sort fields when scroll, separated by comma, with the order asc or desc after colon, ie: @timestamp:desc,_id:asc, _doc(index order, the fastest) by default, _id for --sync and --diff"`
 	TargetEs            string `short:"d" long:"dest"    description:"destination elasticsearch instance, ie: http://localhost:9201"`
 	SourceEsAuthStr     string `short:"m" long:"source_auth"  description:"basic auth of source elasticsearch instance, ie: user:pass"`
 	TargetEsAuthStr     string `short:"n" long:"dest_auth"  description:"basic auth of target elasticsearch instance, ie: user:pass"`
@@ -131,6 +185,9 @@ type Config struct {
 	TruncateOutFile     bool   `long:"truncate_output" description:"truncate before dump to output file" `
 	DumpInputFile       string `short:"i" long:"input_file"            description:"indexing from local dump file" `
 	InputFileType       string `long:"input_file_type"                 description:"the data type of input file, options: dump, json_line, json_array, log_line" default:"dump" `
+	SplitDocs           int    `long:"split_docs"                      description:"rotate the output file after so many documents, the chunks are listed in a manifest file, ie: dump-00001.json and dump.manifest.json" `
+	SplitSizeInMB       int    `long:"split_size"                      description:"rotate the output file after so many MB, the chunks are listed in a manifest file" `
+	FileCompression     string `long:"file_compress"                   description:"compression of input/output file, options: gzip, zstd, none, decided by the extension(.gz, .zst) if not specified" `
 	SourceProxy         string `long:"source_proxy"            description:"set proxy to source http connections, ie: http://127.0.0.1:8080"`
 	TargetProxy         string `long:"dest_proxy"            description:"set proxy to target http connections, ie: http://127.0.0.1:8080"`
 	Refresh             bool   `long:"refresh"                 description:"refresh after migration finished"`
@@ -138,13 +195,60 @@ type Config struct {
 	Fields              string `long:"fields"                 description:"filter source fields(white list), comma separated, ie: col1,col2,col3,..." `
 	SkipFields          string `long:"skip"                   description:"skip source fields(black list), comma separated, ie: col1,col2,col3,..." `
 	RenameFields        string `long:"rename"                 description:"rename source fields, comma separated, ie: _type:type, name:myname" `
-	LogstashEndpoint    string `short:"l"  long:"logstash_endpoint"    description:"target logstash tcp endpoint, ie: 127.0.0.1:5055" `
+	LogstashEndpoint    string `short:"l"  long:"logstash_endpoint"    description:"target logstash tcp endpoints, comma separated, each of --workers connects to one of them, ie: 127.0.0.1:5055" `
 	LogstashSecEndpoint bool   `long:"secured_logstash_endpoint"    description:"target logstash tcp endpoint was secured by TLS" `
 
 	RepeatOutputTimes         int  `long:"repeat_times"            description:"repeat the data from source N times to dest output, use align with parameter regenerate_id to amplify the data size "`
 	RegenerateID              bool `short:"r" long:"regenerate_id"   description:"regenerate id for documents, this will override the exist document id in data source"`
 	Compress                  bool `long:"compress"            description:"use gzip to compress traffic"`
 	SleepSecondsAfterEachBulk int  `short:"p" long:"sleep" description:"sleep N seconds after each bulk request" default:"-1"`
+
+	BulkRetries    int    `long:"bulk_retries" description:"max retries for bulk items rejected by a busy cluster(429/503), with exponential backoff up to 30s" default:"3"`
+	DeadLetterFile string `long:"dead_letter_file" description:"write documents failed to bulk into this file, it can be replayed by -i, ie: failed.json"`
+	CheckpointFile string `long:"checkpoint" description:"save the scroll progress into this file, so an interrupted migration can be resumed, need --sort starts with a field supports range query, ie: @timestamp"`
+	Resume         bool   `long:"resume" description:"resume the migration from the progress saved in --checkpoint"`
+	SearchAfter    bool   `long:"search_after" description:"read source with search_after instead of scroll, inside a point in time for 7.10+, sliced by --sliced_scroll_size, no search context is held between requests on older versions"`
+
+	ConfigFile     string `long:"config" description:"load options from yaml or toml config file, the keys are the long names of flags, secrets can be ${ENV}, flags of command line override it, ie: esm.yml"`
+	JobName        string `long:"job" description:"the jobs to run in --config file, comma separated, ie: users,logs"`
+	AllJobs        bool   `long:"all_jobs" description:"run all the jobs in --config file"`
+	JobConcurrency int    `long:"job_concurrency" description:"number of jobs to run in parallel" default:"1"`
+
+	VerifyMigration bool `long:"verify" description:"compare the document counts of source and target indexes after migration"`
+	VerifyHash      bool `long:"verify_hash" description:"compare the hash of _source of every document too, both sides are read sorted by _id, or looked up by _id for 8.x, implies --verify"`
+
+	DiffOnly       bool   `long:"diff" description:"compare source and target index like --sync, but only report the differences into --diff_report, the target is not changed"`
+	DiffReportFile string `long:"diff_report" description:"write every different document of --sync or --diff into this file, - for stdout, ie: diff.ndjson"`
+	DiffFormat     string `long:"diff_format" description:"format of --diff_report, options: ndjson, json" default:"ndjson"`
+	DiffFields     bool   `long:"diff_fields" description:"include the different fields of _source in --diff_report"`
+
+	SyncBufferCount int    `long:"sync_buffer" description:"max documents with the same sort key held in memory by --sync, the more are spilled into --sync_spill_dir" default:"10000"`
+	SyncSpillDir    string `long:"sync_spill_dir" description:"directory to spill the documents with the same sort key over --sync_buffer, ie: /tmp"`
+
+	BulkAction  string `long:"bulk_action" description:"action of bulk requests, options: index, create(skip the documents exist in target)" default:"index"`
+	VersionType string `long:"version_type" description:"write documents with the version of source, the older ones are rejected by target, options: external, external_gte"`
+	VersionFrom string `long:"version_from" description:"version of source documents used by --version_type, options: version(_version), seq_no(_seq_no, 6.7+)" default:"version"`
+
+	QueryDSL string `long:"query_dsl" description:"query dsl against source elasticsearch instance instead of --query, inline json or @file, passed through as the query of search requests, ie: @query.json"`
+
+	Filters []string `long:"filter" description:"keep the documents matched on client side, works for -i too, can be repeated, all should match, join predicates by || to match any, prefix ! to negate, ie: equals:status=active, exists:email, range:price=10..100, regex:name=^me, !exists:deleted_at"`
+
+	TransformScript string `long:"transform_script" description:"javascript file with a function transform(doc) applied to every document after --transform, change doc._source, doc._id, doc._index or doc._routing in place, return false to drop it, ie: transform.js"`
+	RejectedFile    string `long:"rejected_file" description:"write documents failed to transform into this file, with the error, it can be replayed by -i, ie: rejected.json"`
+
+	Transforms []string `long:"transform" description:"transform documents before output, can be repeated, applied in order, ie: rename:user.name=>user.full_name, copy:a=>b, remove:a,b, set:a=1, convert:a=>int, date:a=>2006-01-02=>epoch_millis"`
+
+	Follow          bool   `long:"follow" description:"keep copying the new documents found by --follow_field after the migration, until interrupted"`
+	FollowField     string `long:"follow_field" description:"timestamp field to find the new documents for --follow, ie: @timestamp"`
+	FollowStateFile string `long:"follow_state" description:"save the high water mark of --follow into this file, it's continued from there after restart, ie: follow.json"`
+	FollowInterval  int    `long:"follow_interval" description:"seconds to sleep between the rounds of --follow" default:"60"`
+	FollowReconcile int    `long:"follow_reconcile" description:"every N seconds, remove the documents deleted from source by comparing both sides like --sync, 0 to disable" default:"0"`
+
+	RenameIndexes []string `long:"rename_index" description:"rename target indexes, can be repeated, the first matched rule wins, * and ? are capture groups, or a regexp between slashes, ie: src-*=>dst-$1-v2, /logs-(\\d+)/=>archive-$1"`
+
+	LogstashCA       string `long:"logstash_ca" description:"CA certificate file in PEM to verify the TLS certificate of --secured_logstash_endpoint, the system CAs are used if not specified, ie: ca.pem"`
+	LogstashInsecure bool   `long:"logstash_insecure" description:"skip verifying the TLS certificate of --secured_logstash_endpoint"`
+	LogstashRetries  int    `long:"logstash_retries" description:"max retries to reconnect and resend to logstash, the documents are failed after that" default:"5"`
 }
 
 type Auth struct {
@@ -21,16 +21,20 @@ import "bytes"
 type ESAPI interface {
 	ClusterHealth() *ClusterHealth
 	ClusterVersion() *ClusterVersion
-	Bulk(data *bytes.Buffer) error
+	Bulk(data *bytes.Buffer) (*BulkResponse, error)
 	GetIndexSettings(indexNames string) (*Indexes, error)
 	DeleteIndex(name string) error
 	CreateIndex(name string, settings map[string]interface{}) error
 	GetIndexMappings(copyAllIndexes bool, indexNames string) (string, int, *Indexes, error)
 	UpdateIndexSettings(indexName string, settings map[string]interface{}) error
 	UpdateIndexMapping(indexName string, mappings map[string]interface{}) error
-	NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-		slicedId int, maxSlicedCount int, fields string) (ScrollAPI, error)
+	NewScroll(indexNames string, scrollTime string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+		sort string, slicedId int, maxSlicedCount int, fields string) (ScrollAPI, error)
 	NextScroll(scrollTime string, scrollId string) (ScrollAPI, error)
+	NewSearchAfter(indexNames string, keepAlive string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+		sort string, slicedId int, maxSlicedCount int, fields string, searchAfter []interface{}) (ScrollAPI, error)
 	DeleteScroll(scrollId string) error
 	Refresh(name string) (err error)
+	Count(indexNames string, query SearchQuery) (int, error)
+	MaxValue(indexNames string, field string, query SearchQuery) (interface{}, error)
 }
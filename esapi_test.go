@@ -0,0 +1,72 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetIndexMappingsPatterns(t *testing.T) {
+	indexes := []string{"app-logs", "logs-1", "logs-2", "metrics-1", "other"}
+
+	// answer _mapping like elasticsearch, the comma separated names and wildcards are resolved by the server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		patterns := strings.Split(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/_mapping"), ",")
+		var items []string
+		for _, name := range indexes {
+			for _, pattern := range patterns {
+				prefix, suffix, wildcard := strings.Cut(pattern, "*")
+				if pattern == "_all" || pattern == name ||
+					(wildcard && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix)) {
+					items = append(items, `"`+name+`":{"mappings":{"properties":{}}}`)
+					break
+				}
+			}
+		}
+		w.Write([]byte("{" + strings.Join(items, ",") + "}"))
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		names string
+		want  string
+	}{
+		{"_all", "app-logs,logs-1,logs-2,metrics-1,other"},
+		{"logs-*", "logs-1,logs-2"},
+		{"logs-*,metrics-*", "logs-1,logs-2,metrics-1"},
+		{"*-logs", "app-logs"},
+		{"logs-1,other", "logs-1,other"},
+		{"none-*", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.names, func(t *testing.T) {
+			for _, api := range []ESAPI{&ESAPIV0{Host: server.URL}, &ESAPIV6{ESAPIV5{ESAPIV0{Host: server.URL}}}, &ESAPIV7{ESAPIV6{ESAPIV5{ESAPIV0{Host: server.URL}}}}} {
+				got, _, _, err := api.GetIndexMappings(false, c.names)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != c.want {
+					t.Errorf("%T: got %s, want %s", api, got, c.want)
+				}
+			}
+		})
+	}
+}
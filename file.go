@@ -18,9 +18,15 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/cheggaaa/pb"
 	log "github.com/cihub/seelog"
+	"github.com/klauspost/compress/zstd"
+	"hash"
 	"io"
 	"os"
 	"strings"
@@ -35,77 +41,348 @@ func checkFileIsExist(filename string) bool {
 	return exist
 }
 
-func (m *Migrator) NewFileReadWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
-	log.Debug("start reading file")
-	f, err := os.Open(m.Config.DumpInputFile)
+// getFileCompression return the compression of file, decided by the extension if not specified
+func getFileCompression(path string, compression string) (string, error) {
+	switch strings.ToLower(compression) {
+	case "gzip", "gz":
+		return "gzip", nil
+	case "zstd", "zst":
+		return "zstd", nil
+	case "none":
+		return "", nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown file compression: %s", compression)
+	}
+
+	lowerPath := strings.ToLower(path)
+	if strings.HasSuffix(lowerPath, ".gz") {
+		return "gzip", nil
+	} else if strings.HasSuffix(lowerPath, ".zst") || strings.HasSuffix(lowerPath, ".zstd") {
+		return "zstd", nil
+	}
+	return "", nil
+}
+
+// compressWriter is a writer which may buffer data inside, Flush writes them out
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type plainWriter struct {
+	io.Writer
+}
+
+func (w plainWriter) Flush() error {
+	return nil
+}
+
+func (w plainWriter) Close() error {
+	return nil
+}
+
+func newCompressWriter(w io.Writer, compression string) (compressWriter, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return plainWriter{w}, nil
+}
+
+type compressedFile struct {
+	io.Reader
+	file  *os.File
+	close func() error
+}
+
+func (f *compressedFile) Close() error {
+	if f.close != nil {
+		f.close()
+	}
+	return f.file.Close()
+}
+
+// openInputFile open the file for read, the data is decompressed if needed
+func openInputFile(path string, compression string) (io.ReadCloser, error) {
+	compression, err := getFileCompression(path, compression)
 	if err != nil {
-		log.Error(err)
-		return
+		return nil, err
 	}
 
-	defer f.Close()
-	r := bufio.NewReader(f)
-	lineCount := 0
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case "gzip":
+		r, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedFile{Reader: r, file: f, close: r.Close}, nil
+	case "zstd":
+		r, err := zstd.NewReader(bufio.NewReader(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedFile{Reader: r, file: f, close: func() error {
+			r.Close()
+			return nil
+		}}, nil
+	}
+	return f, nil
+}
+
+// readLines call fn with every non-empty line of r, including the last one without line break
+func readLines(r *bufio.Reader, fn func(line string)) error {
 	for {
 		line, err := r.ReadString('\n')
-		if io.EOF == err || nil != err {
-			break
+		if len(strings.TrimSpace(line)) > 0 {
+			fn(line)
+		}
+		if io.EOF == err {
+			return nil
 		}
-		lineCount += 1
-		js := map[string]interface{}{}
-
-		err = DecodeJson(line, &js)
 		if err != nil {
-			log.Error(err)
-			continue
+			return err
 		}
-		m.DocChan <- js
-		pb.Increment()
 	}
+}
+
+// readJsonArray call fn with every element of the top-level json array in r, one by one
+func readJsonArray(r io.Reader, fn func(element json.RawMessage)) error {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return errors.New("input file is not a json array")
+	}
+	for decoder.More() {
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			return err
+		}
+		fn(element)
+	}
+	_, err = decoder.Token()
+	return err
+}
 
+// countFileDocs count the documents of input file, to show the progress
+func countFileDocs(path string, fileType string, compression string) (int, error) {
+	f, err := openInputFile(path, compression)
+	if err != nil {
+		return 0, err
+	}
 	defer f.Close()
+
+	count := 0
+	if fileType == "json_array" {
+		err = readJsonArray(bufio.NewReader(f), func(element json.RawMessage) {
+			count++
+		})
+	} else {
+		err = readLines(bufio.NewReader(f), func(line string) {
+			count++
+		})
+	}
+	return count, err
+}
+
+// wrapFileDoc wrap a raw document of input file into the dump format, the index and type
+// are taken from -y and -u, the `_id` of document is used unless --regenerate_id
+func (m *Migrator) wrapFileDoc(source map[string]interface{}) map[string]interface{} {
+	id := ""
+	if v, ok := source["_id"]; ok {
+		delete(source, "_id")
+		if !m.Config.RegenerateID {
+			id = fmt.Sprint(v)
+		}
+	}
+
+	docType := m.Config.OverrideTypeName
+	if len(docType) == 0 {
+		docType = "_doc"
+	}
+
+	return map[string]interface{}{
+		"_index":  m.Config.TargetIndexName,
+		"_type":   docType,
+		"_id":     id,
+		"_source": source,
+	}
+}
+
+func (m *Migrator) NewFileReadWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
+	log.Debug("start reading file")
+	defer wg.Done()
+	defer close(m.DocChan)
+
+	if err := m.readInputFile(m.Config.DumpInputFile, m.Config.InputFileType, m.Config.FileCompression, pb); err != nil {
+		log.Error(err)
+	}
+
 	log.Debug("end reading file")
-	close(m.DocChan)
-	wg.Done()
+}
+
+// readInputFile send all the documents of file to the doc chan
+func (m *Migrator) readInputFile(path string, fileType string, compression string, pb *pb.ProgressBar) error {
+	f, err := openInputFile(path, compression)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	switch fileType {
+	case "json_array":
+		return readJsonArray(r, func(element json.RawMessage) {
+			source := map[string]interface{}{}
+			if err := DecodeJsonBytes(element, &source); err != nil {
+				log.Error(err)
+				return
+			}
+			m.DocChan <- m.wrapFileDoc(source)
+			pb.Increment()
+		})
+	default:
+		return readLines(r, func(line string) {
+			js := map[string]interface{}{}
+			switch fileType {
+			case "log_line":
+				js = m.wrapFileDoc(map[string]interface{}{
+					"message": strings.TrimRight(line, "\r\n"),
+				})
+			case "json_line":
+				if err := DecodeJson(line, &js); err != nil {
+					log.Error(err)
+					return
+				}
+				js = m.wrapFileDoc(js)
+			default:
+				if err := DecodeJson(line, &js); err != nil {
+					log.Error(err)
+					return
+				}
+			}
+			m.DocChan <- js
+			pb.Increment()
+		})
+	}
+}
+
+// dumpFile is one output file of dump, the size and checksum of the data written to disk are tracked
+type dumpFile struct {
+	path    string
+	file    *os.File
+	cw      compressWriter
+	w       *bufio.Writer
+	hash    hash.Hash
+	size    int64
+	docs    int
+	indexes map[string]bool
+}
+
+func (d *dumpFile) Write(p []byte) (int, error) {
+	n, err := d.file.Write(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+func openDumpFile(path string, flag int, compression string) (*dumpFile, error) {
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dumpFile{path: path, file: f, hash: sha256.New(), indexes: map[string]bool{}}
+	d.cw, err = newCompressWriter(d, compression)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.w = bufio.NewWriter(d.cw)
+	return d, nil
+}
+
+func (d *dumpFile) WriteDoc(doc map[string]interface{}, data []byte) error {
+	d.docs++
+	if index, ok := doc["_index"].(string); ok {
+		d.indexes[index] = true
+	}
+	if _, err := d.w.Write(data); err != nil {
+		return err
+	}
+	return d.w.WriteByte('\n')
+}
+
+func (d *dumpFile) Flush() error {
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	return d.cw.Flush()
+}
+
+func (d *dumpFile) Close() error {
+	if err := d.w.Flush(); err != nil {
+		d.file.Close()
+		return err
+	}
+	if err := d.cw.Close(); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
 }
 
 func (c *Migrator) NewFileDumpWorker(pb *pb.ProgressBar, wg *sync.WaitGroup) {
-	var f *os.File
-	var err1 error
+	defer wg.Done()
+
+	compression, err := getFileCompression(c.Config.DumpOutFile, c.Config.FileCompression)
+	if err != nil {
+		log.Error(err)
+		return
+	}
 
-	if checkFileIsExist(c.Config.DumpOutFile) {
-		flag := os.O_WRONLY
+	// with --split_docs or --split_size, the output is rotated into chunks listed by a manifest
+	var manifest *DumpManifest
+	var out *dumpFile
+	if c.Config.SplitDocs > 0 || c.Config.SplitSizeInMB > 0 {
+		manifest, err = c.newDumpManifest(compression)
+	} else {
+		flag := os.O_CREATE | os.O_WRONLY
 		if c.Config.TruncateOutFile {
 			flag |= os.O_TRUNC
 		} else {
 			flag |= os.O_APPEND
 		}
-		f, err1 = os.OpenFile(c.Config.DumpOutFile, flag, os.ModeAppend)
-		if err1 != nil {
-			log.Error(err1)
-			return
-		}
-
-	} else {
-		f, err1 = os.Create(c.Config.DumpOutFile)
-		if err1 != nil {
-			log.Error(err1)
-			return
-		}
+		out, err = openDumpFile(c.Config.DumpOutFile, flag, compression)
+	}
+	if err != nil {
+		log.Error(err)
+		return
 	}
 
-	w := bufio.NewWriter(f)
-	skipFields := make([]string, 0)
-	if len(c.Config.SkipFields) > 0 {
-		//skip fields
-		if !strings.Contains(c.Config.SkipFields, ",") {
-			skipFields = append(skipFields, c.Config.SkipFields)
-		} else {
-			fields := strings.Split(c.Config.SkipFields, ",")
-			for _, field := range fields {
-				skipFields = append(skipFields, field)
-			}
+	// sequence numbers of the documents written, acknowledged to checkpoint after flush
+	writtenSeqs := make([]uint64, 0)
+
+	closeChunk := func() {
+		if err := out.Close(); err != nil {
+			log.Error(err)
 		}
+		if err := manifest.AddChunk(out); err != nil {
+			log.Error(err)
+		}
+		out = nil
 	}
 
 READ_DOCS:
@@ -120,29 +397,52 @@ READ_DOCS:
 		}
 
 		// sanity check
-		for _, key := range []string{"_index", "_type", "_source", "_id"} {
+		for _, key := range []string{"_index", "_source", "_id"} {
 			if _, ok := docI[key]; !ok {
 				break READ_DOCS
 			}
 		}
-		for _, key := range skipFields {
-			if _, found := docI[key]; found {
-				delete(docI, key)
-			}
+		seq := takeCheckpointSeq(docI)
+		if !c.transformDoc(docI, seq) {
+			continue
 		}
 
 		jsr, err := json.Marshal(docI)
-		log.Trace(string(jsr))
 		if err != nil {
-			log.Error(err)
+			c.rejectDoc(nil, docI["_id"], seq, err)
+			continue
 		}
-		n, err := w.WriteString(string(jsr))
-		if err != nil {
-			log.Error(n, err)
+		log.Trace(string(jsr))
+
+		if out == nil {
+			out, err = openDumpFile(manifest.NextChunkPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, compression)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		}
+		if err := out.WriteDoc(docI, jsr); err != nil {
+			// not acknowledged, it's copied again once resumed
+			log.Error(err)
+			continue
 		}
-		w.WriteString("\n")
 		pb.Increment()
 
+		if c.Checkpoint != nil {
+			writtenSeqs = append(writtenSeqs, seq)
+			if len(writtenSeqs) >= c.Config.DocBufferCount {
+				out.Flush()
+				c.Checkpoint.Ack(writtenSeqs...)
+				writtenSeqs = writtenSeqs[:0]
+			}
+		}
+
+		if manifest != nil && manifest.IsChunkFull(out, c.Config.SplitDocs, c.Config.SplitSizeInMB) {
+			closeChunk()
+			c.Checkpoint.Ack(writtenSeqs...)
+			writtenSeqs = writtenSeqs[:0]
+		}
+
 		// if channel is closed flush and gtfo
 		if !open {
 			goto WORKER_DONE
@@ -150,9 +450,15 @@ READ_DOCS:
 	}
 
 WORKER_DONE:
-	w.Flush()
-	f.Close()
+	if manifest != nil {
+		if out != nil {
+			closeChunk()
+		}
+		log.Infof("dumped %d documents into %d chunks, manifest: %s", manifest.TotalDocs, len(manifest.Chunks), manifest.path)
+	} else if err := out.Close(); err != nil {
+		log.Error(err)
+	}
+	c.Checkpoint.Ack(writtenSeqs...)
 
-	wg.Done()
 	log.Debug("file dump finished")
 }
@@ -0,0 +1,265 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/cheggaaa/pb"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetFileCompression(t *testing.T) {
+	cases := []struct {
+		path        string
+		compression string
+		want        string
+		err         bool
+	}{
+		{path: "dump.json", want: ""},
+		{path: "dump.json.gz", want: "gzip"},
+		{path: "DUMP.JSON.GZ", want: "gzip"},
+		{path: "dump.json.zst", want: "zstd"},
+		{path: "dump.json.zstd", want: "zstd"},
+		{path: "dump.gz.json", want: ""},
+		{path: "dump.json", compression: "gzip", want: "gzip"},
+		{path: "dump.json", compression: "gz", want: "gzip"},
+		{path: "dump.json", compression: "ZSTD", want: "zstd"},
+		{path: "dump.json", compression: "zst", want: "zstd"},
+		{path: "dump.json.gz", compression: "none", want: ""},
+		{path: "dump.json.gz", compression: "zstd", want: "zstd"},
+		{path: "dump.json", compression: "bzip2", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path+"/"+c.compression, func(t *testing.T) {
+			got, err := getFileCompression(c.path, c.compression)
+			if c.err {
+				if err == nil {
+					t.Fatalf("got %s, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCompressedFileRoundTrip(t *testing.T) {
+	data := `{"_id":"1","_source":{"v":1}}` + "\n" + `{"_id":"2","_source":{"v":2}}` + "\n"
+
+	cases := []struct {
+		name        string
+		file        string
+		compression string
+		// the magic bytes the file starts with, empty for plain text
+		magic string
+	}{
+		{name: "plain", file: "dump.json", magic: ""},
+		{name: "gzip by extension", file: "dump.json.gz", magic: "\x1f\x8b"},
+		{name: "zstd by extension", file: "dump.json.zst", magic: "\x28\xb5\x2f\xfd"},
+		{name: "gzip by flag", file: "dump.json", compression: "gzip", magic: "\x1f\x8b"},
+		{name: "plain by flag", file: "dump.json.gz", compression: "none", magic: ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), c.file)
+			compression, err := getFileCompression(path, c.compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := openDumpFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.w.WriteString(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.magic) > 0 && string(raw[:len(c.magic)]) != c.magic {
+				t.Errorf("got file starts with %x, want %x", raw[:len(c.magic)], c.magic)
+			}
+			if len(c.magic) == 0 && string(raw) != data {
+				t.Errorf("got plain file %q, want %q", raw, data)
+			}
+
+			r, err := openInputFile(path, c.compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != data {
+				t.Errorf("got %q, want %q", got, data)
+			}
+		})
+	}
+}
+
+func TestReadInputFile(t *testing.T) {
+	cases := []struct {
+		name     string
+		fileType string
+		data     string
+		want     string
+		// the lines or elements counted for the progress, the invalid ones included
+		count int
+		err   bool
+	}{
+		{
+			name:     "dump",
+			fileType: "dump",
+			data:     `{"_index":"src","_type":"doc","_id":"1","_source":{"v":1}}` + "\n\n",
+			want:     `[{"_index":"src","_type":"doc","_id":"1","_source":{"v":1}}]`,
+			count:    1,
+		},
+		{
+			name:     "json line",
+			fileType: "json_line",
+			data:     `{"_id":"1","v":1}` + "\n" + `{"v":9007199254740993}` + "\n" + `not json` + "\n" + `{"_id":3,"v":3}`,
+			want: `[{"_index":"dst","_type":"_doc","_id":"1","_source":{"v":1}},
+				{"_index":"dst","_type":"_doc","_id":"","_source":{"v":9007199254740993}},
+				{"_index":"dst","_type":"_doc","_id":"3","_source":{"v":3}}]`,
+			count: 4,
+		},
+		{
+			name:     "json array",
+			fileType: "json_array",
+			data:     `[{"_id":"1","v":1},` + "\n" + `{"v":{"nested":[1,2]}}]`,
+			want: `[{"_index":"dst","_type":"_doc","_id":"1","_source":{"v":1}},
+				{"_index":"dst","_type":"_doc","_id":"","_source":{"v":{"nested":[1,2]}}}]`,
+			count: 2,
+		},
+		{
+			name:     "empty json array",
+			fileType: "json_array",
+			data:     `[]`,
+			want:     `[]`,
+		},
+		{
+			name:     "not json array",
+			fileType: "json_array",
+			data:     `{"v":1}`,
+			err:      true,
+		},
+		{
+			name:     "log line",
+			fileType: "log_line",
+			data:     "first line\r\n  \nsecond {\"v\":1}",
+			want: `[{"_index":"dst","_type":"_doc","_id":"","_source":{"message":"first line"}},
+				{"_index":"dst","_type":"_doc","_id":"","_source":{"message":"second {\"v\":1}"}}]`,
+			count: 2,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "input.json")
+			if err := os.WriteFile(path, []byte(c.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{Config: &Config{TargetIndexName: "dst"}, DocChan: make(chan map[string]interface{}, 10)}
+			err := m.readInputFile(path, c.fileType, "", pb.New(0))
+			close(m.DocChan)
+			if c.err {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			docs := []map[string]interface{}{}
+			for doc := range m.DocChan {
+				docs = append(docs, doc)
+			}
+			assertJsonEqual(t, docs, c.want)
+
+			count, err := countFileDocs(path, c.fileType, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != c.count {
+				t.Errorf("counted %d documents, want %d", count, c.count)
+			}
+		})
+	}
+}
+
+func TestWrapFileDoc(t *testing.T) {
+	cases := []struct {
+		name   string
+		config Config
+		source string
+		want   string
+	}{
+		{
+			name:   "with id",
+			config: Config{TargetIndexName: "dst"},
+			source: `{"_id":"a","v":1}`,
+			want:   `{"_index":"dst","_type":"_doc","_id":"a","_source":{"v":1}}`,
+		},
+		{
+			name:   "number id",
+			config: Config{TargetIndexName: "dst"},
+			source: `{"_id":9007199254740993}`,
+			want:   `{"_index":"dst","_type":"_doc","_id":"9007199254740993","_source":{}}`,
+		},
+		{
+			name:   "without id",
+			config: Config{TargetIndexName: "dst", OverrideTypeName: "log"},
+			source: `{"v":1}`,
+			want:   `{"_index":"dst","_type":"log","_id":"","_source":{"v":1}}`,
+		},
+		{
+			name:   "regenerate id",
+			config: Config{TargetIndexName: "dst", RegenerateID: true},
+			source: `{"_id":"a","v":1}`,
+			want:   `{"_index":"dst","_type":"_doc","_id":"","_source":{"v":1}}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			source := map[string]interface{}{}
+			if err := DecodeJsonBytes([]byte(c.source), &source); err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{Config: &c.config}
+			assertJsonEqual(t, m.wrapFileDoc(source), c.want)
+		})
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Predicate test a document, the predicates of a field with array value match any item, like elasticsearch
+type Predicate interface {
+	Match(doc map[string]interface{}) bool
+}
+
+// filterProcessor keep the documents matched all the --filter, documents are filtered on client side,
+// so it works for every input, like dump files of -i
+type filterProcessor struct {
+	predicates []Predicate
+}
+
+func (p *filterProcessor) Process(doc map[string]interface{}) (bool, error) {
+	for _, predicate := range p.predicates {
+		if !predicate.Match(doc) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// parseFilters parse --filter, every --filter should be matched, the predicates of one --filter
+// joined by `||` match if any of them matches
+func parseFilters(filters []string) (*filterProcessor, error) {
+	processor := &filterProcessor{}
+	for _, filter := range filters {
+		var alternatives anyPredicate
+		for _, part := range strings.Split(filter, "||") {
+			predicate, err := parsePredicate(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			alternatives = append(alternatives, predicate)
+		}
+		if len(alternatives) == 1 {
+			processor.predicates = append(processor.predicates, alternatives[0])
+		} else {
+			processor.predicates = append(processor.predicates, alternatives)
+		}
+	}
+	return processor, nil
+}
+
+// parsePredicate parse one predicate, `!` in the front to negate it, ie:
+//
+//	equals:status=active
+//	exists:user.email
+//	range:price=10..100
+//	regex:user.name=^me
+//	!exists:deleted_at
+func parsePredicate(filter string) (Predicate, error) {
+	if strings.HasPrefix(filter, "!") {
+		predicate, err := parsePredicate(strings.TrimSpace(filter[1:]))
+		if err != nil {
+			return nil, err
+		}
+		return notPredicate{predicate}, nil
+	}
+
+	parts := strings.SplitN(filter, ":", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[1])) == 0 {
+		return nil, fmt.Errorf("invalid filter: %s, should be like equals:field=value", filter)
+	}
+	name := strings.TrimSpace(parts[0])
+	args := strings.TrimSpace(parts[1])
+
+	pair := func() (string, string, error) {
+		kv := strings.SplitN(args, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return "", "", fmt.Errorf("invalid filter: %s, should be like %s:field=value", filter, name)
+		}
+		return strings.TrimSpace(kv[0]), kv[1], nil
+	}
+
+	switch name {
+	case "equals":
+		field, value, err := pair()
+		return &equalsPredicate{field: field, value: value}, err
+	case "exists":
+		return &existsPredicate{field: args}, nil
+	case "range":
+		field, value, err := pair()
+		if err != nil {
+			return nil, err
+		}
+		bounds := strings.SplitN(value, "..", 2)
+		if len(bounds) != 2 || len(bounds[0])+len(bounds[1]) == 0 {
+			return nil, fmt.Errorf("invalid filter: %s, should be like range:field=from..to, either end can be omitted", filter)
+		}
+		return &rangePredicate{field: field, from: bounds[0], to: bounds[1]}, nil
+	case "regex":
+		field, value, err := pair()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %s, %v", filter, err)
+		}
+		return &regexPredicate{field: field, re: re}, nil
+	}
+	return nil, fmt.Errorf("unknown filter: %s, options: equals, exists, range, regex", name)
+}
+
+type anyPredicate []Predicate
+
+func (p anyPredicate) Match(doc map[string]interface{}) bool {
+	for _, predicate := range p {
+		if predicate.Match(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+type notPredicate struct {
+	predicate Predicate
+}
+
+func (p notPredicate) Match(doc map[string]interface{}) bool {
+	return !p.predicate.Match(doc)
+}
+
+// equalsPredicate compare numbers by value, others by the string form, ie: equals:enabled=true
+type equalsPredicate struct {
+	field string
+	value string
+}
+
+func (p *equalsPredicate) Match(doc map[string]interface{}) bool {
+	return matchValues(doc, p.field, func(v interface{}) bool {
+		return compareValue(v, p.value) == 0
+	})
+}
+
+// existsPredicate match the fields with a value which is not null or an empty array
+type existsPredicate struct {
+	field string
+}
+
+func (p *existsPredicate) Match(doc map[string]interface{}) bool {
+	return matchValues(doc, p.field, func(v interface{}) bool {
+		return true
+	})
+}
+
+// rangePredicate match the values between from and to, both inclusive, numbers are compared by
+// value, others by string, which works for dates like 2006-01-02T15:04:05
+type rangePredicate struct {
+	field string
+	from  string
+	to    string
+}
+
+func (p *rangePredicate) Match(doc map[string]interface{}) bool {
+	return matchValues(doc, p.field, func(v interface{}) bool {
+		if len(p.from) > 0 && compareValue(v, p.from) < 0 {
+			return false
+		}
+		if len(p.to) > 0 && compareValue(v, p.to) > 0 {
+			return false
+		}
+		return true
+	})
+}
+
+type regexPredicate struct {
+	field string
+	re    *regexp.Regexp
+}
+
+func (p *regexPredicate) Match(doc map[string]interface{}) bool {
+	return matchValues(doc, p.field, func(v interface{}) bool {
+		return p.re.MatchString(valueString(v))
+	})
+}
+
+// matchValues call fn with the value of field, or every item of an array, null values are skipped
+func matchValues(doc map[string]interface{}, field string, fn func(v interface{}) bool) bool {
+	v, ok := getDocField(doc, field)
+	if !ok || v == nil {
+		return false
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return fn(v)
+	}
+	for _, item := range items {
+		if item != nil && fn(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValue compare a document value with the value of filter, as numbers if both are numbers,
+// longs are compared exactly like the sort values
+func compareValue(v interface{}, value string) int {
+	s := valueString(v)
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return compareNumbers(json.Number(s), json.Number(value))
+		}
+	}
+	return strings.Compare(s, value)
+}
+
+func valueString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case map[string]interface{}:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
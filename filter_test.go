@@ -0,0 +1,121 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseFilters(t *testing.T) {
+	docs := map[string]string{
+		"active":  `{"status":"active","price":20,"user":{"name":"medcl","email":"m@medcl.net"},"tags":["a","b"]}`,
+		"pending": `{"status":"pending","price":100.5,"user":{"name":"elastic"},"deleted_at":null}`,
+		"deleted": `{"status":"deleted","price":5,"deleted_at":"2024-01-02T00:00:00","tags":[]}`,
+		"long":    `{"status":"active","id":9007199254740993,"created":"2024-03-01T10:00:00"}`,
+	}
+
+	cases := []struct {
+		name    string
+		filters []string
+		want    []string
+		err     bool
+	}{
+		{name: "equals", filters: []string{"equals:status=active"}, want: []string{"active", "long"}},
+		{name: "equals number", filters: []string{"equals:price=20.0"}, want: []string{"active"}},
+		{name: "equals array item", filters: []string{"equals:tags=b"}, want: []string{"active"}},
+		{name: "exists", filters: []string{"exists:deleted_at"}, want: []string{"deleted"}},
+		{name: "exists nested", filters: []string{"exists:user.email"}, want: []string{"active"}},
+		{name: "range", filters: []string{"range:price=10..100"}, want: []string{"active"}},
+		{name: "range inclusive", filters: []string{"range:price=20..100.5"}, want: []string{"active", "pending"}},
+		{name: "range from", filters: []string{"range:price=100.."}, want: []string{"pending"}},
+		{name: "range to", filters: []string{"range:price=..10"}, want: []string{"deleted"}},
+		{name: "range of longs", filters: []string{"range:id=9007199254740993.."}, want: []string{"long"}},
+		{name: "range beyond long", filters: []string{"range:id=9007199254740994.."}, want: []string{}},
+		{name: "range of dates", filters: []string{"range:created=2024-02-01..2024-04-01"}, want: []string{"long"}},
+		{name: "regex", filters: []string{"regex:user.name=^me"}, want: []string{"active"}},
+		{name: "regex of numbers", filters: []string{`regex:price=^\d+$`}, want: []string{"active", "deleted"}},
+		{name: "not", filters: []string{"!exists:deleted_at"}, want: []string{"active", "long", "pending"}},
+		{name: "not equals", filters: []string{"! equals:status=active"}, want: []string{"deleted", "pending"}},
+		{name: "or", filters: []string{"equals:status=pending || equals:status=deleted"}, want: []string{"deleted", "pending"}},
+		{name: "or with not", filters: []string{"exists:user.email || !exists:price"}, want: []string{"active", "long"}},
+		{name: "all of filters", filters: []string{"equals:status=active", "exists:user"}, want: []string{"active"}},
+		{name: "unknown", filters: []string{"prefix:status=a"}, err: true},
+		{name: "invalid range", filters: []string{"range:price=10"}, err: true},
+		{name: "invalid regex", filters: []string{"regex:name=("}, err: true},
+		{name: "missing value", filters: []string{"equals:status"}, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			processor, err := parseFilters(c.filters)
+			if c.err {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, name := range []string{"active", "deleted", "long", "pending"} {
+				doc := map[string]interface{}{}
+				if err := DecodeJsonBytes([]byte(docs[name]), &doc); err != nil {
+					t.Fatal(err)
+				}
+				keep, err := processor.Process(map[string]interface{}{"_id": name, "_source": doc})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if keep {
+					got = append(got, name)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(c.want, ",") {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCompareValue(t *testing.T) {
+	cases := []struct {
+		v     interface{}
+		value string
+		want  int
+	}{
+		{json.Number("9007199254740993"), "9007199254740992", 1},
+		{json.Number("9007199254740993"), "9007199254740993", 0},
+		{json.Number("-9007199254740993"), "-9007199254740992", -1},
+		{json.Number("2"), "10", -1},
+		{json.Number("1.5"), "1.25", 1},
+		{json.Number("2"), "2.0", 0},
+		{"10", "9", 1},
+		{"b", "a", 1},
+		{"2024-01-02", "2024-01-10", -1},
+		{true, "true", 0},
+	}
+
+	for _, c := range cases {
+		if got := compareValue(c.v, c.value); got != c.want {
+			t.Errorf("compare %v with %s: got %d, want %d", c.v, c.value, got, c.want)
+		}
+	}
+}
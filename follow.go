@@ -0,0 +1,253 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// FollowState is the progress of --follow persisted to disk, documents with the timestamp field
+// not less than the high water mark are copied again in the next round
+type FollowState struct {
+	SourceIndexes string      `json:"source_indexes"`
+	Field         string      `json:"field"`
+	HighWaterMark interface{} `json:"high_water_mark"`
+	InitialCopy   bool        `json:"initial_copy"`
+	LastRound     time.Time   `json:"last_round,omitempty"`
+	LastReconcile time.Time   `json:"last_reconcile,omitempty"`
+
+	path string
+}
+
+// LoadFollowState read the state of --follow, an empty state is returned if the file doesn't exist
+func LoadFollowState(path string, sourceIndexes string, field string) (*FollowState, error) {
+	state := &FollowState{SourceIndexes: sourceIndexes, Field: field, path: path}
+	if !checkFileIsExist(path) {
+		return state, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := DecodeJsonBytes(data, state); err != nil {
+		return nil, err
+	}
+	if state.SourceIndexes != sourceIndexes || state.Field != field {
+		return nil, fmt.Errorf("follow state %s was created with -x %s --follow_field=%s, can't continue with -x %s --follow_field=%s",
+			path, state.SourceIndexes, state.Field, sourceIndexes, field)
+	}
+	return state, nil
+}
+
+// Save write the state to a temp file first, so a crash never leaves a broken state
+func (state *FollowState) Save() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := state.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, state.path)
+}
+
+// follow keep the target up to date with source until interrupted. The source is copied as usual first,
+// then the documents with the --follow_field not less than the high water mark are copied every
+// --follow_interval seconds. With --follow_reconcile, the documents deleted from source are removed
+// from target by the sync comparison
+func (m *Migrator) follow() error {
+	c := m.Config
+	state, err := LoadFollowState(c.FollowStateFile, c.SourceIndexNames, c.FollowField)
+	if err != nil {
+		return err
+	}
+
+	m.SourceESAPI = m.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr, c.SourceProxy, c.Compress)
+	if m.SourceESAPI == nil {
+		return errors.New("can not parse source es api")
+	}
+	m.TargetESAPI = m.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr, c.TargetProxy, false)
+	if m.TargetESAPI == nil {
+		return errors.New("can not parse target es api")
+	}
+	if version := m.SourceESAPI.ClusterVersion(); !version.IsOpenSearch() && version.MajorVersion() < 5 {
+		return errors.New("--follow need the source documents sorted by --follow_field, which is not supported before 5.0")
+	}
+
+	if !state.InitialCopy {
+		// the documents written during the initial copy are copied again by the first round
+		state.HighWaterMark, err = m.SourceESAPI.MaxValue(c.SourceIndexNames, c.FollowField, c.SearchQuery())
+		if err != nil {
+			return err
+		}
+		log.Infof("start the initial copy, high water mark of %s: %v", c.FollowField, state.HighWaterMark)
+
+		initial := *c
+		initial.Follow = false
+		initial.DeadLetterFile = ""
+		initial.RejectedFile = ""
+		copier := &Migrator{Config: &initial, Name: m.Name, Pool: m.Pool, DeadLetter: m.DeadLetter, Rejected: m.Rejected}
+		err := runMigration(copier)
+		m.Stats.Read += copier.Stats.Read
+		m.Stats.Written += copier.Stats.Written
+		m.TransformStats.Dropped += copier.TransformStats.Dropped
+		m.TransformStats.Rejected += copier.TransformStats.Rejected
+		if err != nil {
+			return err
+		}
+
+		state.InitialCopy = true
+		state.LastReconcile = time.Now()
+		if err := state.Save(); err != nil {
+			return err
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	interval := time.Duration(c.FollowInterval) * time.Second
+	for {
+		if err := m.followRound(state); err != nil {
+			return err
+		}
+
+		if c.FollowReconcile > 0 && time.Since(state.LastReconcile) >= time.Duration(c.FollowReconcile)*time.Second {
+			log.Info("reconcile the deleted documents")
+			if err := m.syncIndexes(); err != nil {
+				log.Error(err)
+			} else {
+				state.LastReconcile = time.Now()
+				if err := state.Save(); err != nil {
+					return err
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			log.Infof("follow stopped, high water mark of %s: %v, saved in %s", c.FollowField, state.HighWaterMark, state.path)
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// followRound copy the documents since the high water mark, which is saved after every bulk
+func (m *Migrator) followRound(state *FollowState) error {
+	c := m.Config
+
+	var filter map[string]interface{}
+	if state.HighWaterMark != nil {
+		filter = map[string]interface{}{
+			"range": map[string]interface{}{
+				c.FollowField: map[string]interface{}{
+					"gte": state.HighWaterMark,
+				},
+			},
+		}
+	}
+
+	stream, err := newDocStream(m.SourceESAPI, c.SourceIndexNames, c.ScrollTime, c.DocBufferCount, c.SearchQuery(), filter,
+		c.FollowField, c.Fields)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// target index => _id => hit
+	batch := map[string]map[string]map[string]interface{}{}
+	batchCount := 0
+	docType := ""
+	var mark interface{}
+
+	op := opIndex
+	if c.BulkAction == "create" {
+		op = opCreate
+	}
+	// the high water mark is only saved after all the documents before it were written
+	flush := func() error {
+		for targetIndex, docs := range batch {
+			if err := m.bulkRecords(op, m.TargetESAPI, targetIndex, docType, docs); err != nil {
+				// the failed documents can be replayed from the dead letter file, don't stop following for them
+				if bulkErr, ok := err.(*BulkError); ok && bulkErr.DeadLettered {
+					log.Warnf("%d documents failed to bulk into %s, written to %s", len(bulkErr.Failures), targetIndex, c.DeadLetterFile)
+					continue
+				}
+				return fmt.Errorf("failed to bulk into %s, high water mark of %s is kept at %v: %v", targetIndex, c.FollowField, state.HighWaterMark, err)
+			}
+		}
+		m.Stats.Written += int64(batchCount)
+		batch = map[string]map[string]map[string]interface{}{}
+		batchCount = 0
+
+		if mark != nil {
+			state.HighWaterMark = mark
+		}
+		state.LastRound = time.Now()
+		return state.Save()
+	}
+
+	for {
+		doc, err := stream.Next()
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			break
+		}
+		if sort, ok := doc["sort"].([]interface{}); ok && len(sort) > 0 && sort[0] != nil {
+			mark = sort[0]
+		}
+		if !m.transformDoc(doc, 0) {
+			continue
+		}
+
+		id, _ := doc["_id"].(string)
+		index, _ := doc["_index"].(string)
+		targetIndex := m.getTargetIndexName(index)
+		if _, ok := batch[targetIndex]; !ok {
+			batch[targetIndex] = map[string]map[string]interface{}{}
+		}
+		batch[targetIndex][id] = doc
+		batchCount++
+		docType = getDocType(doc)
+
+		if batchCount >= c.DocBufferCount {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	m.Stats.Read += int64(stream.count)
+
+	if err := flush(); err != nil {
+		return err
+	}
+	log.Infof("follow round copied %d documents, high water mark of %s: %v", stream.count, c.FollowField, state.HighWaterMark)
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeFollowES read the source from fakeSearchES, and bulk into fakeBulkES
+type fakeFollowES struct {
+	*fakeSearchES
+	bulk *fakeBulkES
+}
+
+func (f *fakeFollowES) Bulk(data *bytes.Buffer) (*BulkResponse, error) {
+	return f.bulk.Bulk(data)
+}
+
+func TestFollowRound(t *testing.T) {
+	docs := []string{
+		`{"_id":"a","_index":"src","_routing":"r1","_version":3,"_source":{"ts":1}}`,
+		`{"_id":"b","_index":"src","_version":1,"_source":{"ts":2}}`,
+		`{"_id":"c","_index":"src","_routing":"r2","_version":7,"_source":{"ts":3}}`,
+	}
+
+	cases := []struct {
+		name        string
+		action      string
+		versionType string
+		statuses    map[string][]int
+		deadLetter  bool
+		mark        interface{}
+		actions     []string
+		err         string
+	}{
+		{
+			name:    "index with routing",
+			action:  "index",
+			mark:    json.Number("3"),
+			actions: []string{`{"index":{"_index":"dst","_type":"_doc","_id":"a","routing":"r1"}}`, `{"index":{"_index":"dst","_type":"_doc","_id":"b"}}`, `{"index":{"_index":"dst","_type":"_doc","_id":"c","routing":"r2"}}`},
+		},
+		{
+			name:        "create with version",
+			action:      "create",
+			versionType: "external",
+			mark:        json.Number("3"),
+			actions:     []string{`{"create":{"_index":"dst","_type":"_doc","_id":"a","routing":"r1","version":3,"version_type":"external"}}`, `{"create":{"_index":"dst","_type":"_doc","_id":"b","version":1,"version_type":"external"}}`, `{"create":{"_index":"dst","_type":"_doc","_id":"c","routing":"r2","version":7,"version_type":"external"}}`},
+		},
+		{
+			// the first batch was written
+			name:     "failed items keep the mark",
+			action:   "index",
+			statuses: map[string][]int{"c": {400}},
+			mark:     json.Number("2"),
+			err:      "high water mark of ts is kept at 2: 1 of 1 bulk items failed",
+		},
+		{
+			// the failed document can be replayed from the dead letter file
+			name:       "dead lettered items move the mark",
+			action:     "index",
+			statuses:   map[string][]int{"c": {400}},
+			deadLetter: true,
+			mark:       json.Number("3"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			api := &fakeFollowES{
+				fakeSearchES: &fakeSearchES{version: "7.10.0", docs: docs},
+				bulk:         &fakeBulkES{statuses: c.statuses},
+			}
+			cfg := &Config{FollowField: "ts", DocBufferCount: 2, TargetIndexName: "dst", BulkAction: c.action,
+				VersionType: c.versionType, VersionFrom: "version"}
+			m := &Migrator{Config: cfg, SourceESAPI: api, TargetESAPI: api}
+			if c.deadLetter {
+				cfg.DeadLetterFile = filepath.Join(t.TempDir(), "failed.json")
+				deadLetter, err := NewDeadLetterWriter(cfg.DeadLetterFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer deadLetter.Close()
+				m.DeadLetter = deadLetter
+			}
+			state, err := LoadFollowState(filepath.Join(t.TempDir(), "follow.json"), "src", "ts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			state.HighWaterMark = json.Number("0")
+
+			err = m.followRound(state)
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if state.HighWaterMark != c.mark {
+				t.Errorf("got high water mark %v, want %v", state.HighWaterMark, c.mark)
+			}
+			if failed := int64(len(c.statuses)); m.BulkStats.Failed != failed {
+				t.Errorf("counted %d failures, want %d", m.BulkStats.Failed, failed)
+			}
+
+			if c.actions == nil {
+				return
+			}
+			var actions []string
+			for _, body := range api.bulk.bodies {
+				for i, line := range strings.Split(strings.TrimSpace(body), "\n") {
+					if i%2 == 0 {
+						actions = append(actions, line)
+					}
+				}
+			}
+			sort.Strings(actions)
+			if strings.Join(actions, "\n") != strings.Join(c.actions, "\n") {
+				t.Errorf("got actions:\n%s\nwant:\n%s", strings.Join(actions, "\n"), strings.Join(c.actions, "\n"))
+			}
+		})
+	}
+}
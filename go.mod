@@ -3,23 +3,30 @@ module github.com/medcl/esm
 go 1.21.1
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/cheggaaa/pb v1.0.29
 	github.com/cihub/seelog v0.0.0-20170130134532-f561c5e57575
+	github.com/dop251/goja v0.0.0-20260311135729-065cd970411c
 	github.com/jessevdk/go-flags v1.5.0
+	github.com/klauspost/compress v1.17.0
 	github.com/mattn/go-isatty v0.0.14
 	github.com/parnurzeal/gorequest v0.2.16
 	github.com/valyala/fasthttp v1.51.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/andybalholm/brotli v1.0.5 // indirect
+	github.com/dlclark/regexp2 v1.11.4 // indirect
 	github.com/elazarl/goproxy v0.0.0-20231117061959-7cc037d33fb5 // indirect
-	github.com/klauspost/compress v1.17.0 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/mattn/go-runewidth v0.0.4 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/smartystreets/goconvey v1.8.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	moul.io/http2curl v1.0.0 // indirect
 )
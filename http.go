@@ -116,15 +116,24 @@ func newDeleteRequest(client *http.Client, method, urlStr string) (*http.Request
 	return req, nil
 }
 
-var client = &http.Client{
-	Transport: &http.Transport{
+// newHttpClient return a client of its own transport, every ESAPI keeps one, so the proxy of
+// source and target, or of the jobs running in parallel, are not mixed up
+func newHttpClient(proxy string) *http.Client {
+	transport := &http.Transport{
 		DisableKeepAlives:  true,
 		DisableCompression: false,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true,
 		},
-	},
+	}
+	if len(proxy) > 0 {
+		proxyUrl := VerifyWithResult(url.Parse(proxy)).(*url.URL)
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	return &http.Client{Transport: transport}
 }
+
+var defaultClient = newHttpClient("")
 var fastHttpClient = &fasthttp.Client{
 	TLSConfig: &tls.Config{InsecureSkipVerify: true},
 }
@@ -188,7 +197,19 @@ func DoRequest(compress bool, method string, loadUrl string, auth *Auth, body []
 	return string(resp.Body()), nil
 }
 
-func Request(compress bool, method string, loadUrl string, auth *Auth, body *bytes.Buffer, proxy string) (string, error) {
+// Request send the request by the client of ESAPI, a client without proxy is used if it's nil
+func Request(compress bool, method string, loadUrl string, auth *Auth, body *bytes.Buffer, client *http.Client) (string, error) {
+	return RequestWithHeaders(compress, method, loadUrl, auth, body, client, nil)
+}
+
+// RequestWithHeaders works like Request, entries in headers are set after the default
+// json content type, so they can override it
+func RequestWithHeaders(compress bool, method string, loadUrl string, auth *Auth, body *bytes.Buffer, client *http.Client,
+	headers map[string]string) (string, error) {
+
+	if client == nil {
+		client = defaultClient
+	}
 
 	var err error
 	var reqest *http.Request
@@ -206,15 +227,10 @@ func Request(compress bool, method string, loadUrl string, auth *Auth, body *byt
 		reqest.SetBasicAuth(auth.User, auth.Pass)
 	}
 
-	oldTransport := client.Transport.(*http.Transport)
-	if len(proxy) > 0 {
-		proxyUrl := VerifyWithResult(url.Parse(proxy)).(*url.URL)
-		proxyFunc := http.ProxyURL(proxyUrl)
-		oldTransport.Proxy = proxyFunc
-	} else {
-		oldTransport.Proxy = nil
-	}
 	reqest.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		reqest.Header.Set(k, v)
+	}
 
 	//enable gzip
 	//reqest.Header.Set("Content-Encoding", "gzip")
@@ -262,7 +278,6 @@ func DecodeJson(jsonStream string, o interface{}) error {
 	//decoder.
 
 	if err := decoder.Decode(o); err != nil {
-		fmt.Println("error:", err)
 		return err
 	}
 	return nil
@@ -274,7 +289,6 @@ func DecodeJsonBytes(jsonStream []byte, o interface{}) error {
 	decoder.UseNumber()
 
 	if err := decoder.Decode(o); err != nil {
-		fmt.Println("error:", err)
 		return err
 	}
 	return nil
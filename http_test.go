@@ -0,0 +1,77 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestProxy(t *testing.T) {
+	// the proxies answer by themselves, and count the requests they received
+	newProxy := func(name string, count *int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(count, 1)
+			w.Write([]byte(name))
+		}))
+	}
+	var sourceCount, targetCount int64
+	source := newProxy("source", &sourceCount)
+	defer source.Close()
+	target := newProxy("target", &targetCount)
+	defer target.Close()
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer direct.Close()
+
+	cases := []struct {
+		name   string
+		client *http.Client
+		want   string
+	}{
+		{"source proxy", newHttpClient(source.URL), "source"},
+		{"target proxy", newHttpClient(target.URL), "target"},
+		{"without proxy", newHttpClient(""), "direct"},
+		{"default client", nil, "direct"},
+	}
+
+	// the clients are used in parallel, as the jobs of --config do
+	wg := sync.WaitGroup{}
+	for _, c := range cases {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(name string, client *http.Client, want string) {
+				defer wg.Done()
+				got, err := Request(false, "GET", direct.URL+"/_cluster/health", nil, nil, client)
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				} else if got != want {
+					t.Errorf("%s: got response of %s, want %s", name, got, want)
+				}
+			}(c.name, c.client, c.want)
+		}
+	}
+	wg.Wait()
+
+	if sourceCount != 10 || targetCount != 10 {
+		t.Errorf("got %d requests by source proxy, %d by target proxy, want 10", sourceCount, targetCount)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+	"github.com/mattn/go-isatty"
+	"os"
+	"sync"
+	"time"
+)
+
+// JobStats count the documents of a job
+type JobStats struct {
+	Read    int64
+	Written int64
+}
+
+// JobResult is the summary of a finished job
+type JobResult struct {
+	Name     string
+	Stats    JobStats
+	Bulk     BulkStats
+	Duration time.Duration
+	Err      error
+}
+
+// barPrefix prefix the progress bar with the job name, to tell the bars of batch jobs apart
+func (m *Migrator) barPrefix(prefix string) string {
+	if len(m.Name) == 0 {
+		return prefix
+	}
+	return m.Name + " " + prefix
+}
+
+// runJobs run the jobs with at most --job_concurrency in parallel, the summary of every job
+// is printed after all finished, return false if any job failed
+func runJobs(jobs []Job) bool {
+	concurrency := jobs[0].Config.JobConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	log.Infof("start %d jobs, %d in parallel", len(jobs), concurrency)
+
+	// the progress bars of all jobs share one pool, the bar of jobs keeps it alive until all done
+	var pool *pb.Pool
+	jobsBar := pb.New(len(jobs)).Prefix("Jobs")
+	if isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()) {
+		var err error
+		pool, err = pb.StartPool(jobsBar)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	results := make([]JobResult, len(jobs))
+	tokens := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i, job := range jobs {
+		tokens <- struct{}{}
+		wg.Add(1)
+		go func(i int, job Job) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+
+			log.Infof("job %s started", job.Name)
+			migrator := &Migrator{Config: job.Config, Name: job.Name, Pool: pool}
+			start := time.Now()
+			err := runMigration(migrator)
+			results[i] = JobResult{
+				Name:     job.Name,
+				Stats:    migrator.Stats,
+				Bulk:     migrator.BulkStats,
+				Duration: time.Since(start),
+				Err:      err,
+			}
+			if err != nil {
+				log.Errorf("job %s failed: %v", job.Name, err)
+			} else {
+				log.Infof("job %s finished", job.Name)
+			}
+			jobsBar.Increment()
+		}(i, job)
+	}
+	wg.Wait()
+
+	if pool != nil {
+		jobsBar.Finish()
+		pool.Stop()
+	}
+
+	failed := 0
+	log.Info("jobs summary:")
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = "failed: " + result.Err.Error()
+			failed++
+		}
+		log.Infof("  %s: %s, read %d, written %d, bulk retried %d, bulk failed %d, version conflicts %d, took %s", result.Name, status,
+			result.Stats.Read, result.Stats.Written, result.Bulk.Retried, result.Bulk.Failed, result.Bulk.Conflicts,
+			result.Duration.Round(time.Millisecond))
+	}
+	log.Infof("%d jobs finished, %d failed", len(jobs)-failed, failed)
+	return failed == 0
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunJobs(t *testing.T) {
+	// the target rejects the documents with _id "bad"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`{"name":"test","cluster_name":"test","version":{"number":"7.10.0"}}`))
+		case "/_cluster/health":
+			w.Write([]byte(`{"cluster_name":"test","status":"green"}`))
+		case "/_bulk":
+			body, _ := io.ReadAll(r.Body)
+			api := &fakeBulkES{statuses: map[string][]int{"bad": {400}}}
+			response, err := api.Bulk(bytes.NewBuffer(body))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(response)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	newJob := func(name string, ids ...string) Job {
+		input := filepath.Join(dir, name+".json")
+		data := bytes.Buffer{}
+		for _, id := range ids {
+			data.WriteString(`{"_id":"` + id + `","_index":"src","_type":"_doc","_source":{"v":1}}` + "\n")
+		}
+		if err := os.WriteFile(input, data.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		jobs, err := parseJobs([]string{"-i", input, "-d", server.URL, "-y", "dst"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs[0].Name = name
+		return jobs[0]
+	}
+
+	cases := []struct {
+		name string
+		jobs []Job
+		want bool
+	}{
+		{name: "all written", jobs: []Job{newJob("a", "1", "2"), newJob("b", "3")}, want: true},
+		{name: "documents failed", jobs: []Job{newJob("c", "4"), newJob("d", "5", "bad")}, want: false},
+		{name: "job failed", jobs: []Job{newJob("e", "6"), {Name: "f", Config: &Config{}}}, want: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := runJobs(c.jobs); got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	// a single job fails with the count of failed documents
+	m := &Migrator{Config: newJob("g", "7", "bad").Config}
+	if err := runMigration(m); err == nil || err.Error() != "1 documents failed to bulk into target" {
+		t.Errorf("got error %v, want 1 documents failed", err)
+	}
+}
@@ -18,13 +18,42 @@ package main
 
 import (
 	log "github.com/cihub/seelog"
+	"os"
 	"strings"
 )
 
-func setInitLogging(logLevel string) {
+// stderrReceiver write the logs to stderr, when stdout is taken by --diff_report=-
+type stderrReceiver struct{}
+
+func (r *stderrReceiver) ReceiveMessage(message string, level log.LogLevel, context log.LogContextInterface) error {
+	_, err := os.Stderr.WriteString(message)
+	return err
+}
+
+func (r *stderrReceiver) AfterParse(initArgs log.CustomReceiverInitArgs) error {
+	return nil
+}
+
+func (r *stderrReceiver) Flush() {
+}
+
+func (r *stderrReceiver) Close() error {
+	return nil
+}
+
+func init() {
+	log.RegisterReceiver("stderr", &stderrReceiver{})
+}
+
+func setInitLogging(logLevel string, stderr bool) {
 
 	logLevel = strings.ToLower(logLevel)
 
+	console := `<console formatid="main" />`
+	if stderr {
+		console = `<custom name="stderr" formatid="main" />`
+	}
+
 	testConfig := `
 	<seelog  type="sync" minlevel="`
 	testConfig = testConfig + logLevel
@@ -33,7 +62,7 @@ func setInitLogging(logLevel string) {
 			<filter levels="error">
 				<file path="./esm.log"/>
 			</filter>
-			<console formatid="main" />
+			` + console + `
 		</outputs>
 		<formats>
 			<format id="main" format="[%Date(01-02) %Time] [%LEV] [ %File:%Line ,%FuncShort] %Msg%n"/>
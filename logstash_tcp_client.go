@@ -16,194 +16,240 @@ limitations under the License.
 
 package main
 
-//import (
-//	"fmt"
-//	"os"
-//	"bufio"
-//	"strconv"
-//	"crypto/tls"
-//	"net"
-//	"log"
-//	"encoding/binary"
-//	"github.com/paulbellamy/ratecounter"
-//	"time"
-//	"io/ioutil"
-//	"infini.sh/framework/core/util"
-//)
-//
-//func WriteToLogstash(c *Config)  {
-//	if c.LogstashEndpoint==""{
-//		fmt.Println("logstash endpoint not defined");
-//		return
-//	}
-//
-//	//go StartServer("127.0.0.1:5055")
-//
-//	// connect to this socket
-//
-//	//read files
-//
-//
-//
-//
-//
-//	//fmt.Println(len(arr))
-//	//fmt.Println(arr[0])
-//
-//	fmt.Println(c.Workers)
-//	conf := &tls.Config{
-//		InsecureSkipVerify: true,
-//	}
-//	counter := ratecounter.NewRateCounter(1 * time.Second)
-//	for i:=0;i<c.Workers;i++{
-//		go func() {
-//
-//			conn, err := net.Dial("tcp", c.LogstashEndpoint)
-//			if err != nil {
-//				fmt.Println(err)
-//				return
-//			}
-//
-//			if c.LogstashSecEndpoint{
-//				conn, err = tls.Dial("tcp", c.LogstashEndpoint, conf)
-//				if err != nil {
-//					fmt.Println(err)
-//					return
-//				}
-//			}
-//
-//			defer conn.Close()
-//
-//			fmt.Println("worker:"+strconv.Itoa(i))
-//
-//			if c.DumpInputFile!="" {
-//				f, err := os.Open(c.DumpInputFile)
-//				if err != nil {
-//					fmt.Println(err)
-//					return
-//				}
-//
-//				//get file lines
-//				defer f.Close()
-//				r := bufio.NewReader(f)
-//				b, err := ioutil.ReadAll(r)
-//				if err != nil {
-//					log.Fatal(err)
-//				}
-//
-//				var arr []map[string]interface{}
-//				_ = DecodeJson(string(b), &arr)
-//
-//
-//				for {
-//					//"13.64.105.169:5055"
-//					// read in input from stdin
-//					//reader := bufio.NewReader(os.Stdin)
-//					//fmt.Print("Text to send: ")
-//					//text, _ := reader.ReadString('\n')
-//					// send to socket
-//
-//					for i,v:=range arr{
-//						//text:="{\"a\":\"123123\"}"
-//						obj:=map[string]interface{}{}
-//						//obj["level"]=c.TestLevel
-//						//obj["environment"]=c.TestEnvironment
-//						obj["i"]=i
-//						//fmt.Println(c.TestLevel)
-//						v["labels"]=obj
-//
-//
-//						_, e := conn.Write(util.ToJSONBytes(v))
-//						conn.Write([]byte("\r\n"))
-//						//fmt.Print(".")
-//
-//						if e != nil {
-//							fmt.Println("Error to send message because of ", e.Error())
-//							break
-//						}
-//					}
-//
-//
-//					//fmt.Fprintf(conn, text + "\n")
-//					// listen for reply
-//					//message, _ := bufio.NewReader(conn).ReadString('\n')
-//					//fmt.Print("Message from server: "+message)
-//				}
-//			}else{
-//
-//				for x:=0;x<10000000 ;x++  {
-//					v:="{\"a\":\"123123\"}"
-//					_, e := conn.Write([]byte(v))
-//					conn.Write([]byte("\r\n"))
-//					//fmt.Print(".")
-//
-//					if e != nil {
-//						fmt.Println("Error to send message because of ", e.Error())
-//						break
-//					}
-//				}
-//
-//			}
-//
-//
-//
-//		}()
-//
-//	}
-//
-//	reader := bufio.NewReader(os.Stdin)
-//	fmt.Println("Type to Stop")
-//	reader.ReadString('\n')
-//	fmt.Println(counter.Rate())
-//}
-//
-//const (
-//	BYTES_SIZE uint16 = 1024
-//	HEAD_SIZE  int    = 2
-//)
-//
-//func StartServer(address string) {
-//	listener, err := net.Listen("tcp", address)
-//	if err != nil {
-//		log.Println("Error listening", err.Error())
-//		return
-//	}
-//	for {
-//		conn, err := listener.Accept()
-//		fmt.Println(conn.RemoteAddr())
-//		if err != nil {
-//			fmt.Println("Error accepting", err.Error())
-//			return // 终止程序
-//		}
-//		go doConn(conn)
-//	}
-//}
-//
-//func doConn(conn net.Conn) {
-//	var (
-//		buffer      = newBuffer(conn, 16)
-//		headBuf     []byte
-//		contentSize int
-//		contentBuf  []byte
-//	)
-//	for {
-//		_, err := buffer.readFromReader()
-//		if err != nil {
-//			fmt.Println(err)
-//			return
-//		}
-//		for {
-//			headBuf, err = buffer.seek(HEAD_SIZE);
-//			if err != nil {
-//				break
-//			}
-//			contentSize = int(binary.BigEndian.Uint16(headBuf))
-//			if (buffer.Len() >= contentSize-HEAD_SIZE) {
-//				contentBuf = buffer.read(HEAD_SIZE, contentSize)
-//				fmt.Println(string(contentBuf))
-//				continue
-//			}
-//			break
-//		}
-//	}
-//}
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logstashDialTimeout  = 10 * time.Second
+	logstashWriteTimeout = 30 * time.Second
+	logstashMaxBackoff   = 30 * time.Second
+)
+
+// LogstashStats count the documents failed to send to logstash after retried
+type LogstashStats struct {
+	Failed int64
+}
+
+// getLogstashEndpoints split the comma separated logstash endpoints
+func getLogstashEndpoints(endpoints string) []string {
+	result := make([]string, 0)
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if len(endpoint) > 0 {
+			result = append(result, endpoint)
+		}
+	}
+	return result
+}
+
+// logstashTLSConfig verify the certificate of logstash by the CA file, or the system CAs if it's empty
+func logstashTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if len(caFile) > 0 {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func dialLogstash(endpoint string, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig != nil {
+		dialer := &net.Dialer{Timeout: logstashDialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", endpoint, tlsConfig)
+	}
+	return net.DialTimeout("tcp", endpoint, logstashDialTimeout)
+}
+
+// logstashSender keep a connection to one logstash endpoint, reconnect on failure
+type logstashSender struct {
+	endpoint string
+	retries  int
+	backoff  time.Duration
+	dial     func() (net.Conn, error)
+	conn     net.Conn
+}
+
+func newLogstashSender(endpoint string, tlsConfig *tls.Config, retries int) *logstashSender {
+	return &logstashSender{
+		endpoint: endpoint,
+		retries:  retries,
+		backoff:  time.Second,
+		dial: func() (net.Conn, error) {
+			return dialLogstash(endpoint, tlsConfig)
+		},
+	}
+}
+
+// Send write the json lines, the rest is resent after reconnected, from the beginning of the line
+// partially written, as logstash discards the incomplete line of a broken connection, the error is
+// returned after retried so many times
+func (s *logstashSender) Send(data []byte) error {
+	sent := 0
+	backoff := s.backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt > s.retries {
+				return fmt.Errorf("failed to send to logstash %s after %d retries: %v", s.endpoint, s.retries, err)
+			}
+			log.Warnf("failed to send to logstash %s, retry after %s: %v", s.endpoint, backoff, err)
+			time.Sleep(backoff)
+			if backoff < logstashMaxBackoff {
+				backoff *= 2
+			}
+		}
+
+		if s.conn == nil {
+			s.conn, err = s.dial()
+			if err != nil {
+				s.conn = nil
+				continue
+			}
+			log.Debug("connected to logstash, ", s.endpoint)
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(logstashWriteTimeout))
+		var n int
+		n, err = s.conn.Write(data[sent:])
+		sent += n
+		if err == nil {
+			return nil
+		}
+		s.Close()
+		sent = bytes.LastIndexByte(data[:sent], '\n') + 1
+	}
+}
+
+func (s *logstashSender) Close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// logstashEvent is the _source with the `_index` and `_id` of document in `@metadata`, like the docinfo
+// of logstash elasticsearch input, ie: document_id => "%{[@metadata][_id]}" in elasticsearch output
+func logstashEvent(doc map[string]interface{}, source map[string]interface{}) map[string]interface{} {
+	metadata := map[string]interface{}{}
+	if v, ok := source["@metadata"].(map[string]interface{}); ok {
+		for k, value := range v {
+			metadata[k] = value
+		}
+	}
+	metadata["_index"] = doc["_index"]
+	metadata["_id"] = doc["_id"]
+
+	event := make(map[string]interface{}, len(source)+1)
+	for k, v := range source {
+		event[k] = v
+	}
+	event["@metadata"] = metadata
+	return event
+}
+
+// NewLogstashWorker send the `_source` of documents to logstash tcp input as json lines, with their
+// `_index` and `_id` in `@metadata`, use the `json_lines` codec on the logstash side. The connection is re-established on
+// failure, the pending data is resent after reconnected, TLS is used if tlsConfig is not nil
+func (m *Migrator) NewLogstashWorker(endpoint string, tlsConfig *tls.Config, pb *pb.ProgressBar, wg *sync.WaitGroup) {
+	log.Debug("start logstash worker, ", endpoint)
+
+	sender := newLogstashSender(endpoint, tlsConfig, m.Config.LogstashRetries)
+	defer func() {
+		sender.Close()
+		wg.Done()
+	}()
+
+	mainBuf := bytes.Buffer{}
+	docEnc := json.NewEncoder(&mainBuf)
+	// sequence numbers of the documents in mainBuf, acknowledged to checkpoint after sent
+	sentSeqs := make([]uint64, 0)
+
+	flush := func() {
+		if mainBuf.Len() == 0 {
+			return
+		}
+
+		// the failed documents are not acknowledged, so the checkpoint stays before them
+		if err := sender.Send(mainBuf.Bytes()); err != nil {
+			log.Errorf("%d documents failed: %v", len(sentSeqs), err)
+			atomic.AddInt64(&m.LogstashStats.Failed, int64(len(sentSeqs)))
+		} else {
+			pb.Add(len(sentSeqs))
+			m.Checkpoint.Ack(sentSeqs...)
+		}
+		sentSeqs = sentSeqs[:0]
+		mainBuf.Reset()
+	}
+
+	idleDuration := 5 * time.Second
+	idleTimeout := time.NewTimer(idleDuration)
+	defer idleTimeout.Stop()
+
+	for {
+		idleTimeout.Reset(idleDuration)
+		select {
+		case docI, open := <-m.DocChan:
+			// if channel is closed flush and gtfo
+			if !open {
+				flush()
+				log.Debug("logstash worker finished, ", endpoint)
+				return
+			}
+
+			// this check is in case the document is an error with scroll stuff
+			if status, ok := docI["status"]; ok {
+				if status.(int) == 404 {
+					log.Error("error: ", docI["response"])
+					continue
+				}
+			}
+
+			seq := takeCheckpointSeq(docI)
+			if !m.transformDoc(docI, seq) {
+				continue
+			}
+
+			source, ok := docI["_source"].(map[string]interface{})
+			if !ok {
+				log.Errorf("failed decoding document: %+v", docI)
+				original, _ := json.Marshal(docI)
+				m.rejectDoc(original, docI["_id"], seq, errors.New("_source is not an object"))
+				continue
+			}
+			if err := docEnc.Encode(logstashEvent(docI, source)); err != nil {
+				original, _ := json.Marshal(docI)
+				m.rejectDoc(original, docI["_id"], seq, err)
+				continue
+			}
+			sentSeqs = append(sentSeqs, seq)
+
+			if mainBuf.Len() > (m.Config.BulkSizeInMB * 1024 * 1024) {
+				flush()
+			}
+		case <-idleTimeout.C:
+			log.Debug("5s no message input")
+			flush()
+		}
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/cheggaaa/pb"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLogstashConn accept limit bytes, then the connection is broken, -1 for no limit
+type fakeLogstashConn struct {
+	net.Conn
+	limit  int
+	data   []byte
+	closed bool
+}
+
+func (c *fakeLogstashConn) Write(b []byte) (int, error) {
+	if c.limit >= 0 && len(b) > c.limit {
+		c.data = append(c.data, b[:c.limit]...)
+		return c.limit, errors.New("connection reset by peer")
+	}
+	c.data = append(c.data, b...)
+	return len(b), nil
+}
+
+func (c *fakeLogstashConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *fakeLogstashConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestLogstashSend(t *testing.T) {
+	data := `{"a":1}` + "\n" + `{"b":2}` + "\n" + `{"c":3}` + "\n"
+
+	cases := []struct {
+		name string
+		// the limits of connections, a dial fails for nil
+		conns []*fakeLogstashConn
+		want  []string
+		err   string
+	}{
+		{
+			name:  "sent at once",
+			conns: []*fakeLogstashConn{{limit: -1}},
+			want:  []string{data},
+		},
+		{
+			name:  "partial line is resent",
+			conns: []*fakeLogstashConn{{limit: 10}, {limit: -1}},
+			want:  []string{`{"a":1}` + "\n" + `{"`, `{"b":2}` + "\n" + `{"c":3}` + "\n"},
+		},
+		{
+			name:  "complete lines are not resent",
+			conns: []*fakeLogstashConn{{limit: 16}, {limit: -1}},
+			want:  []string{`{"a":1}` + "\n" + `{"b":2}` + "\n", `{"c":3}` + "\n"},
+		},
+		{
+			name:  "reconnected after dial failed",
+			conns: []*fakeLogstashConn{nil, {limit: 3}, {limit: -1}},
+			want:  []string{`{"a`, data},
+		},
+		{
+			name:  "failed after retries",
+			conns: []*fakeLogstashConn{{limit: 10}, nil, {limit: 0}, {limit: -1}},
+			err:   "failed to send to logstash test:5055 after 2 retries",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dials := 0
+			sender := &logstashSender{endpoint: "test:5055", retries: 2, backoff: time.Millisecond}
+			sender.dial = func() (net.Conn, error) {
+				if dials >= len(c.conns) {
+					t.Fatal("too many dials")
+				}
+				conn := c.conns[dials]
+				dials++
+				if conn == nil {
+					return nil, errors.New("connection refused")
+				}
+				return conn, nil
+			}
+
+			err := sender.Send([]byte(data))
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, conn := range c.conns[:dials] {
+				if conn != nil {
+					got = append(got, string(conn.data))
+				}
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+			// the broken connections are closed, the last one is kept
+			for i, conn := range c.conns[:dials] {
+				if conn != nil && conn.closed != (i < dials-1) {
+					t.Errorf("connection %d closed: %v", i, conn.closed)
+				}
+			}
+		})
+	}
+}
+
+func TestLogstashTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		caFile   string
+		insecure bool
+		err      string
+	}{
+		{name: "verified by system CAs"},
+		{name: "insecure", insecure: true},
+		{name: "missing CA file", caFile: filepath.Join(dir, "missing.pem"), err: "no such file"},
+		{name: "invalid CA file", caFile: invalid, err: "no certificate found"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config, err := logstashTLSConfig(c.caFile, c.insecure)
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.InsecureSkipVerify != c.insecure {
+				t.Errorf("got InsecureSkipVerify %v, want %v", config.InsecureSkipVerify, c.insecure)
+			}
+		})
+	}
+}
+
+func TestLogstashWorker(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	m := &Migrator{Config: &Config{LogstashRetries: 1, BulkSizeInMB: 10}, DocChan: make(chan map[string]interface{}, 3)}
+	m.DocChan <- map[string]interface{}{"_index": "src", "_type": "_doc", "_id": "a", "_source": map[string]interface{}{"v": 1}}
+	m.DocChan <- map[string]interface{}{"_index": "src", "_id": "b", "_source": map[string]interface{}{"v": 2, "@metadata": map[string]interface{}{"pipeline": "p"}}}
+	close(m.DocChan)
+
+	bar := pb.New(0)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	m.NewLogstashWorker(listener.Addr().String(), nil, bar, &wg)
+
+	lines := strings.Split(strings.TrimSpace(<-received), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d events, want 2: %q", len(lines), lines)
+	}
+	assertJsonEqual(t, json.RawMessage(lines[0]), `{"v":1,"@metadata":{"_index":"src","_id":"a"}}`)
+	assertJsonEqual(t, json.RawMessage(lines[1]), `{"v":2,"@metadata":{"pipeline":"p","_index":"src","_id":"b"}}`)
+	if bar.Get() != 2 || m.LogstashStats.Failed != 0 {
+		t.Errorf("got %d sent, %d failed, want 2 sent", bar.Get(), m.LogstashStats.Failed)
+	}
+}
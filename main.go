@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/cheggaaa/pb"
 	log "github.com/cihub/seelog"
-	goflags "github.com/jessevdk/go-flags"
 	"github.com/mattn/go-isatty"
-	"io"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -36,32 +36,164 @@ func main() {
 		log.Debug("stop pprof server: %v", endpoint)
 	}()
 
-	var err error
-	c := &Config{}
-	migrator := Migrator{}
-	migrator.Config = c
-
 	// parse args
-	_, err = goflags.Parse(c)
+	jobs, err := parseJobs(os.Args[1:])
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	setInitLogging(c.LogLevel)
+	// stdout is taken by the report of --diff_report=-
+	setInitLogging(jobs[0].Config.LogLevel, jobs[0].Config.DiffReportFile == "-")
 
-	if len(c.SourceEs) == 0 && len(c.DumpInputFile) == 0 {
-		log.Error("no input, type --help for more details")
+	if len(jobs) > 1 {
+		for _, job := range jobs {
+			if job.Config.DiffReportFile == "-" {
+				log.Errorf("--diff_report=- only works with one job, the reports of job %s would be mixed with others", job.Name)
+				log.Flush()
+				os.Exit(1)
+			}
+		}
+		if !runJobs(jobs) {
+			log.Flush()
+			os.Exit(1)
+		}
 		return
 	}
-	if len(c.TargetEs) == 0 && len(c.DumpOutFile) == 0 {
-		log.Error("no output, type --help for more details")
-		return
+
+	migrator := &Migrator{Config: jobs[0].Config}
+	if err := runMigration(migrator); err != nil {
+		log.Error(err)
+		log.Flush()
+		os.Exit(1)
+	}
+}
+
+// runMigration run the migration of one job, the progress is counted into migrator.Stats,
+// the job fails if any document failed to bulk, even if it's written to the dead letter file
+func runMigration(migrator *Migrator) (err error) {
+	c := migrator.Config
+	defer func() {
+		if err == nil && migrator.BulkStats.Failed > 0 {
+			err = fmt.Errorf("%d documents failed to bulk into target", migrator.BulkStats.Failed)
+		}
+	}()
+
+	if len(c.SourceEs) == 0 && len(c.DumpInputFile) == 0 {
+		return errors.New("no input, type --help for more details")
+	}
+	if len(c.TargetEs) == 0 && len(c.DumpOutFile) == 0 && len(c.LogstashEndpoint) == 0 {
+		return errors.New("no output, type --help for more details")
+	}
+	if (len(c.LogstashCA) > 0 || c.LogstashInsecure) && !c.LogstashSecEndpoint {
+		return errors.New("--logstash_ca and --logstash_insecure need --secured_logstash_endpoint")
+	}
+
+	if len(c.DumpInputFile) > 0 {
+		switch c.InputFileType {
+		case "dump":
+		case "json_line", "json_array", "log_line":
+			if len(c.TargetIndexName) == 0 {
+				return fmt.Errorf("input_file_type %s need the target index name by -y", c.InputFileType)
+			}
+		default:
+			return fmt.Errorf("unknown input_file_type: %s", c.InputFileType)
+		}
+		if isManifestFile(c.DumpInputFile) && c.InputFileType != "dump" {
+			return errors.New("dump manifest only works with --input_file_type=dump")
+		}
+	}
+
+	for _, path := range []string{c.DumpInputFile, c.DumpOutFile} {
+		if _, err := getFileCompression(path, c.FileCompression); err != nil {
+			return err
+		}
 	}
 
 	if c.SourceEs == c.TargetEs && c.SourceIndexNames == c.TargetIndexName {
-		log.Error("migration output is the same as the output")
-		return
+		return errors.New("migration output is the same as the output")
+	}
+
+	// scroll in the index order by default, sorting by _id is expensive on large indexes, but sync
+	// need both sides in the same order
+	if len(c.SortField) == 0 {
+		c.SortField = "_doc"
+		if c.Sync || c.DiffOnly {
+			c.SortField = "_id"
+		}
+	}
+	sortSpec, err := ParseSortSpec(c.SortField)
+	if err != nil {
+		return err
+	}
+	// the same sort in the same format, as it's saved in checkpoint
+	c.SortField = sortSpec.String()
+
+	if len(c.QueryDSL) > 0 {
+		if len(c.Query) > 0 {
+			return errors.New("--query can't work with --query_dsl, put the query_string into the query dsl")
+		}
+		// the compact json of query clause, which is decoded for every search
+		c.QueryDSL, err = ParseQueryDSL(c.QueryDSL)
+		if err != nil {
+			return err
+		}
+	}
+
+	migrator.IndexRenameRules, err = ParseIndexRenameRules(c.RenameIndexes)
+	if err != nil {
+		return err
+	}
+
+	migrator.Pipeline, err = ParsePipeline(c.Filters, c.RenameFields, c.SkipFields, c.Transforms, c.TransformScript)
+	if err != nil {
+		return err
+	}
+
+	if c.VerifyHash {
+		c.VerifyMigration = true
+	}
+	if c.VerifyMigration {
+		if len(c.SourceEs) == 0 || len(c.TargetEs) == 0 {
+			return errors.New("--verify only works when migrating from source elasticsearch to target elasticsearch")
+		}
+		if c.RepeatOutputTimes > 1 || c.RegenerateID {
+			return errors.New("--verify can't work with --repeat_times or --regenerate_id, the documents are not copied as they are")
+		}
+		// the documents dropped by --filter or --transform_script are not expected in target
+		if c.VerifyHash && (len(c.RenameFields) > 0 || len(c.SkipFields) > 0 || len(c.Transforms) > 0 || len(c.TransformScript) > 0) {
+			return errors.New("--verify_hash can't work with --rename, --skip, --transform or --transform_script, the documents are changed")
+		}
+	}
+
+	if c.BulkAction != "index" && c.BulkAction != "create" {
+		return fmt.Errorf("unknown bulk action: %s, options: index, create", c.BulkAction)
+	}
+	if len(c.VersionType) > 0 {
+		if c.VersionType != "external" && c.VersionType != "external_gte" {
+			return fmt.Errorf("unknown version type: %s, options: external, external_gte", c.VersionType)
+		}
+		if c.VersionFrom != "version" && c.VersionFrom != "seq_no" {
+			return fmt.Errorf("unknown version source: %s, options: version, seq_no", c.VersionFrom)
+		}
+		if c.BulkAction == "create" || c.RegenerateID {
+			return errors.New("--version_type can't work with --bulk_action=create or --regenerate_id")
+		}
+	}
+
+	if len(c.DeadLetterFile) > 0 {
+		migrator.DeadLetter, err = NewDeadLetterWriter(c.DeadLetterFile)
+		if err != nil {
+			return err
+		}
+		defer migrator.DeadLetter.Close()
+	}
+	if len(c.RejectedFile) > 0 {
+		migrator.Rejected, err = NewDeadLetterWriter(c.RejectedFile)
+		if err != nil {
+			return err
+		}
+		defer migrator.Rejected.Close()
 	}
 
 	var showBar bool = false
@@ -73,24 +205,61 @@ func main() {
 		showBar = false
 	}
 
-	if c.Sync {
-		//sync 功能时,只支持一个 index:
-		if len(c.SourceIndexNames) == 0 || len(c.TargetIndexName) == 0 {
-			log.Error("migration sync only support source 1 index to 1 target index")
-			return
+	if c.DiffOnly && c.VerifyMigration {
+		return errors.New("--diff can't work with --verify, the target is not changed")
+	}
+	if c.DiffOnly && len(c.DiffReportFile) == 0 {
+		return errors.New("--diff need --diff_report to write the differences, - for stdout")
+	}
+	if len(c.DiffReportFile) > 0 {
+		if !c.Sync && !c.DiffOnly {
+			return errors.New("--diff_report only works with --sync or --diff")
+		}
+		migrator.DiffReport, err = NewDiffReport(c.DiffReportFile, c.DiffFormat, c.DiffFields)
+		if err != nil {
+			return err
+		}
+		defer migrator.DiffReport.Close()
+	}
+
+	if c.Follow {
+		if len(c.SourceEs) == 0 || len(c.TargetEs) == 0 || len(c.SourceIndexNames) == 0 {
+			return errors.New("--follow only works when migrating from source elasticsearch to target elasticsearch, with -x")
+		}
+		if len(c.FollowField) == 0 || len(c.FollowStateFile) == 0 {
+			return errors.New("--follow need the --follow_field and the --follow_state file")
+		}
+		if c.Sync || c.DiffOnly || c.RepeatOutputTimes > 1 || c.RegenerateID {
+			return errors.New("--follow can't work with --sync, --diff, --repeat_times or --regenerate_id")
+		}
+		if c.FollowInterval < 1 {
+			return errors.New("--follow_interval should be greater than 0")
+		}
+		return migrator.follow()
+	}
+
+	if c.Sync || c.DiffOnly {
+		if len(c.SourceIndexNames) == 0 {
+			return errors.New("migration sync need the source indexes, ie: -x src_index or -x \"logs-*\"")
+		}
+		if c.SyncBufferCount < 1 {
+			return errors.New("--sync_buffer should be greater than 0")
 		}
 		migrator.SourceESAPI = migrator.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr, c.SourceProxy, c.Compress)
 		if migrator.SourceESAPI == nil {
-			log.Error("can not parse source es api")
-			return
+			return errors.New("can not parse source es api")
 		}
 		migrator.TargetESAPI = migrator.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr, c.TargetProxy, false)
 		if migrator.TargetESAPI == nil {
-			log.Error("can not parse target es api")
-			return
+			return errors.New("can not parse target es api")
 		}
-		migrator.SyncBetweenIndex(migrator.SourceESAPI, migrator.TargetESAPI, c)
-		return
+		if err := migrator.syncIndexes(); err != nil {
+			return err
+		}
+		if c.VerifyMigration {
+			return migrator.verifyMigration()
+		}
+		return nil
 	}
 
 	//至少输出一次
@@ -100,6 +269,21 @@ func main() {
 		log.Info("source data will repeat send to target: ", c.RepeatOutputTimes, " times, the document id will be regenerated.")
 	}
 
+	if len(c.CheckpointFile) > 0 {
+		if len(c.SourceEs) == 0 || c.RepeatOutputTimes > 1 {
+			return errors.New("--checkpoint only works when migrating from source elasticsearch, without --repeat_times")
+		}
+		if len(sortSpec) == 0 || sortSpec[0].Field == "_doc" || sortSpec[0].Field == "_score" || (sortSpec[0].Field == "_id" && !c.SearchAfter) {
+			return errors.New("--checkpoint need --sort starts with a field supports range query, ie: @timestamp, or --sort=_id with --search_after")
+		}
+		migrator.Checkpoint, err = NewCheckpoint(c.CheckpointFile, c.Resume)
+		if err != nil {
+			return err
+		}
+	} else if c.Resume {
+		return errors.New("--resume need the --checkpoint file")
+	}
+
 	if c.RepeatOutputTimes > 0 {
 
 		for i := 0; i < c.RepeatOutputTimes; i++ {
@@ -113,9 +297,9 @@ func main() {
 
 			//var srcESVersion *ClusterVersion
 			// create a progressbar and start a docCount
-			var outputBar *pb.ProgressBar = pb.New(1).Prefix("Output ")
+			var outputBar *pb.ProgressBar = pb.New(1).Prefix(migrator.barPrefix("Output "))
 
-			var fetchBar = pb.New(1).Prefix("Scroll")
+			var fetchBar = pb.New(1).Prefix(migrator.barPrefix("Scroll"))
 
 			wg := sync.WaitGroup{}
 
@@ -126,22 +310,65 @@ func main() {
 				migrator.SourceESAPI = migrator.ParseEsApi(true, c.SourceEs, c.SourceEsAuthStr,
 					migrator.Config.SourceProxy, c.Compress)
 				if migrator.SourceESAPI == nil {
-					log.Error("can not parse source es api")
-					return
+					return errors.New("can not parse source es api")
 				}
 
 				if c.ScrollSliceSize < 1 {
 					c.ScrollSliceSize = 1
 				}
 
+				if c.VersionFrom == "seq_no" && len(c.VersionType) > 0 {
+					if version := migrator.SourceESAPI.ClusterVersion(); !version.IsOpenSearch() && !version.IsAtLeast(6, 7) {
+						return errors.New("--version_from=seq_no need elasticsearch 6.7+, use --version_from=version instead")
+					}
+				}
+
+				if migrator.Checkpoint != nil {
+					version := migrator.SourceESAPI.ClusterVersion()
+					if !version.IsOpenSearch() && version.MajorVersion() < 5 {
+						return errors.New("scan scroll before 5.0 is not sorted, --checkpoint is not supported")
+					}
+					if c.SearchAfter && len(sortSpec.Without("_id")) == 0 && version.MajorVersion() >= 8 {
+						return errors.New("sort by _id is not allowed in 8.x, --checkpoint need another --sort field")
+					}
+				}
+
 				totalSize := 0
-				finishedSlice := 0
+				scrollWg := sync.WaitGroup{}
 				for slice := 0; slice < c.ScrollSliceSize; slice++ {
-					scroll, err := migrator.SourceESAPI.NewScroll(c.SourceIndexNames, c.ScrollTime, c.DocBufferCount, c.Query,
-						c.SortField, slice, c.ScrollSliceSize, c.Fields)
+					var filter map[string]interface{}
+					var searchAfter []interface{}
+					var sliceCheckpoint *SliceCheckpoint
+					if migrator.Checkpoint != nil {
+						sliceCheckpoint, err = migrator.Checkpoint.Slice(c.SourceIndexNames, c.SortField, slice, c.ScrollSliceSize)
+						if err != nil {
+							return err
+						}
+						if sliceCheckpoint.Done {
+							log.Infof("slice %d was finished, skip", slice)
+							continue
+						}
+						if c.SearchAfter {
+							searchAfter = sliceCheckpoint.ResumeSearchAfter()
+						} else {
+							filter = sliceCheckpoint.ResumeFilter(c.SortField)
+						}
+						if len(sliceCheckpoint.LastSort) > 0 {
+							log.Infof("resume slice %d from %s=%v, %d documents were done", slice, c.SortField,
+								sliceCheckpoint.LastSort[0], sliceCheckpoint.Count)
+						}
+					}
+
+					var scroll ScrollAPI
+					if c.SearchAfter {
+						scroll, err = migrator.SourceESAPI.NewSearchAfter(c.SourceIndexNames, c.ScrollTime, c.DocBufferCount, c.SearchQuery(), filter,
+							c.SortField, slice, c.ScrollSliceSize, c.Fields, searchAfter)
+					} else {
+						scroll, err = migrator.SourceESAPI.NewScroll(c.SourceIndexNames, c.ScrollTime, c.DocBufferCount, c.SearchQuery(), filter,
+							c.SortField, slice, c.ScrollSliceSize, c.Fields)
+					}
 					if err != nil {
-						log.Error(err)
-						return
+						return err
 					}
 
 					totalSize += scroll.GetHitsTotal()
@@ -149,79 +376,97 @@ func main() {
 					if scroll.GetDocs() != nil {
 
 						if scroll.GetHitsTotal() == 0 {
-							log.Error("can't find documents from source.")
-							return
+							if sliceCheckpoint != nil {
+								sliceCheckpoint.Finish()
+								continue
+							}
+							return errors.New("can't find documents from source.")
 						}
 
+						scroll.SetCheckpoint(sliceCheckpoint)
+						wg.Add(1)
+						scrollWg.Add(1)
 						go func() {
-							wg.Add(1)
 							//process input
 							// start scroll
-							scroll.ProcessScrollResult(&migrator, fetchBar)
+							scroll.ProcessScrollResult(migrator, fetchBar)
 
 							// loop scrolling until done
-							for scroll.Next(&migrator, fetchBar) == false {
+							for scroll.Next(migrator, fetchBar) == false {
 							}
 
 							if showBar {
 								fetchBar.Finish()
 							}
 
+							sliceCheckpoint.Finish()
+
 							// finished, close doc chan and wait for goroutines to be done
 							wg.Done()
-							finishedSlice++
-
-							//clean up final results
-							if finishedSlice == c.ScrollSliceSize {
-								log.Debug("closing doc chan")
-								close(migrator.DocChan)
-							}
+							scrollWg.Done()
 						}()
 					}
 				}
 
+				//clean up final results
+				go func() {
+					scrollWg.Wait()
+					log.Debug("closing doc chan")
+					close(migrator.DocChan)
+				}()
+
 				if totalSize > 0 {
 					fetchBar.Total = int64(totalSize)
 					outputBar.Total = int64(totalSize)
 				}
 
 			} else if len(c.DumpInputFile) > 0 {
-				//read file stream
-				wg.Add(1)
-				f, err := os.Open(c.DumpInputFile)
-				if err != nil {
-					log.Error(err)
-					return
-				}
-				//get file lines
-				lineCount := 0
-				defer f.Close()
-				r := bufio.NewReader(f)
-				for {
-					_, err := r.ReadString('\n')
-					if io.EOF == err || nil != err {
-						break
+				if isManifestFile(c.DumpInputFile) {
+					manifest, err := LoadDumpManifest(c.DumpInputFile)
+					if err != nil {
+						return err
 					}
-					lineCount += 1
-				}
-				log.Trace("file line,", lineCount)
+					if err := manifest.Verify(); err != nil {
+						return err
+					}
+					log.Infof("loading %d documents from %d dump chunks", manifest.TotalDocs, len(manifest.Chunks))
 
-				fetchBar := pb.New(lineCount).Prefix("Read")
-				outputBar = pb.New(lineCount).Prefix("Output ")
+					fetchBar = pb.New(manifest.TotalDocs).Prefix(migrator.barPrefix("Read"))
+					outputBar = pb.New(manifest.TotalDocs).Prefix(migrator.barPrefix("Output "))
 
-				f.Close()
+					//read chunks in parallel
+					wg.Add(1)
+					go migrator.NewManifestReadWorker(manifest, fetchBar, &wg)
+				} else {
+					//get file documents
+					docCount, err := countFileDocs(c.DumpInputFile, c.InputFileType, c.FileCompression)
+					if err != nil {
+						return err
+					}
+					log.Trace("file documents,", docCount)
+
+					fetchBar = pb.New(docCount).Prefix(migrator.barPrefix("Read"))
+					outputBar = pb.New(docCount).Prefix(migrator.barPrefix("Output "))
 
-				go migrator.NewFileReadWorker(fetchBar, &wg)
+					//read file stream
+					wg.Add(1)
+					go migrator.NewFileReadWorker(fetchBar, &wg)
+				}
 
 			}
 
 			var pool *pb.Pool
 			if showBar {
 
-				// start pool
-				pool, err = pb.StartPool(fetchBar, outputBar)
-				if err != nil {
-					panic(err)
+				if migrator.Pool != nil {
+					// progress bars of batch jobs share one pool
+					migrator.Pool.Add(fetchBar, outputBar)
+				} else {
+					// start pool
+					pool, err = pb.StartPool(fetchBar, outputBar)
+					if err != nil {
+						panic(err)
+					}
 				}
 			}
 
@@ -237,17 +482,14 @@ func main() {
 				migrator.TargetESAPI = migrator.ParseEsApi(false, c.TargetEs, c.TargetEsAuthStr,
 					migrator.Config.TargetProxy, false)
 				if migrator.TargetESAPI == nil {
-					log.Error("can not parse target es api")
-					return
+					return errors.New("can not parse target es api")
 				}
 
 				log.Debug("start process with mappings")
-				if c.CopyIndexMappings &&
-					migrator.TargetESAPI.ClusterVersion().Version.Number[0] != migrator.SourceESAPI.ClusterVersion().Version.Number[0] {
-					log.Error(migrator.SourceESAPI.ClusterVersion().Version, "=>",
-						migrator.TargetESAPI.ClusterVersion().Version,
-						",cross-big-version mapping migration not available, please update mapping manually :(")
-					return
+				if c.CopyIndexMappings && migrator.SourceESAPI != nil &&
+					!isMappingCompatible(migrator.SourceESAPI.ClusterVersion(), migrator.TargetESAPI.ClusterVersion()) {
+					return fmt.Errorf("%v=>%v,cross-big-version mapping migration not available, please update mapping manually :(",
+						migrator.SourceESAPI.ClusterVersion().Version.Number, migrator.TargetESAPI.ClusterVersion().Version.Number)
 				}
 
 				// wait for cluster state to be okay before moving
@@ -280,8 +522,7 @@ func main() {
 					indexNames, indexCount, sourceIndexMappings, err := migrator.SourceESAPI.GetIndexMappings(c.CopyAllIndexes, c.SourceIndexNames)
 
 					if err != nil {
-						log.Error(err)
-						return
+						return err
 					}
 
 					sourceIndexRefreshSettings := map[string]interface{}{}
@@ -301,127 +542,38 @@ func main() {
 							sourceIndexSettings, err := migrator.SourceESAPI.GetIndexSettings(c.SourceIndexNames)
 							log.Debug("source index settings:", sourceIndexSettings)
 							if err != nil {
-								log.Error(err)
-								return
-							}
-
-							//get target index settings
-							targetIndexSettings, err := migrator.TargetESAPI.GetIndexSettings(c.TargetIndexName)
-							if err != nil {
-								//ignore target es settings error
-								log.Debug(err)
-							}
-							log.Debug("target IndexSettings", targetIndexSettings)
-
-							//if there is only one index and we specify the dest indexname
-							if c.SourceIndexNames != c.TargetIndexName && (len(c.TargetIndexName) > 0) && indexCount == 1 {
-								log.Debugf("only one index,so we can rewrite indexname, src:%v, dest:%v ,indexCount:%d", c.SourceIndexNames, c.TargetIndexName, indexCount)
-								(*sourceIndexSettings)[c.TargetIndexName] = (*sourceIndexSettings)[c.SourceIndexNames]
-								delete(*sourceIndexSettings, c.SourceIndexNames)
-								log.Debug(sourceIndexSettings)
-							}
-
-							// dealing with indices settings
-							for name, idx := range *sourceIndexSettings {
-								log.Debug("dealing with index,name:", name, ",settings:", idx)
-								tempIndexSettings := getEmptyIndexSettings()
-
-								targetIndexExist := false
-								//if target index settings is exist and we don't copy settings, we use target settings
-								if targetIndexSettings != nil {
-									//if target es have this index and we dont copy index settings
-									if val, ok := (*targetIndexSettings)[name]; ok {
-										targetIndexExist = true
-										tempIndexSettings = val.(map[string]interface{})
-									}
-
-									if c.RecreateIndex {
-										migrator.TargetESAPI.DeleteIndex(name)
-										targetIndexExist = false
-									}
-								}
-
-								//copy index settings
-								if c.CopyIndexSettings {
-									tempIndexSettings = ((*sourceIndexSettings)[name]).(map[string]interface{})
-								}
-
-								//check map elements
-								if _, ok := tempIndexSettings["settings"]; !ok {
-									tempIndexSettings["settings"] = map[string]interface{}{}
-								}
-
-								if _, ok := tempIndexSettings["settings"].(map[string]interface{})["index"]; !ok {
-									tempIndexSettings["settings"].(map[string]interface{})["index"] = map[string]interface{}{}
-								}
-
-								sourceIndexRefreshSettings[name] = ((*sourceIndexSettings)[name].(map[string]interface{}))["settings"].(map[string]interface{})["index"].(map[string]interface{})["refresh_interval"]
-
-								//set refresh_interval
-								tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["refresh_interval"] = -1
-								tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_replicas"] = 0
-
-								//clean up settings
-								delete(tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{}), "number_of_shards")
-
-								//copy indexsettings and mappings
-								if targetIndexExist {
-									log.Debug("update index with settings,", name, tempIndexSettings)
-									//override shard settings
-									if c.ShardsCount > 0 {
-										tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_shards"] = c.ShardsCount
-									}
-									err := migrator.TargetESAPI.UpdateIndexSettings(name, tempIndexSettings)
-									if err != nil {
-										log.Error(err)
-									}
-								} else {
-
-									//override shard settings
-									if c.ShardsCount > 0 {
-										tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_shards"] = c.ShardsCount
-									}
-
-									log.Debug("create index with settings,", name, tempIndexSettings)
-									err := migrator.TargetESAPI.CreateIndex(name, tempIndexSettings)
-									if err != nil {
-										log.Error(err)
-									}
-
-								}
-
-							}
-
-							if c.CopyIndexMappings {
-
-								//if there is only one index and we specify the dest indexname
-								if c.SourceIndexNames != c.TargetIndexName && (len(c.TargetIndexName) > 0) && indexCount == 1 {
-									log.Debugf("only one index,so we can rewrite indexname, src:%v, dest:%v ,indexCount:%d", c.SourceIndexNames, c.TargetIndexName, indexCount)
-									(*sourceIndexMappings)[c.TargetIndexName] = (*sourceIndexMappings)[c.SourceIndexNames]
-									delete(*sourceIndexMappings, c.SourceIndexNames)
-									log.Debug(sourceIndexMappings)
-								}
-
-								for name, mapping := range *sourceIndexMappings {
-									err := migrator.TargetESAPI.UpdateIndexMapping(name, mapping.(map[string]interface{})["mappings"].(map[string]interface{}))
-									if err != nil {
-										log.Error(err)
-									}
-								}
+								return err
 							}
 
+							sourceIndexRefreshSettings = migrator.copyIndexSettings(c.SourceIndexNames, indexCount, sourceIndexSettings, sourceIndexMappings)
 							log.Info("settings/mappings migration finished.")
 						}
 
 					} else {
-						log.Error("index not exists,", c.SourceIndexNames)
-						return
+						return fmt.Errorf("index not exists, %s", c.SourceIndexNames)
 					}
 
 					defer migrator.recoveryIndexSettings(sourceIndexRefreshSettings)
-				} else if len(c.DumpInputFile) > 0 {
-					//check shard settings
-					//TODO support shard config
+				} else if len(c.DumpInputFile) > 0 && (c.CopyIndexSettings || c.CopyIndexMappings || c.ShardsCount > 0) {
+					// recreate indexes from the settings and mappings saved with dump
+					metaPath := getIndexMetaPath(c.DumpInputFile)
+					meta, err := LoadIndexMeta(metaPath)
+					if err != nil {
+						return fmt.Errorf("can't load the settings and mappings of dump, %v", err)
+					}
+
+					if c.CopyIndexMappings && meta.SourceCluster != nil &&
+						!isMappingCompatible(meta.SourceCluster, migrator.TargetESAPI.ClusterVersion()) {
+						return fmt.Errorf("%v=>%v,cross-big-version mapping migration not available, please update mapping manually :(",
+							meta.SourceCluster.Version.Number, migrator.TargetESAPI.ClusterVersion().Version.Number)
+					}
+
+					log.Infof("start settings/mappings migration from %s..", metaPath)
+					indexNames := meta.IndexNames()
+					sourceIndexRefreshSettings := migrator.copyIndexSettings(strings.Join(indexNames, ","), len(indexNames), meta.Settings, meta.Mappings)
+					log.Info("settings/mappings migration finished.")
+
+					defer migrator.recoveryIndexSettings(sourceIndexRefreshSettings)
 				}
 
 			}
@@ -431,31 +583,92 @@ func main() {
 			//start es bulk thread
 			if len(c.TargetEs) > 0 {
 				log.Debug("start es bulk workers")
-				outputBar.Prefix("Bulk")
+				outputBar.Prefix(migrator.barPrefix("Bulk"))
 				var docCount int
 				wg.Add(c.Workers)
 				for i := 0; i < c.Workers; i++ {
 					go migrator.NewBulkWorker(&docCount, outputBar, &wg)
 				}
+			} else if len(c.LogstashEndpoint) > 0 {
+				log.Debug("start logstash workers")
+				outputBar.Prefix(migrator.barPrefix("Logstash"))
+				endpoints := getLogstashEndpoints(c.LogstashEndpoint)
+				if len(endpoints) == 0 {
+					return fmt.Errorf("invalid logstash endpoint: %s", c.LogstashEndpoint)
+				}
+				var tlsConfig *tls.Config
+				if c.LogstashSecEndpoint {
+					tlsConfig, err = logstashTLSConfig(c.LogstashCA, c.LogstashInsecure)
+					if err != nil {
+						return fmt.Errorf("can't load --logstash_ca, %v", err)
+					}
+				}
+				wg.Add(c.Workers)
+				for i := 0; i < c.Workers; i++ {
+					go migrator.NewLogstashWorker(endpoints[i%len(endpoints)], tlsConfig, outputBar, &wg)
+				}
 			} else if len(c.DumpOutFile) > 0 {
+				// keep settings and mappings with the documents, to recreate the indexes on restore
+				if len(c.SourceEs) > 0 {
+					if err := migrator.saveIndexMeta(); err != nil {
+						return err
+					}
+				}
+
 				// start file write
-				outputBar.Prefix("Write")
+				outputBar.Prefix(migrator.barPrefix("Write"))
 				wg.Add(1)
 				go migrator.NewFileDumpWorker(outputBar, &wg)
 			}
 
 			wg.Wait()
 
+			migrator.Stats.Read += fetchBar.Get()
+			migrator.Stats.Written += outputBar.Get()
+
+			if migrator.Checkpoint != nil {
+				if err := migrator.Checkpoint.Save(); err == nil {
+					log.Infof("checkpoint saved to %s", c.CheckpointFile)
+				}
+			}
+
 			if showBar {
 
 				outputBar.Finish()
 				// close pool
-				pool.Stop()
+				if pool != nil {
+					pool.Stop()
+				}
 
 			}
 		}
 
 	}
 
+	if migrator.TransformStats.Dropped > 0 || migrator.TransformStats.Rejected > 0 {
+		log.Infof("%d documents were dropped by --filter or --transform_script, %d documents failed to transform", migrator.TransformStats.Dropped, migrator.TransformStats.Rejected)
+		if migrator.Rejected != nil && migrator.TransformStats.Rejected > 0 {
+			log.Infof("failed documents were written to %s, replay them with: -i %s", c.RejectedFile, c.RejectedFile)
+		}
+	}
+	if migrator.BulkStats.Conflicts > 0 {
+		log.Infof("bulk skipped %d documents with version conflicts, target has them already or newer", migrator.BulkStats.Conflicts)
+	}
+	if migrator.BulkStats.Retried > 0 || migrator.BulkStats.Failed > 0 {
+		log.Infof("bulk retried %d documents, %d documents failed", migrator.BulkStats.Retried, migrator.BulkStats.Failed)
+		if migrator.DeadLetter != nil && migrator.BulkStats.Failed > 0 {
+			log.Infof("failed documents were written to %s, replay them with: -i %s", c.DeadLetterFile, c.DeadLetterFile)
+		}
+	}
+
+	if migrator.LogstashStats.Failed > 0 {
+		return fmt.Errorf("%d documents failed to send to logstash", migrator.LogstashStats.Failed)
+	}
+
 	log.Info("data migration finished.")
+
+	if c.VerifyMigration {
+		return migrator.verifyMigration()
+	}
+	return nil
 }
@@ -0,0 +1,337 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const manifestSuffix = ".manifest.json"
+
+// DumpManifest list the chunks of a dump which was rotated by --split_docs or --split_size,
+// the chunk files are stored next to the manifest
+type DumpManifest struct {
+	CreatedAt     time.Time       `json:"created_at"`
+	SourceCluster *ClusterVersion `json:"source_cluster,omitempty"`
+	SourceIndexes []string        `json:"source_indexes"`
+	Compression   string          `json:"compression"`
+	TotalDocs     int             `json:"total_docs"`
+	Chunks        []DumpChunk     `json:"chunks"`
+
+	path   string
+	prefix string
+	suffix string
+}
+
+type DumpChunk struct {
+	File    string   `json:"file"`
+	Docs    int      `json:"docs"`
+	Size    int64    `json:"size"`
+	Sha256  string   `json:"sha256"`
+	Indexes []string `json:"indexes"`
+}
+
+// isManifestFile check whether the input file is a dump manifest
+func isManifestFile(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), manifestSuffix)
+}
+
+// splitDumpPath split the output file into the prefix and the extensions of chunks,
+// ie: dump.json.gz => dump, .json.gz
+func splitDumpPath(path string) (string, string) {
+	base := path
+	suffix := ""
+	for _, ext := range []string{".gz", ".zst", ".zstd"} {
+		if strings.HasSuffix(strings.ToLower(base), ext) {
+			suffix = base[len(base)-len(ext):]
+			base = base[:len(base)-len(ext)]
+			break
+		}
+	}
+	ext := filepath.Ext(base)
+	return base[:len(base)-len(ext)], ext + suffix
+}
+
+// newDumpManifest create the manifest of output file, the previous manifest is continued
+// unless --truncate_output
+func (c *Migrator) newDumpManifest(compression string) (*DumpManifest, error) {
+	prefix, suffix := splitDumpPath(c.Config.DumpOutFile)
+	path := prefix + manifestSuffix
+
+	manifest := &DumpManifest{}
+	if !c.Config.TruncateOutFile && checkFileIsExist(path) {
+		var err error
+		manifest, err = LoadDumpManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("continue dump manifest %s, %d chunks exist", path, len(manifest.Chunks))
+	} else {
+		manifest.CreatedAt = time.Now()
+		manifest.SourceIndexes = []string{}
+		manifest.Chunks = []DumpChunk{}
+		if c.SourceESAPI != nil {
+			manifest.SourceCluster = c.SourceESAPI.ClusterVersion()
+		}
+	}
+
+	if len(compression) == 0 {
+		compression = "none"
+	}
+	if len(manifest.Chunks) > 0 && manifest.Compression != compression {
+		return nil, fmt.Errorf("dump manifest %s was created with compression %s, can't continue with %s",
+			path, manifest.Compression, compression)
+	}
+	manifest.Compression = compression
+	manifest.path = path
+	manifest.prefix = prefix
+	manifest.suffix = suffix
+
+	return manifest, manifest.Save()
+}
+
+// LoadDumpManifest read the manifest of a rotated dump
+func LoadDumpManifest(path string) (*DumpManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &DumpManifest{}
+	if err := DecodeJsonBytes(data, manifest); err != nil {
+		return nil, err
+	}
+	manifest.path = path
+	return manifest, nil
+}
+
+// Save write the manifest to disk
+func (manifest *DumpManifest) Save() error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first, so a crash never leaves a broken manifest
+	tmp := manifest.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, manifest.path)
+}
+
+// NextChunkPath return the path of the chunk to be written, ie: dump-00001.json
+func (manifest *DumpManifest) NextChunkPath() string {
+	return fmt.Sprintf("%s-%05d%s", manifest.prefix, len(manifest.Chunks)+1, manifest.suffix)
+}
+
+// ChunkPath return the path of chunk, relative paths are resolved from the manifest
+func (manifest *DumpManifest) ChunkPath(chunk DumpChunk) string {
+	if filepath.IsAbs(chunk.File) {
+		return chunk.File
+	}
+	return filepath.Join(filepath.Dir(manifest.path), chunk.File)
+}
+
+// IsChunkFull check whether the chunk reached the max documents or the max size in MB
+func (manifest *DumpManifest) IsChunkFull(chunk *dumpFile, maxDocs int, maxSizeInMB int) bool {
+	if maxDocs > 0 && chunk.docs >= maxDocs {
+		return true
+	}
+	return maxSizeInMB > 0 && chunk.size >= int64(maxSizeInMB)*1024*1024
+}
+
+// AddChunk add a closed chunk into the manifest and save it
+func (manifest *DumpManifest) AddChunk(chunk *dumpFile) error {
+	indexes := make([]string, 0, len(chunk.indexes))
+	for index := range chunk.indexes {
+		indexes = append(indexes, index)
+	}
+	sort.Strings(indexes)
+
+	manifest.Chunks = append(manifest.Chunks, DumpChunk{
+		File:    filepath.Base(chunk.path),
+		Docs:    chunk.docs,
+		Size:    chunk.size,
+		Sha256:  hex.EncodeToString(chunk.hash.Sum(nil)),
+		Indexes: indexes,
+	})
+	manifest.TotalDocs += chunk.docs
+
+	for _, index := range indexes {
+		found := false
+		for _, v := range manifest.SourceIndexes {
+			if v == index {
+				found = true
+				break
+			}
+		}
+		if !found {
+			manifest.SourceIndexes = append(manifest.SourceIndexes, index)
+		}
+	}
+	sort.Strings(manifest.SourceIndexes)
+
+	log.Debugf("dump chunk %s finished, %d documents", chunk.path, chunk.docs)
+	return manifest.Save()
+}
+
+// Verify check the size and checksum of all the chunks before loading them
+func (manifest *DumpManifest) Verify() error {
+	for _, chunk := range manifest.Chunks {
+		path := manifest.ChunkPath(chunk)
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		size, err := io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		if size != chunk.Size {
+			return fmt.Errorf("size of dump chunk %s is %d, expected %d", path, size, chunk.Size)
+		}
+		if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != chunk.Sha256 {
+			return fmt.Errorf("checksum of dump chunk %s mismatch, %s != %s", path, checksum, chunk.Sha256)
+		}
+	}
+	return nil
+}
+
+// NewManifestReadWorker load the chunks of manifest in parallel, by at most --workers readers
+func (m *Migrator) NewManifestReadWorker(manifest *DumpManifest, pb *pb.ProgressBar, wg *sync.WaitGroup) {
+	log.Debug("start reading dump manifest, ", manifest.path)
+	defer wg.Done()
+	defer close(m.DocChan)
+
+	chunks := make(chan DumpChunk, len(manifest.Chunks))
+	for _, chunk := range manifest.Chunks {
+		chunks <- chunk
+	}
+	close(chunks)
+
+	readers := m.Config.Workers
+	if readers > len(manifest.Chunks) {
+		readers = len(manifest.Chunks)
+	}
+
+	readerWg := sync.WaitGroup{}
+	readerWg.Add(readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			defer readerWg.Done()
+			for chunk := range chunks {
+				path := manifest.ChunkPath(chunk)
+				log.Debug("start reading dump chunk, ", path)
+				if err := m.readInputFile(path, "dump", manifest.Compression, pb); err != nil {
+					log.Error(err)
+				}
+			}
+		}()
+	}
+	readerWg.Wait()
+
+	log.Debug("end reading dump manifest")
+}
+
+const indexMetaSuffix = ".meta.json"
+
+// DumpIndexMeta is the settings and mappings of the dumped indexes, saved next to the dump,
+// so the indexes can be recreated before restoring the documents
+type DumpIndexMeta struct {
+	SourceCluster *ClusterVersion `json:"source_cluster,omitempty"`
+	Settings      *Indexes        `json:"settings"`
+	Mappings      *Indexes        `json:"mappings"`
+}
+
+// getIndexMetaPath return the path of index metadata of dump file or manifest, ie: dump.json.gz => dump.meta.json
+func getIndexMetaPath(path string) string {
+	if isManifestFile(path) {
+		return path[:len(path)-len(manifestSuffix)] + indexMetaSuffix
+	}
+	prefix, _ := splitDumpPath(path)
+	return prefix + indexMetaSuffix
+}
+
+// saveIndexMeta save the settings and mappings of source indexes next to the output file
+func (m *Migrator) saveIndexMeta() error {
+	indexNames, _, mappings, err := m.SourceESAPI.GetIndexMappings(m.Config.CopyAllIndexes, m.Config.SourceIndexNames)
+	if err != nil {
+		return err
+	}
+	settings, err := m.SourceESAPI.GetIndexSettings(indexNames)
+	if err != nil {
+		return err
+	}
+
+	meta := DumpIndexMeta{
+		SourceCluster: m.SourceESAPI.ClusterVersion(),
+		Settings:      settings,
+		Mappings:      mappings,
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := getIndexMetaPath(m.Config.DumpOutFile)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	log.Infof("settings and mappings of %s were saved to %s", indexNames, path)
+	return nil
+}
+
+// LoadIndexMeta read the settings and mappings saved with dump
+func LoadIndexMeta(path string) (*DumpIndexMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta := &DumpIndexMeta{}
+	if err := DecodeJsonBytes(data, meta); err != nil {
+		return nil, err
+	}
+	if meta.Settings == nil || meta.Mappings == nil {
+		return nil, fmt.Errorf("invalid index metadata file: %s", path)
+	}
+	return meta, nil
+}
+
+// IndexNames return the sorted names of dumped indexes
+func (meta *DumpIndexMeta) IndexNames() []string {
+	names := make([]string, 0, len(*meta.Mappings))
+	for name := range *meta.Mappings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
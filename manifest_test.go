@@ -0,0 +1,342 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/cheggaaa/pb"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSplitDumpPath(t *testing.T) {
+	cases := []struct {
+		path   string
+		prefix string
+		suffix string
+	}{
+		{"dump.json", "dump", ".json"},
+		{"dump.json.gz", "dump", ".json.gz"},
+		{"/data/dump.ndjson.ZST", "/data/dump", ".ndjson.ZST"},
+		{"dump", "dump", ""},
+		{"dump.gz", "dump", ".gz"},
+	}
+
+	for _, c := range cases {
+		prefix, suffix := splitDumpPath(c.path)
+		if prefix != c.prefix || suffix != c.suffix {
+			t.Errorf("%s: got %s, %s, want %s, %s", c.path, prefix, suffix, c.prefix, c.suffix)
+		}
+	}
+}
+
+// dumpDocs dump the documents with ids into the output file of migrator
+func dumpDocs(m *Migrator, ids ...string) {
+	m.DocChan = make(chan map[string]interface{}, len(ids))
+	for _, id := range ids {
+		m.DocChan <- map[string]interface{}{"_index": "idx-" + id[:1], "_type": "_doc", "_id": id, "_source": map[string]interface{}{"v": id}}
+	}
+	close(m.DocChan)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	m.NewFileDumpWorker(pb.New(0), &wg)
+}
+
+func TestManifestRotation(t *testing.T) {
+	dir := t.TempDir()
+	m := &Migrator{Config: &Config{DumpOutFile: filepath.Join(dir, "dump.json.gz"), SplitDocs: 2, DocBufferCount: 10}}
+	dumpDocs(m, "a1", "a2", "b1", "b2", "b3")
+
+	manifest, err := LoadDumpManifest(filepath.Join(dir, "dump"+manifestSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	var docs []int
+	for _, chunk := range manifest.Chunks {
+		files = append(files, chunk.File)
+		docs = append(docs, chunk.Docs)
+	}
+	if want := []string{"dump-00001.json.gz", "dump-00002.json.gz", "dump-00003.json.gz"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got chunks %v, want %v", files, want)
+	}
+	if want := []int{2, 2, 1}; !reflect.DeepEqual(docs, want) {
+		t.Errorf("got documents of chunks %v, want %v", docs, want)
+	}
+	if manifest.TotalDocs != 5 || manifest.Compression != "gzip" {
+		t.Errorf("got %d documents compressed by %s, want 5 by gzip", manifest.TotalDocs, manifest.Compression)
+	}
+	if want := []string{"idx-a", "idx-b"}; !reflect.DeepEqual(manifest.SourceIndexes, want) {
+		t.Errorf("got source indexes %v, want %v", manifest.SourceIndexes, want)
+	}
+	if err := manifest.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the manifest is continued by the next dump
+	dumpDocs(m, "c1")
+	manifest, err = LoadDumpManifest(filepath.Join(dir, "dump"+manifestSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) != 4 || manifest.Chunks[3].File != "dump-00004.json.gz" || manifest.TotalDocs != 6 {
+		t.Errorf("got %d chunks of %d documents after continued, want 4 chunks of 6 documents", len(manifest.Chunks), manifest.TotalDocs)
+	}
+
+	// but not with another compression
+	m.Config.DumpOutFile = filepath.Join(dir, "dump.json")
+	if _, err := m.newDumpManifest(""); err == nil || !strings.Contains(err.Error(), "can't continue with none") {
+		t.Errorf("got error %v, want can't continue", err)
+	}
+
+	// --truncate_output starts a new one
+	m.Config.TruncateOutFile = true
+	dumpDocs(m, "d1")
+	manifest, err = LoadDumpManifest(filepath.Join(dir, "dump"+manifestSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) != 1 || manifest.Chunks[0].File != "dump-00001.json" || manifest.TotalDocs != 1 {
+		t.Errorf("got %d chunks of %d documents after truncated, want 1 chunk of 1 document", len(manifest.Chunks), manifest.TotalDocs)
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(path string) error
+		err    string
+	}{
+		{name: "intact", modify: func(path string) error { return nil }},
+		{
+			name: "truncated",
+			modify: func(path string) error {
+				return os.Truncate(path, 10)
+			},
+			err: "size of dump chunk",
+		},
+		{
+			name: "modified",
+			modify: func(path string) error {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				data[len(data)-2] = 'x'
+				return os.WriteFile(path, data, 0644)
+			},
+			err: "checksum of dump chunk",
+		},
+		{
+			name:   "missing",
+			modify: os.Remove,
+			err:    "no such file",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			m := &Migrator{Config: &Config{DumpOutFile: filepath.Join(dir, "dump.json"), SplitDocs: 2, DocBufferCount: 10}}
+			dumpDocs(m, "a1", "a2", "a3")
+
+			manifest, err := LoadDumpManifest(filepath.Join(dir, "dump"+manifestSuffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.modify(manifest.ChunkPath(manifest.Chunks[1])); err != nil {
+				t.Fatal(err)
+			}
+
+			err = manifest.Verify()
+			if len(c.err) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("got error %v, want %s", err, c.err)
+			}
+		})
+	}
+}
+
+func TestManifestReadWorker(t *testing.T) {
+	dir := t.TempDir()
+	var ids []string
+	for i := 0; i < 25; i++ {
+		ids = append(ids, fmt.Sprintf("a%02d", i))
+	}
+	m := &Migrator{Config: &Config{DumpOutFile: filepath.Join(dir, "dump.json.zst"), SplitDocs: 4, DocBufferCount: 10}}
+	dumpDocs(m, ids...)
+
+	manifest, err := LoadDumpManifest(filepath.Join(dir, "dump"+manifestSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) != 7 {
+		t.Fatalf("got %d chunks, want 7", len(manifest.Chunks))
+	}
+
+	for _, workers := range []int{1, 3, 10} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			reader := &Migrator{Config: &Config{Workers: workers}, DocChan: make(chan map[string]interface{}, 10)}
+			bar := pb.New(0)
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			go reader.NewManifestReadWorker(manifest, bar, &wg)
+
+			var got []string
+			for doc := range reader.DocChan {
+				got = append(got, doc["_id"].(string))
+			}
+			wg.Wait()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, ids) {
+				t.Errorf("got documents %v, want %v", got, ids)
+			}
+			if bar.Get() != int64(len(ids)) {
+				t.Errorf("got progress %d, want %d", bar.Get(), len(ids))
+			}
+		})
+	}
+}
+
+func TestGetIndexMetaPath(t *testing.T) {
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"dump.json", "dump.meta.json"},
+		{"/data/dump.json.gz", "/data/dump.meta.json"},
+		{"dump" + manifestSuffix, "dump.meta.json"},
+		{"dump", "dump.meta.json"},
+	}
+
+	for _, c := range cases {
+		if got := getIndexMetaPath(c.path); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.path, got, c.want)
+		}
+	}
+}
+
+// fakeMetaES answer the settings and mappings of source indexes
+type fakeMetaES struct {
+	ESAPI
+	version  string
+	mappings Indexes
+	settings Indexes
+	// the index names GetIndexSettings was asked for
+	settingsOf string
+}
+
+func (f *fakeMetaES) ClusterVersion() *ClusterVersion {
+	version := &ClusterVersion{ClusterName: "source"}
+	version.Version.Number = f.version
+	return version
+}
+
+func (f *fakeMetaES) GetIndexMappings(copyAllIndexes bool, indexNames string) (string, int, *Indexes, error) {
+	return resolvedIndexNames(indexNames, f.mappings), len(f.mappings), &f.mappings, nil
+}
+
+func (f *fakeMetaES) GetIndexSettings(indexNames string) (*Indexes, error) {
+	f.settingsOf = indexNames
+	return &f.settings, nil
+}
+
+func TestIndexMetaRoundTrip(t *testing.T) {
+	api := &fakeMetaES{
+		version: "6.8.0",
+		mappings: Indexes{
+			"logs-2": map[string]interface{}{"mappings": map[string]interface{}{"doc": map[string]interface{}{"properties": map[string]interface{}{"n": map[string]interface{}{"type": "long"}}}}},
+			"logs-1": map[string]interface{}{"mappings": map[string]interface{}{"doc": map[string]interface{}{"properties": map[string]interface{}{}}}},
+		},
+		settings: Indexes{
+			"logs-1": map[string]interface{}{"settings": map[string]interface{}{"index": map[string]interface{}{"number_of_shards": "3"}}},
+			"logs-2": map[string]interface{}{"settings": map[string]interface{}{"index": map[string]interface{}{"number_of_shards": "1"}}},
+		},
+	}
+	dir := t.TempDir()
+	m := &Migrator{Config: &Config{DumpOutFile: filepath.Join(dir, "dump.json.gz"), SourceIndexNames: "logs-*"}, SourceESAPI: api}
+	if err := m.saveIndexMeta(); err != nil {
+		t.Fatal(err)
+	}
+	if api.settingsOf != "logs-1,logs-2" {
+		t.Errorf("got settings of %s, want logs-1,logs-2", api.settingsOf)
+	}
+
+	// the manifest of a rotated dump finds the same metadata
+	meta, err := LoadIndexMeta(getIndexMetaPath(filepath.Join(dir, "dump"+manifestSuffix)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"logs-1", "logs-2"}; !reflect.DeepEqual(meta.IndexNames(), want) {
+		t.Errorf("got index names %v, want %v", meta.IndexNames(), want)
+	}
+	if meta.SourceCluster == nil || meta.SourceCluster.Version.Number != "6.8.0" {
+		t.Errorf("got source cluster %+v, want 6.8.0", meta.SourceCluster)
+	}
+	assertJsonEqual(t, meta.Mappings, `{"logs-1":{"mappings":{"doc":{"properties":{}}}},"logs-2":{"mappings":{"doc":{"properties":{"n":{"type":"long"}}}}}}`)
+	assertJsonEqual(t, meta.Settings, `{"logs-1":{"settings":{"index":{"number_of_shards":"3"}}},"logs-2":{"settings":{"index":{"number_of_shards":"1"}}}}`)
+}
+
+func TestLoadIndexMeta(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{name: "valid", data: `{"settings":{"a":{}},"mappings":{"a":{}}}`},
+		{name: "without settings", data: `{"mappings":{"a":{}}}`, err: "invalid index metadata file"},
+		{name: "without mappings", data: `{"settings":{"a":{}}}`, err: "invalid index metadata file"},
+		{name: "invalid json", data: `{"settings":`, err: "unexpected EOF"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dump"+indexMetaSuffix)
+			if err := os.WriteFile(path, []byte(c.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := LoadIndexMeta(path)
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(meta.IndexNames(), []string{"a"}) {
+				t.Errorf("got index names %v, want [a]", meta.IndexNames())
+			}
+		})
+	}
+
+	if _, err := LoadIndexMeta(filepath.Join(t.TempDir(), "missing"+indexMetaSuffix)); err == nil {
+		t.Error("got no error for missing file")
+	}
+}
@@ -19,13 +19,16 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/cheggaaa/pb"
 	"io"
 	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -36,6 +39,8 @@ type BulkOperation uint8
 const (
 	opIndex BulkOperation = iota
 	opDelete
+	// index only if the document doesn't exist, by --bulk_action=create
+	opCreate
 )
 
 func (op BulkOperation) String() string {
@@ -44,6 +49,8 @@ func (op BulkOperation) String() string {
 		return "opIndex"
 	case opDelete:
 		return "opDelete"
+	case opCreate:
+		return "opCreate"
 	default:
 		return fmt.Sprintf("unknown:%d", op)
 	}
@@ -62,6 +69,122 @@ func (m *Migrator) recoveryIndexSettings(sourceIndexRefreshSettings map[string]i
 	}
 }
 
+// copyIndexSettings create or update the target indexes with the settings and mappings of source indexes,
+// the refresh_interval of source indexes are returned, to be recovered after migration
+func (m *Migrator) copyIndexSettings(sourceIndexNames string, indexCount int, sourceIndexSettings *Indexes, sourceIndexMappings *Indexes) map[string]interface{} {
+	sourceIndexRefreshSettings := map[string]interface{}{}
+
+	m.renameIndexes(sourceIndexSettings)
+	m.renameIndexes(sourceIndexMappings)
+
+	//get target index settings
+	targetIndexSettings, err := m.TargetESAPI.GetIndexSettings(m.Config.TargetIndexName)
+	if err != nil {
+		//ignore target es settings error
+		log.Debug(err)
+	}
+	log.Debug("target IndexSettings", targetIndexSettings)
+
+	//if there is only one index and we specify the dest indexname
+	if _, ok := (*sourceIndexSettings)[sourceIndexNames]; ok && sourceIndexNames != m.Config.TargetIndexName && (len(m.Config.TargetIndexName) > 0) && indexCount == 1 {
+		log.Debugf("only one index,so we can rewrite indexname, src:%v, dest:%v ,indexCount:%d", sourceIndexNames, m.Config.TargetIndexName, indexCount)
+		(*sourceIndexSettings)[m.Config.TargetIndexName] = (*sourceIndexSettings)[sourceIndexNames]
+		delete(*sourceIndexSettings, sourceIndexNames)
+		log.Debug(sourceIndexSettings)
+	}
+
+	// dealing with indices settings
+	for name, idx := range *sourceIndexSettings {
+		log.Debug("dealing with index,name:", name, ",settings:", idx)
+		tempIndexSettings := getEmptyIndexSettings()
+
+		targetIndexExist := false
+		//if target index settings is exist and we don't copy settings, we use target settings
+		if targetIndexSettings != nil {
+			//if target es have this index and we dont copy index settings
+			if val, ok := (*targetIndexSettings)[name]; ok {
+				targetIndexExist = true
+				tempIndexSettings = val.(map[string]interface{})
+			}
+
+			if m.Config.RecreateIndex {
+				m.TargetESAPI.DeleteIndex(name)
+				targetIndexExist = false
+			}
+		}
+
+		//copy index settings
+		if m.Config.CopyIndexSettings {
+			tempIndexSettings = ((*sourceIndexSettings)[name]).(map[string]interface{})
+		}
+
+		//check map elements
+		if _, ok := tempIndexSettings["settings"]; !ok {
+			tempIndexSettings["settings"] = map[string]interface{}{}
+		}
+
+		if _, ok := tempIndexSettings["settings"].(map[string]interface{})["index"]; !ok {
+			tempIndexSettings["settings"].(map[string]interface{})["index"] = map[string]interface{}{}
+		}
+
+		sourceIndexRefreshSettings[name] = ((*sourceIndexSettings)[name].(map[string]interface{}))["settings"].(map[string]interface{})["index"].(map[string]interface{})["refresh_interval"]
+
+		//set refresh_interval
+		tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["refresh_interval"] = -1
+		tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_replicas"] = 0
+
+		//clean up settings
+		delete(tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{}), "number_of_shards")
+
+		//copy indexsettings and mappings
+		if targetIndexExist {
+			log.Debug("update index with settings,", name, tempIndexSettings)
+			//override shard settings
+			if m.Config.ShardsCount > 0 {
+				tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_shards"] = m.Config.ShardsCount
+			}
+			err := m.TargetESAPI.UpdateIndexSettings(name, tempIndexSettings)
+			if err != nil {
+				log.Error(err)
+			}
+		} else {
+
+			//override shard settings
+			if m.Config.ShardsCount > 0 {
+				tempIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_shards"] = m.Config.ShardsCount
+			}
+
+			log.Debug("create index with settings,", name, tempIndexSettings)
+			err := m.TargetESAPI.CreateIndex(name, tempIndexSettings)
+			if err != nil {
+				log.Error(err)
+			}
+
+		}
+
+	}
+
+	if m.Config.CopyIndexMappings {
+
+		//if there is only one index and we specify the dest indexname
+		if _, ok := (*sourceIndexMappings)[sourceIndexNames]; ok && sourceIndexNames != m.Config.TargetIndexName && (len(m.Config.TargetIndexName) > 0) && indexCount == 1 {
+			log.Debugf("only one index,so we can rewrite indexname, src:%v, dest:%v ,indexCount:%d", sourceIndexNames, m.Config.TargetIndexName, indexCount)
+			(*sourceIndexMappings)[m.Config.TargetIndexName] = (*sourceIndexMappings)[sourceIndexNames]
+			delete(*sourceIndexMappings, sourceIndexNames)
+			log.Debug(sourceIndexMappings)
+		}
+
+		for name, mapping := range *sourceIndexMappings {
+			err := m.TargetESAPI.UpdateIndexMapping(name, mapping.(map[string]interface{})["mappings"].(map[string]interface{}))
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	return sourceIndexRefreshSettings
+}
+
 func (m *Migrator) ClusterVersion(host string, auth *Auth, proxy string) (*ClusterVersion, []error) {
 
 	url := fmt.Sprintf("%s", host)
@@ -107,19 +230,49 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 	}
 
 	esInfo := "dest"
+	docVersion := ""
 	if isSource {
 		esInfo = "source"
+		if len(m.Config.VersionType) > 0 {
+			docVersion = m.Config.VersionFrom
+		}
+	}
+
+	if esVersion.IsOpenSearch() {
+		log.Infof("%s opensearch version: %s", esInfo, esVersion.Version.Number)
+		api := new(ESAPIOpenSearch)
+		api.Host = host
+		api.Compress = compress
+		api.Auth = auth
+		api.HttpProxy = proxy
+		api.Client = newHttpClient(proxy)
+		api.Version = esVersion
+		api.DocVersion = docVersion
+		return api
 	}
 
 	log.Infof("%s es version: %s", esInfo, esVersion.Version.Number)
-	if strings.HasPrefix(esVersion.Version.Number, "7.") {
+	if strings.HasPrefix(esVersion.Version.Number, "8.") {
+		log.Debug("es is V8,", esVersion.Version.Number)
+		api := new(ESAPIV8)
+		api.Host = host
+		api.Compress = compress
+		api.Auth = auth
+		api.HttpProxy = proxy
+		api.Client = newHttpClient(proxy)
+		api.Version = esVersion
+		api.DocVersion = docVersion
+		return api
+	} else if strings.HasPrefix(esVersion.Version.Number, "7.") {
 		log.Debug("es is V7,", esVersion.Version.Number)
 		api := new(ESAPIV7)
 		api.Host = host
 		api.Compress = compress
 		api.Auth = auth
 		api.HttpProxy = proxy
+		api.Client = newHttpClient(proxy)
 		api.Version = esVersion
+		api.DocVersion = docVersion
 		return api
 		//migrator.SourceESAPI = api
 	} else if strings.HasPrefix(esVersion.Version.Number, "6.") {
@@ -129,7 +282,9 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		api.Compress = compress
 		api.Auth = auth
 		api.HttpProxy = proxy
+		api.Client = newHttpClient(proxy)
 		api.Version = esVersion
+		api.DocVersion = docVersion
 		return api
 		//migrator.SourceESAPI = api
 	} else if strings.HasPrefix(esVersion.Version.Number, "5.") {
@@ -139,7 +294,9 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		api.Compress = compress
 		api.Auth = auth
 		api.HttpProxy = proxy
+		api.Client = newHttpClient(proxy)
 		api.Version = esVersion
+		api.DocVersion = docVersion
 		return api
 		//migrator.SourceESAPI = api
 	} else {
@@ -149,11 +306,57 @@ func (m *Migrator) ParseEsApi(isSource bool, host string, authStr string, proxy
 		api.Compress = compress
 		api.Auth = auth
 		api.HttpProxy = proxy
+		api.Client = newHttpClient(proxy)
 		api.Version = esVersion
+		api.DocVersion = docVersion
 		return api
 	}
 }
 
+// getDocType return the `_type` of a document, documents from 8.x have no type, `_doc` is used
+func getDocType(doc map[string]interface{}) string {
+	if docType, ok := doc["_type"].(string); ok && len(docType) > 0 {
+		return docType
+	}
+	return "_doc"
+}
+
+// isTypelessMapping check whether the cluster use mappings without type name,
+// opensearch was forked from 7.10, so all of its versions are typeless
+func isTypelessMapping(v *ClusterVersion) bool {
+	return v.IsOpenSearch() || v.MajorVersion() >= 7
+}
+
+// isMappingCompatible check whether the mappings of source can be applied to target,
+// typeless mappings of 7.x, 8.x and opensearch are interchangeable, the typed mappings of 6.x
+// are accepted by them after unwrapped, as 6.x has only one type
+func isMappingCompatible(src *ClusterVersion, dst *ClusterVersion) bool {
+	if isTypelessMapping(dst) && (isTypelessMapping(src) || src.MajorVersion() == 6) {
+		return true
+	}
+	if src.IsOpenSearch() || dst.IsOpenSearch() {
+		return false
+	}
+	return src.MajorVersion() == dst.MajorVersion()
+}
+
+// unwrapMappingType return the mapping inside the type name, for typeless targets, ie:
+// {"doc":{"properties":{}}} => {"properties":{}}
+func unwrapMappingType(mappings map[string]interface{}) map[string]interface{} {
+	if len(mappings) != 1 {
+		return mappings
+	}
+	for name, mapping := range mappings {
+		if m, ok := mapping.(map[string]interface{}); ok && name != "properties" {
+			if _, ok := m["properties"]; ok {
+				log.Debugf("unwrap mapping type: %s", name)
+				return m
+			}
+		}
+	}
+	return mappings
+}
+
 func (m *Migrator) ClusterReady(api ESAPI) (*ClusterHealth, bool) {
 	health := api.ClusterHealth()
 
@@ -184,6 +387,8 @@ func (m *Migrator) NewBulkWorker(docCount *int, pb *pb.ProgressBar, wg *sync.Wai
 	mainBuf := bytes.Buffer{}
 	docBuf := bytes.Buffer{}
 	docEnc := json.NewEncoder(&docBuf)
+	// sequence numbers of the documents in mainBuf, in order, acknowledged to checkpoint after bulk
+	bulkSeqs := make([]uint64, 0)
 
 	idleDuration := 5 * time.Second
 	idleTimeout := time.NewTimer(idleDuration)
@@ -210,20 +415,21 @@ READ_DOCS:
 			}
 
 			// sanity check
-			for _, key := range []string{"_index", "_type", "_source", "_id"} {
+			for _, key := range []string{"_index", "_source", "_id"} {
 				if _, ok := docI[key]; !ok {
 					break READ_DOCS
 				}
 			}
 
+			seq := takeCheckpointSeq(docI)
+			if !m.transformDoc(docI, seq) {
+				continue
+			}
+
 			var tempDestIndexName string
 			var tempTargetTypeName string
-			tempDestIndexName = docI["_index"].(string)
-			tempTargetTypeName = docI["_type"].(string)
-
-			if m.Config.TargetIndexName != "" {
-				tempDestIndexName = m.Config.TargetIndexName
-			}
+			tempDestIndexName = m.getTargetIndexName(docI["_index"].(string))
+			tempTargetTypeName = getDocType(docI)
 
 			if m.Config.OverrideTypeName != "" {
 				tempTargetTypeName = m.Config.OverrideTypeName
@@ -240,29 +446,7 @@ READ_DOCS:
 				doc.Id = ""
 			}
 
-			if m.Config.RenameFields != "" {
-				kvs := strings.Split(m.Config.RenameFields, ",")
-				for _, i := range kvs {
-					fvs := strings.Split(i, ":")
-					oldField := strings.TrimSpace(fvs[0])
-					newField := strings.TrimSpace(fvs[1])
-					if oldField == "_type" {
-						doc.source[newField] = docI["_type"].(string)
-					} else {
-						v := doc.source[oldField]
-						doc.source[newField] = v
-						delete(doc.source, oldField)
-					}
-				}
-			}
-
-			// add doc "_routing" if exists
-			if _, ok := docI["_routing"]; ok {
-				str, ok := docI["_routing"].(string)
-				if ok && str != "" {
-					doc.Routing = str
-				}
-			}
+			m.carryDocMeta(&doc, docI)
 
 			// if channel is closed flush and gtfo
 			if !open {
@@ -272,22 +456,28 @@ READ_DOCS:
 			// sanity check
 			if len(doc.Index) == 0 || len(doc.Type) == 0 {
 				log.Errorf("failed decoding document: %+v", doc)
+				original, _ := json.Marshal(docI)
+				m.rejectDoc(original, docI["_id"], seq, errors.New("no target index or type"))
 				continue
 			}
 
 			// encode the doc and and the _source field for a bulk request
 			post := map[string]Document{
-				"index": doc,
+				m.Config.BulkAction: doc,
 			}
-			if err = docEnc.Encode(post); err != nil {
-				log.Error(err)
+			if err = docEnc.Encode(post); err == nil {
+				err = docEnc.Encode(doc.source)
 			}
-			if err = docEnc.Encode(doc.source); err != nil {
-				log.Error(err)
+			if err != nil {
+				original, _ := json.Marshal(docI)
+				m.rejectDoc(original, docI["_id"], seq, err)
+				docBuf.Reset()
+				continue
 			}
 
 			// append the doc to the main buffer
 			mainBuf.Write(docBuf.Bytes())
+			bulkSeqs = append(bulkSeqs, seq)
 			// reset for next document
 			bulkItemSize++
 			(*docCount)++
@@ -309,7 +499,8 @@ READ_DOCS:
 		goto READ_DOCS
 
 	CLEAN_BUFFER:
-		m.TargetESAPI.Bulk(&mainBuf)
+		m.ackBulk(bulkSeqs, m.doBulk(m.TargetESAPI, &mainBuf))
+		bulkSeqs = bulkSeqs[:0]
 		log.Trace("clean buffer, and execute bulk insert")
 		pb.Add(bulkItemSize)
 		bulkItemSize = 0
@@ -322,254 +513,489 @@ WORKER_DONE:
 		mainBuf.Write(docBuf.Bytes())
 		bulkItemSize++
 	}
-	m.TargetESAPI.Bulk(&mainBuf)
+	m.ackBulk(bulkSeqs, m.doBulk(m.TargetESAPI, &mainBuf))
 	log.Trace("bulk insert")
 	pb.Add(bulkItemSize)
 	bulkItemSize = 0
 	wg.Done()
 }
 
-func (m *Migrator) bulkRecords(bulkOp BulkOperation, dstEsApi ESAPI, targetIndex string, targetType string, diffDocMaps map[string]interface{}) error {
-	//var err error
-	docCount := 0
-	bulkItemSize := 0
-	mainBuf := bytes.Buffer{}
-	docBuf := bytes.Buffer{}
-	docEnc := json.NewEncoder(&docBuf)
+// carryDocMeta copy the routing of hit to doc, and the version of source if --version_type is set,
+// the older ones are rejected by target
+func (m *Migrator) carryDocMeta(doc *Document, hit map[string]interface{}) {
+	if routing, ok := hit["_routing"].(string); ok && routing != "" {
+		doc.Routing = routing
+	}
+	if m.Config.VersionType != "" {
+		if v, ok := hit["_"+m.Config.VersionFrom]; ok {
+			doc.Version = v
+			doc.VersionType = m.Config.VersionType
+		}
+	}
+}
 
-	//var tempDestIndexName string
-	//var tempTargetTypeName string
+// bulkRecords write the hits into target index by _id, with their routing and version, the error of bulk
+// is returned, including the items failed
+func (m *Migrator) bulkRecords(bulkOp BulkOperation, dstEsApi ESAPI, targetIndex string, targetType string, hits map[string]map[string]interface{}) error {
+	// --diff only reports the differences, the target is never changed
+	if m.Config.DiffOnly {
+		return nil
+	}
 
-	for docId, docData := range diffDocMaps {
-		docI := docData.(map[string]interface{})
-		log.Debugf("now will bulk %s docId=%s, docData=%+v", bulkOp, docId, docData)
-		//tempDestIndexName = docI["_index"].(string)
-		//tempTargetTypeName = docI["_type"].(string)
-		var strOperation string
+	mainBuf := bytes.Buffer{}
+	docEnc := json.NewEncoder(&mainBuf)
+	for docId, hit := range hits {
+		log.Debugf("now will bulk %s docId=%s, hit=%+v", bulkOp, docId, hit)
 		doc := Document{
 			Index: targetIndex,
 			Type:  targetType,
-			Id:    docId, // docI["_id"].(string),
+			Id:    docId,
+		}
+		m.carryDocMeta(&doc, hit)
+		if bulkOp == opDelete {
+			// the version of target is not fetched, delete whatever it is
+			doc.Version = nil
+			doc.VersionType = ""
 		}
 
+		var strOperation string
 		switch bulkOp {
 		case opIndex:
-			doc.source = docI // docI["_source"].(map[string]interface{}),
 			strOperation = "index"
+		case opCreate:
+			strOperation = "create"
 		case opDelete:
 			strOperation = "delete"
-			//do nothing
 		}
 
 		// encode the doc and and the _source field for a bulk request
-
 		post := map[string]Document{
 			strOperation: doc,
 		}
-		_ = Verify(docEnc.Encode(post))
-		if bulkOp == opIndex {
-			_ = Verify(docEnc.Encode(doc.source))
+		if err := docEnc.Encode(post); err != nil {
+			return err
+		}
+		if bulkOp != opDelete {
+			if err := docEnc.Encode(hit["_source"]); err != nil {
+				return err
+			}
 		}
-		// append the doc to the main buffer
-		mainBuf.Write(docBuf.Bytes())
-		// reset for next document
-		bulkItemSize++
-		docCount++
-		docBuf.Reset()
 	}
 
-	if mainBuf.Len() > 0 {
-		_ = Verify(dstEsApi.Bulk(&mainBuf))
+	return m.doBulk(dstEsApi, &mainBuf)
+}
+
+// syncBulk is a batch of changes found by sync, to be bulked into target
+type syncBulk struct {
+	op      BulkOperation
+	docType string
+	docs    map[string]map[string]interface{}
+}
+
+// syncStats is the counts of all the slices of sync
+type syncStats struct {
+	src    int64
+	dst    int64
+	add    int64
+	update int64
+	delete int64
+}
+
+// syncTotals is the documents of the whole source and target index, not of a slice
+type syncTotals struct {
+	src int
+	dst int
+}
+
+// syncIndexes sync every target index with the source indexes copied into it, -x can be a comma separated
+// list or patterns, the target index is named by --rename_index rules, or -y, or the same as source
+func (m *Migrator) syncIndexes() error {
+	c := m.Config
+	indexNames, _, _, err := m.SourceESAPI.GetIndexMappings(c.CopyAllIndexes, c.SourceIndexNames)
+	if err != nil {
+		return err
+	}
+	targetNames, targets := m.groupByTargetIndex(indexNames)
+	if len(targetNames) == 0 {
+		return fmt.Errorf("no source index found: %s", c.SourceIndexNames)
+	}
+
+	total := &syncStats{}
+	failed := make([]string, 0)
+	for _, target := range targetNames {
+		sourceIndexes := strings.Join(targets[target], ",")
+		stats, err := m.SyncBetweenIndex(m.SourceESAPI, m.TargetESAPI, c, sourceIndexes, target)
+		if stats != nil {
+			total.src += stats.src
+			total.dst += stats.dst
+			total.add += stats.add
+			total.update += stats.update
+			total.delete += stats.delete
+		}
+		if err != nil {
+			log.Errorf("sync %s to %s failed: %v", sourceIndexes, target, err)
+			failed = append(failed, target)
+		}
+	}
+
+	if len(targetNames) > 1 {
+		action := "sync"
+		if c.DiffOnly {
+			action = "diff"
+		}
+		log.Infof("%s %d target indexes, source=%d, target=%d, add=%d, update=%d, delete=%d", action,
+			len(targetNames), total.src, total.dst, total.add, total.update, total.delete)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to sync %d of %d target indexes: %s", len(failed), len(targetNames), strings.Join(failed, ", "))
 	}
 	return nil
 }
 
-func (m *Migrator) SyncBetweenIndex(srcEsApi ESAPI, dstEsApi ESAPI, cfg *Config) {
-	// _id => value
-	srcDocMaps := make(map[string]interface{})
-	dstDocMaps := make(map[string]interface{})
-	diffDocMaps := make(map[string]interface{})
+// syncLookup find the documents by _id, which were not found at the same sort values of the other side,
+// the source documents are transformed, and the dropped ones are not found
+func (m *Migrator) syncLookup(api ESAPI, indexNames string, cfg *Config, docs map[string]map[string]interface{}, transform bool) (map[string]map[string]interface{}, error) {
+	found, err := lookupByIds(api, indexNames, cfg.ScrollTime, cfg.SearchQuery(), cfg.Fields, docs)
+	if err != nil || !transform {
+		return found, err
+	}
+	for id, doc := range found {
+		// not tracked by checkpoint or counted, it's only read to know whether it's in source
+		if keep, err := m.Pipeline.Apply(doc); err != nil || !keep {
+			delete(found, id)
+		}
+	}
+	return found, nil
+}
+
+// syncSortSpec return the --sort both sides of sync are read by, _id is dropped if any side is 8.x,
+// which disallows sorting by it, the documents with the same sort values are matched by _id then
+func syncSortSpec(srcEsApi ESAPI, dstEsApi ESAPI, sort string) (SortSpec, error) {
+	spec := sortSpecOf(sort)
+	for _, api := range []ESAPI{srcEsApi, dstEsApi} {
+		if version := api.ClusterVersion(); !version.IsOpenSearch() && version.MajorVersion() >= 8 && spec.Has("_id") {
+			log.Debug("sort by _id is not allowed in 8.x, drop it from the sort of sync")
+			spec = spec.Without("_id")
+		}
+	}
+	if spec.Has("_doc") || spec.Has("_score") {
+		return nil, errors.New("--sync can't sort by _doc or _score, which are different between source and target, set --sort to fields of documents")
+	}
+	if len(spec) == 0 {
+		return nil, errors.New("--sync need --sort on fields of documents, sort by _id is not allowed in 8.x, ie: --sort=@timestamp")
+	}
+	return spec, nil
+}
 
-	srcRecordIndex := 0
-	dstRecordIndex := 0
-	var err error
-	srcType := ""
-	var srcScroll ScrollAPI = nil
-	var dstScroll ScrollAPI = nil
-	var emptyScroll = &EmptyScroll{}
-	lastSrcId := ""
-	lastDestId := ""
-	needScrollSrc := true
-	needScrollDest := true
-
-	addCount := 0
-	updateCount := 0
-	deleteCount := 0
-
-	//TODO: 进度计算,分为 [ scroll src/dst + index ] => delete 几个部分
-	srcBar := pb.New(1).Prefix("Progress")
-	//srcBar := pb.New(1).Prefix("Source")
-	//dstBar := pb.New(100).Prefix("Dest")
-	//pool, err := pb.StartPool(srcBar, dstBar)
+// SyncBetweenIndex walk the source and target index sorted by the same --sort together, and apply the
+// differences to target(index/update/delete), the documents with the same sort values are matched by _id.
+// With --sliced_scroll_size, both sides are read by sliced scroll, the slices are compared concurrently, and
+// the changes are bulked by --workers. Only the current scroll pages, the documents with the same sort values
+// and the batches of changes to bulk are held in memory. Unless sorted by _id only without slices, the documents
+// found on one side only are looked up by _id on the other side, so a document with changed sort values, or in
+// different slices of two sides, is an update
+func (m *Migrator) SyncBetweenIndex(srcEsApi ESAPI, dstEsApi ESAPI, cfg *Config, sourceIndexes string, targetIndex string) (*syncStats, error) {
+	spec, err := syncSortSpec(srcEsApi, dstEsApi, cfg.SortField)
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		if srcScroll == nil {
-			srcScroll, err = srcEsApi.NewScroll(cfg.SourceIndexNames, cfg.ScrollTime, cfg.DocBufferCount, cfg.Query,
-				cfg.SortField, 0, cfg.ScrollSliceSize, cfg.Fields)
-			if err != nil {
-				log.Infof("can not scroll for source index: %s, reason:%s", cfg.SourceIndexNames, err.Error())
-				return
+	slices := cfg.ScrollSliceSize
+	if slices < 1 {
+		slices = 1
+	}
+	if slices > 1 {
+		for _, api := range []ESAPI{srcEsApi, dstEsApi} {
+			if version := api.ClusterVersion(); !version.IsOpenSearch() && version.MajorVersion() < 5 {
+				return nil, errors.New("sliced scroll is only supported since elasticsearch 5.0, set --sliced_scroll_size=1 to sync")
 			}
-			log.Infof("src total count=%d", srcScroll.GetHitsTotal())
-			srcBar.Total = int64(srcScroll.GetHitsTotal())
-			srcBar.Start()
-		} else if needScrollSrc {
-			srcScroll = VerifyWithResult(srcEsApi.NextScroll(cfg.ScrollTime, srcScroll.GetScrollId())).(ScrollAPI)
 		}
+	}
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
 
-		if dstScroll == nil {
-			dstScroll, err = dstEsApi.NewScroll(cfg.TargetIndexName, cfg.ScrollTime, cfg.DocBufferCount, cfg.Query,
-				cfg.SortField, 0, cfg.ScrollSliceSize, cfg.Fields)
-			if err != nil {
-				log.Infof("can not scroll for dest index: %s, reason:%s", cfg.TargetIndexName, err.Error())
-				//生成一个 empty 的, 相当于直接bulk?
-				dstScroll = emptyScroll
+	// unless sorted by _id only, a document changed in source may be found at different sort values of
+	// two sides, and sliced scroll depends on the shards, a document may be in different slices of two
+	// sides, the documents found on one side only are looked up by _id on the other side, unless the whole
+	// index of that side is empty, as a slice of it may be empty while the others have the documents
+	lookup := slices > 1 || len(spec) != 1 || spec[0].Field != "_id"
+	totals := syncTotals{}
+	if lookup {
+		totals.src, err = srcEsApi.Count(sourceIndexes, cfg.SearchQuery())
+		if err != nil {
+			return nil, fmt.Errorf("can not count source index: %s, reason:%v", sourceIndexes, err)
+		}
+		totals.dst, err = dstEsApi.Count(targetIndex, cfg.SearchQuery())
+		if err != nil {
+			log.Infof("can not count dest index: %s, reason:%v", targetIndex, err)
+			totals.dst = 0
+		}
+	}
 
-				//没有 dest index,以 src 的条数作为总数
-				//dstBar.Total = int64(srcScroll.GetHitsTotal()) // = pb.New(srcScroll.GetHitsTotal()).Prefix("Dest")
-			} else {
-				//有 dest index,
-				//dstBar.Total = int64(dstScroll.GetHitsTotal()) // pb.New(dstScroll.GetHitsTotal()).Prefix("Dest")
-			}
-			//dstBar.Start()
-			log.Infof("dst total count=%d", dstScroll.GetHitsTotal())
-		} else if needScrollDest {
-			dstScroll = VerifyWithResult(dstEsApi.NextScroll(cfg.ScrollTime, dstScroll.GetScrollId())).(ScrollAPI)
-		}
-
-		//从目标 index 中查询,并放入 destMap, 如果没有则是空
-		if needScrollDest {
-			for idx, dstDocI := range dstScroll.GetDocs() {
-				destId := dstDocI.(map[string]interface{})["_id"].(string)
-				dstSource := dstDocI.(map[string]interface{})["_source"]
-				lastDestId = destId
-				log.Debugf("dst [%d]: dstId=%s", dstRecordIndex+idx, destId)
-
-				if srcSource, found := srcDocMaps[destId]; found {
-					delete(srcDocMaps, destId)
-
-					//如果从 src 的 map 中找到匹配地项
-					if !reflect.DeepEqual(srcSource, dstSource) {
-						//不相等, 则需要更新
-						diffDocMaps[destId] = srcSource
-						updateCount++
-					} else {
-						//完全相等, 则不需要处理
-					}
-				} else {
-					dstDocMaps[destId] = dstSource
+	stats := &syncStats{}
+	srcBar := pb.New(0).Prefix(m.barPrefix("Progress"))
+	if m.DiffReport.IsStdout() {
+		srcBar.Output = os.Stderr
+	}
+	srcBar.Start()
+
+	// the first error of bulk, the others are logged
+	var bulkErr error
+	bulkErrOnce := sync.Once{}
+	bulkChan := make(chan syncBulk, workers)
+	bulkWg := sync.WaitGroup{}
+	bulkWg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer bulkWg.Done()
+			for bulk := range bulkChan {
+				log.Debugf("now will bulk %s %d records", bulk.op, len(bulk.docs))
+				if err := m.bulkRecords(bulk.op, dstEsApi, targetIndex, bulk.docType, bulk.docs); err != nil {
+					log.Error(err)
+					bulkErrOnce.Do(func() {
+						bulkErr = fmt.Errorf("failed to bulk the changes into %s: %v", targetIndex, err)
+					})
 				}
-				//dstBar.Increment()
-			}
-			dstRecordIndex += len(dstScroll.GetDocs())
-		}
-
-		//先将 src 的当前批次查出并放入 map
-		if needScrollSrc {
-			for idx, srcDocI := range srcScroll.GetDocs() {
-				srcId := srcDocI.(map[string]interface{})["_id"].(string)
-				srcSource := srcDocI.(map[string]interface{})["_source"]
-				srcType = srcDocI.(map[string]interface{})["_type"].(string)
-				lastSrcId = srcId
-				log.Debugf("src [%d]: srcId=%s", srcRecordIndex+idx, srcId)
-
-				if len(lastDestId) == 0 {
-					//没有 destId, 表示 目标 index 中没有数据, 直接全部更新
-					diffDocMaps[srcId] = srcSource
-					addCount++
-				} else if dstSource, ok := dstDocMaps[srcId]; ok { //能从 dstDocMaps 中找到相同ID的数据
-					if !reflect.DeepEqual(srcSource, dstSource) {
-						//不完全相同,需要更新,否则忽略
-						diffDocMaps[srcId] = srcSource
-						updateCount++
-					}
-					//从 dst 中删除相同的
-					delete(dstDocMaps, srcId)
-				} else {
-					//找不到相同的 id, 可能是 dst 还没找到, 或者 dst 中不存在
-					if srcId < lastDestId {
-						//dest 已经超过当前的 srcId, 表示 dst 中不存在
-						diffDocMaps[srcId] = srcSource
-						addCount++
-					} else {
-						srcDocMaps[srcId] = srcSource
-					}
+				if !cfg.DiffOnly && cfg.SleepSecondsAfterEachBulk > 0 {
+					time.Sleep(time.Duration(cfg.SleepSecondsAfterEachBulk) * time.Second)
 				}
-				srcBar.Increment()
 			}
-			srcRecordIndex += len(srcScroll.GetDocs())
-		}
-
-		if len(diffDocMaps) > 0 {
-			log.Debugf("now will bulk index %d records", len(diffDocMaps))
-			_ = Verify(m.bulkRecords(opIndex, dstEsApi, cfg.TargetIndexName, srcType, diffDocMaps))
-			diffDocMaps = make(map[string]interface{})
-		}
-
-		if lastSrcId == lastDestId {
-			needScrollSrc = true
-			needScrollDest = true
-		} else if len(lastDestId) == 0 || (lastSrcId < lastDestId || (needScrollDest == true && len(dstScroll.GetDocs()) == 0)) {
-			//上一次要求遍历 dest,但遍历出空
-			needScrollSrc = true
-			needScrollDest = false
-		} else if lastSrcId > lastDestId || (needScrollSrc == true && len(srcScroll.GetDocs()) == 0) {
-			//上一次要求遍历 src, 但遍历出空
-			needScrollSrc = false
-			needScrollDest = true
-		} else {
-			panic("TODO:")
+		}()
+	}
+
+	errs := make([]error, slices)
+	sliceWg := sync.WaitGroup{}
+	sliceWg.Add(slices)
+	for slice := 0; slice < slices; slice++ {
+		go func(slice int) {
+			defer sliceWg.Done()
+			errs[slice] = m.syncSlice(srcEsApi, dstEsApi, cfg, spec, sourceIndexes, targetIndex, slice, slices, lookup, totals, bulkChan, stats, srcBar)
+			if errs[slice] != nil && slices > 1 {
+				errs[slice] = fmt.Errorf("slice %d: %v", slice, errs[slice])
+			}
+		}(slice)
+	}
+	sliceWg.Wait()
+	close(bulkChan)
+	bulkWg.Wait()
+	srcBar.FinishPrint("Source End")
+
+	for _, err := range errs {
+		if err != nil {
+			return stats, err
 		}
+	}
+	if bulkErr != nil {
+		return stats, bulkErr
+	}
+
+	action := "sync"
+	if cfg.DiffOnly {
+		action = "diff"
+	}
+	log.Infof("%s %s(%d) to %s(%d), add=%d, update=%d, delete=%d", action,
+		sourceIndexes, stats.src, targetIndex, stats.dst,
+		stats.add, stats.update, stats.delete)
+	return stats, nil
+}
 
-		//如果 src 和 dst 都遍历完毕, 才退出
-		log.Debugf("lastSrcId=%s, lastDestId=%s, "+
-			"needScrollSrc=%t, len(srcScroll.GetDocs()=%d, "+
-			"needScrollDest=%t, len(dstScroll.GetDocs())=%d",
-			lastSrcId, lastDestId,
-			needScrollSrc, len(srcScroll.GetDocs()),
-			needScrollDest, len(dstScroll.GetDocs()))
+// syncSlice compare one slice of source and target, the changes are sent to bulkChan
+func (m *Migrator) syncSlice(srcEsApi ESAPI, dstEsApi ESAPI, cfg *Config, spec SortSpec, sourceIndexes string, targetIndex string,
+	slice int, slices int, lookup bool, totals syncTotals, bulkChan chan syncBulk, stats *syncStats, bar *pb.ProgressBar) (err error) {
+	srcType := ""
+	// _id => hit, bulked once there are enough of them
+	indexDocMaps := make(map[string]map[string]interface{})
+	deleteDocMaps := make(map[string]map[string]interface{})
+
+	src, err := newSlicedDocStream(srcEsApi, sourceIndexes, cfg.ScrollTime, cfg.DocBufferCount, cfg.SearchQuery(), nil,
+		spec.String(), slice, slices, cfg.Fields)
+	if err != nil {
+		return fmt.Errorf("can not scroll for source index: %s, reason:%s", sourceIndexes, err.Error())
+	}
+	defer src.Close()
+	log.Infof("src total count=%d", src.Total())
+	atomic.AddInt64(&bar.Total, int64(src.Total()))
+
+	dst, err := newSlicedDocStream(dstEsApi, targetIndex, cfg.ScrollTime, cfg.DocBufferCount, cfg.SearchQuery(), nil,
+		spec.String(), slice, slices, cfg.Fields)
+	if err != nil {
+		//没有 dest index, 相当于直接bulk
+		log.Infof("can not scroll for dest index: %s, reason:%s", targetIndex, err.Error())
+		dst = emptyDocStream(dstEsApi)
+	}
+	defer dst.Close()
+	log.Infof("dst total count=%d", dst.Total())
 
-		if (!needScrollSrc || (len(srcScroll.GetDocs()) == 0 || len(srcScroll.GetDocs()) < cfg.DocBufferCount)) &&
-			(!needScrollDest || (len(dstScroll.GetDocs()) == 0 || len(dstScroll.GetDocs()) < cfg.DocBufferCount)) {
-			log.Debugf("can not find more, will quit, and index %d, delete %d", len(srcDocMaps), len(dstDocMaps))
+	// the documents found on one side only are looked up by _id on the other side, in batches
+	srcOrphans := make(map[string]map[string]interface{})
+	dstOrphans := make(map[string]map[string]interface{})
 
-			if len(srcDocMaps) > 0 {
-				addCount += len(srcDocMaps)
-				_ = Verify(m.bulkRecords(opIndex, dstEsApi, cfg.TargetIndexName, srcType, srcDocMaps))
+	flush := func(force bool) {
+		if len(indexDocMaps) > 0 && (force || len(indexDocMaps) >= cfg.DocBufferCount) {
+			bulkChan <- syncBulk{op: opIndex, docType: srcType, docs: indexDocMaps}
+			indexDocMaps = make(map[string]map[string]interface{})
+		}
+		if len(deleteDocMaps) > 0 && (force || len(deleteDocMaps) >= cfg.DocBufferCount) {
+			bulkChan <- syncBulk{op: opDelete, docType: srcType, docs: deleteDocMaps}
+			deleteDocMaps = make(map[string]map[string]interface{})
+		}
+	}
+
+	add := func(id string, srcDoc map[string]interface{}) {
+		//dst 中不存在, 需要添加
+		srcType = getDocType(srcDoc)
+		indexDocMaps[id] = srcDoc
+		atomic.AddInt64(&stats.add, 1)
+		m.DiffReport.Add(targetIndex, "add", id, srcDoc["_source"], nil)
+	}
+	remove := func(id string, dstDoc map[string]interface{}) {
+		//dst 中多的, 需要删除
+		deleteDocMaps[id] = dstDoc
+		atomic.AddInt64(&stats.delete, 1)
+		m.DiffReport.Add(targetIndex, "delete", id, nil, dstDoc["_source"])
+	}
+	update := func(id string, srcDoc map[string]interface{}, dstDoc map[string]interface{}) {
+		if reflect.DeepEqual(srcDoc["_source"], dstDoc["_source"]) {
+			return
+		}
+		//不相等, 则需要更新
+		srcType = getDocType(srcDoc)
+		indexDocMaps[id] = srcDoc
+		atomic.AddInt64(&stats.update, 1)
+		m.DiffReport.Add(targetIndex, "update", id, srcDoc["_source"], dstDoc["_source"])
+	}
+
+	// the source documents not found at the same sort values are updates if target has them elsewhere
+	resolveSrcOrphans := func() error {
+		if len(srcOrphans) == 0 {
+			return nil
+		}
+		found, err := m.syncLookup(dstEsApi, targetIndex, cfg, srcOrphans, false)
+		if err != nil {
+			return err
+		}
+		for id, srcDoc := range srcOrphans {
+			if dstDoc, ok := found[id]; ok {
+				update(id, srcDoc, dstDoc)
+			} else {
+				add(id, srcDoc)
 			}
-			if len(dstDocMaps) > 0 {
-				//最后在 dst 中还有遗留的,表示 dst 中多的.需要删除
-				deleteCount += len(dstDocMaps)
-				_ = Verify(m.bulkRecords(opDelete, dstEsApi, cfg.TargetIndexName, srcType, dstDocMaps))
+		}
+		srcOrphans = make(map[string]map[string]interface{})
+		flush(false)
+		return nil
+	}
+	// the target documents not found at the same sort values are deleted, unless source has them elsewhere,
+	// which are updated by the source side
+	resolveDstOrphans := func() error {
+		if len(dstOrphans) == 0 {
+			return nil
+		}
+		found, err := m.syncLookup(srcEsApi, sourceIndexes, cfg, dstOrphans, true)
+		if err != nil {
+			return err
+		}
+		for id, dstDoc := range dstOrphans {
+			if _, ok := found[id]; ok {
+				log.Tracef("document %s was found at different sort values of source and target", id)
+			} else {
+				remove(id, dstDoc)
 			}
-			break
 		}
+		dstOrphans = make(map[string]map[string]interface{})
+		flush(false)
+		return nil
+	}
 
-		//目标不存在 或 src 还没有查询到和 dest 一样的地方
-		if cfg.SleepSecondsAfterEachBulk > 0 {
-			time.Sleep(time.Duration(cfg.SleepSecondsAfterEachBulk) * time.Second)
+	apply := func(id string, srcDoc map[string]interface{}, dstDoc map[string]interface{}) error {
+		// target is compared with the transformed source, the dropped ones are not in source
+		if srcDoc != nil && !m.transformDoc(srcDoc, 0) {
+			srcDoc = nil
+			if dstDoc == nil {
+				return nil
+			}
+		}
+		switch {
+		case dstDoc == nil && lookup && totals.dst > 0:
+			srcOrphans[id] = srcDoc
+			if len(srcOrphans) >= cfg.DocBufferCount {
+				return resolveSrcOrphans()
+			}
+		case dstDoc == nil:
+			add(id, srcDoc)
+		case srcDoc == nil && lookup && totals.src > 0:
+			dstOrphans[id] = dstDoc
+			if len(dstOrphans) >= cfg.DocBufferCount {
+				return resolveDstOrphans()
+			}
+		case srcDoc == nil:
+			remove(id, dstDoc)
+		default:
+			update(id, srcDoc, dstDoc)
 		}
+		flush(false)
+		return nil
 	}
-	_ = Verify(srcEsApi.DeleteScroll(srcScroll.GetScrollId()))
-	_ = Verify(dstEsApi.DeleteScroll(dstScroll.GetScrollId()))
 
-	srcBar.FinishPrint("Source End")
-	//dstBar.FinishPrint("Dest End")
-	//pool.Stop()
+	// flush the changes found so far, even if it failed, but the documents found on one side only
+	// are not sure to be added or deleted
+	defer func() {
+		if err == nil {
+			if err = resolveSrcOrphans(); err == nil {
+				err = resolveDstOrphans()
+			}
+		}
+		flush(true)
+		atomic.AddInt64(&stats.src, int64(src.count))
+		atomic.AddInt64(&stats.dst, int64(dst.count))
+	}()
 
-        log.Infof("sync %s(%d) to %s(%d), add=%d, update=%d, delete=%d",
-                cfg.SourceIndexNames, srcRecordIndex, cfg.TargetIndexName, dstRecordIndex,
-                addCount, updateCount, deleteCount)
+	for {
+		srcDoc, err := src.Peek()
+		if err != nil {
+			return err
+		}
+		dstDoc, err := dst.Peek()
+		if err != nil {
+			return err
+		}
+		if srcDoc == nil && dstDoc == nil {
+			return nil
+		}
 
-	//log.Infof("diffDocMaps=%+v", diffDocMaps)
+		// the smaller key of two sides goes first
+		var key []interface{}
+		switch {
+		case dstDoc == nil:
+			key = syncKey(srcDoc)
+		case srcDoc == nil:
+			key = syncKey(dstDoc)
+		default:
+			key = syncKey(srcDoc)
+			if dstKey := syncKey(dstDoc); compareSortValues(spec, dstKey, key) < 0 {
+				key = dstKey
+			}
+		}
+		log.Tracef("sync key=%v", key)
+
+		srcCount := src.count
+		srcGroup, err := readSyncGroup(src, spec, key, cfg.SyncBufferCount, cfg.SyncSpillDir)
+		if err != nil {
+			return err
+		}
+		dstGroup, err := readSyncGroup(dst, spec, key, cfg.SyncBufferCount, cfg.SyncSpillDir)
+		if err != nil {
+			srcGroup.Close()
+			return err
+		}
+		err = joinSyncGroups(srcGroup, dstGroup, apply)
+		srcGroup.Close()
+		dstGroup.Close()
+		if err != nil {
+			return err
+		}
+		bar.Add(src.count - srcCount)
+	}
 }
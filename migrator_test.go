@@ -0,0 +1,447 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/cheggaaa/pb"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSearchES answer the searches of sync from documents in memory, sorted by the sort of request,
+// and filtered by the ids query, the slices of sliced scroll depend on shards like elasticsearch
+type fakeSearchES struct {
+	ESAPI
+	version string
+	docs    []string
+	shards  int
+
+	lock    sync.Mutex
+	scrolls map[string][]interface{}
+	lookups int
+}
+
+func (f *fakeSearchES) ClusterVersion() *ClusterVersion {
+	v := &ClusterVersion{}
+	v.Version.Number = f.version
+	return v
+}
+
+func (f *fakeSearchES) page(id string, docs []interface{}, size int) ScrollAPI {
+	scroll := &Scroll{}
+	if len(docs) > size {
+		f.scrolls[id] = docs[size:]
+		docs = docs[:size]
+		scroll.ScrollId = id
+	} else {
+		delete(f.scrolls, id)
+	}
+	scroll.Hits.Docs = docs
+	return scroll
+}
+
+func (f *fakeSearchES) NewScroll(indexNames string, scrollTime string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+	sortFields string, slicedId int, maxSlicedCount int, fields string) (ScrollAPI, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.docs == nil {
+		return nil, fmt.Errorf("index %s not found", indexNames)
+	}
+
+	ids := map[string]bool{}
+	if filter != nil {
+		if q, ok := filter["ids"]; ok {
+			f.lookups++
+			for _, id := range q.(map[string]interface{})["values"].([]interface{}) {
+				ids[id.(string)] = true
+			}
+		}
+	}
+
+	spec := sortSpecOf(sortFields)
+	docs := make([]interface{}, 0, len(f.docs))
+	for _, s := range f.docs {
+		doc := map[string]interface{}{}
+		if err := DecodeJsonBytes([]byte(s), &doc); err != nil {
+			return nil, err
+		}
+		if len(ids) > 0 && !ids[syncId(doc)] {
+			continue
+		}
+		if maxSlicedCount > 1 {
+			hash := fnv.New32a()
+			hash.Write([]byte(syncId(doc)))
+			if int(hash.Sum32()%uint32(f.shards+1))%maxSlicedCount != slicedId {
+				continue
+			}
+		}
+		values := []interface{}{}
+		for _, key := range spec {
+			if key.Field == "_id" {
+				values = append(values, doc["_id"])
+			} else {
+				values = append(values, doc["_source"].(map[string]interface{})[key.Field])
+			}
+		}
+		if len(spec) > 0 {
+			doc["sort"] = values
+		}
+		docs = append(docs, doc)
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return compareSortValues(spec, syncKey(docs[i].(map[string]interface{})), syncKey(docs[j].(map[string]interface{}))) < 0
+	})
+
+	if f.scrolls == nil {
+		f.scrolls = map[string][]interface{}{}
+	}
+	id := fmt.Sprintf("scroll-%d", len(f.scrolls)+f.lookups+len(docs))
+	for f.scrolls[id] != nil {
+		id += "x"
+	}
+	scroll := f.page(id, docs, docBufferCount)
+	scroll.(*Scroll).Hits.Total = len(docs)
+	return scroll, nil
+}
+
+func (f *fakeSearchES) NextScroll(scrollTime string, scrollId string) (ScrollAPI, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.page(scrollId, f.scrolls[scrollId], 2), nil
+}
+
+func (f *fakeSearchES) DeleteScroll(scrollId string) error {
+	return nil
+}
+
+func (f *fakeSearchES) Count(indexNames string, query SearchQuery) (int, error) {
+	if f.docs == nil {
+		return 0, fmt.Errorf("index %s not found", indexNames)
+	}
+	return len(f.docs), nil
+}
+
+func TestSyncBetweenIndex(t *testing.T) {
+	srcDocs := []string{
+		`{"_id":"a","_index":"src","_source":{"ts":1,"v":"a"}}`,
+		`{"_id":"b","_index":"src","_source":{"ts":5,"v":"b2"}}`,
+		`{"_id":"c","_index":"src","_source":{"ts":3,"v":"c"}}`,
+		`{"_id":"d","_index":"src","_source":{"ts":3,"v":"d"}}`,
+		`{"_id":"e","_index":"src","_source":{"ts":0,"v":"e"}}`,
+		`{"_id":"f","_index":"src","_source":{"v":"f"}}`,
+		`{"_id":"big","_index":"src","_source":{"ts":9007199254740993,"v":"x"}}`,
+	}
+	dstDocs := []string{
+		`{"_id":"a","_index":"dst","_source":{"ts":1,"v":"a"}}`,
+		// the sort values are changed
+		`{"_id":"b","_index":"dst","_source":{"ts":2,"v":"b"}}`,
+		`{"_id":"c","_index":"dst","_source":{"ts":3,"v":"c"}}`,
+		`{"_id":"e","_index":"dst","_source":{"ts":9,"v":"e"}}`,
+		`{"_id":"g","_index":"dst","_source":{"ts":4,"v":"g"}}`,
+		`{"_id":"f","_index":"dst","_source":{"v":"f"}}`,
+		`{"_id":"big","_index":"dst","_source":{"ts":9007199254740992,"v":"x"}}`,
+	}
+	wantStats := syncStats{src: 7, dst: 7, add: 1, update: 3, delete: 1}
+	wantReport := []string{"add d", "delete g", "update b", "update big", "update e"}
+
+	cases := []struct {
+		name       string
+		sort       string
+		srcVersion string
+		dstVersion string
+		dstDocs    []string
+		stats      syncStats
+		report     []string
+		slices     int
+		lookups    bool
+		err        string
+	}{
+		{name: "sorted by _id", sort: "_id", srcVersion: "7.10.0", dstVersion: "7.10.0"},
+		{name: "sorted by timestamp desc", sort: "ts:desc,_id", srcVersion: "7.10.0", dstVersion: "7.10.0", lookups: true},
+		{name: "sorted by timestamp", sort: "ts", srcVersion: "7.10.0", dstVersion: "7.10.0", lookups: true},
+		{name: "_id dropped for 8.x", sort: "ts,_id:desc", srcVersion: "8.1.0", dstVersion: "7.10.0", lookups: true},
+		{name: "empty target", sort: "ts", srcVersion: "7.10.0", dstVersion: "7.10.0", dstDocs: []string{},
+			stats:  syncStats{src: 7, add: 7},
+			report: []string{"add a", "add b", "add big", "add c", "add d", "add e", "add f"}},
+		{name: "sliced by _id", sort: "_id", srcVersion: "7.10.0", dstVersion: "7.10.0", slices: 3, lookups: true},
+		{name: "sliced by timestamp", sort: "ts", srcVersion: "8.1.0", dstVersion: "8.1.0", slices: 2, lookups: true},
+		// some slices of source are empty, as it has less shards, the target documents in them are found in other slices
+		{name: "empty slices", sort: "_id", srcVersion: "7.10.0", dstVersion: "7.10.0", slices: 8, lookups: true},
+		{name: "empty slices of empty target", sort: "ts", srcVersion: "7.10.0", dstVersion: "7.10.0", dstDocs: []string{}, slices: 8,
+			stats:  syncStats{src: 7, add: 7},
+			report: []string{"add a", "add b", "add big", "add c", "add d", "add e", "add f"}},
+		{name: "sliced before 5.0", sort: "_id", srcVersion: "2.4.6", dstVersion: "7.10.0", slices: 2, err: "sliced scroll is only supported since elasticsearch 5.0"},
+		{name: "only _id for 8.x", sort: "_id", srcVersion: "8.1.0", dstVersion: "7.10.0", err: "sort by _id is not allowed in 8.x"},
+		{name: "_doc", sort: "_doc", srcVersion: "7.10.0", dstVersion: "7.10.0", err: "can't sort by _doc or _score"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// the shards of two sides are different
+			src := &fakeSearchES{version: c.srcVersion, docs: srcDocs, shards: 3}
+			dst := &fakeSearchES{version: c.dstVersion, docs: dstDocs, shards: 5}
+			if c.dstDocs != nil {
+				dst.docs = c.dstDocs
+			}
+			if c.report == nil {
+				c.stats, c.report = wantStats, wantReport
+			}
+
+			cfg := &Config{SortField: c.sort, DocBufferCount: 2, SyncBufferCount: 10, DiffOnly: true, Workers: 2, ScrollSliceSize: c.slices}
+			m := &Migrator{Config: cfg}
+			path := filepath.Join(t.TempDir(), "diff.json")
+			report, err := NewDiffReport(path, "ndjson", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.DiffReport = report
+
+			stats, err := m.SyncBetweenIndex(src, dst, cfg, "src", "dst")
+			report.Close()
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *stats != c.stats {
+				t.Errorf("got stats %+v, want %+v", *stats, c.stats)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				entry := DiffEntry{}
+				if err := DecodeJson(line, &entry); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, entry.Op+" "+entry.Id)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, c.report) {
+				t.Errorf("got report %v, want %v", got, c.report)
+			}
+			if lookups := src.lookups + dst.lookups; (lookups > 0) != c.lookups {
+				t.Errorf("looked up documents %d times", lookups)
+			}
+		})
+	}
+}
+
+func TestIsMappingCompatible(t *testing.T) {
+	version := func(number string, distribution string) *ClusterVersion {
+		v := &ClusterVersion{}
+		v.Version.Number = number
+		v.Version.Distribution = distribution
+		return v
+	}
+
+	cases := []struct {
+		name string
+		src  *ClusterVersion
+		dst  *ClusterVersion
+		want bool
+	}{
+		{"same major", version("6.8.0", ""), version("6.2.0", ""), true},
+		{"7.x to 8.x", version("7.10.0", ""), version("8.1.0", ""), true},
+		{"7.x to opensearch", version("7.10.0", ""), version("2.11.0", "opensearch"), true},
+		{"opensearch to opensearch", version("1.3.0", "opensearch"), version("2.11.0", "opensearch"), true},
+		{"6.x to 7.x", version("6.8.0", ""), version("7.10.0", ""), true},
+		{"6.x to opensearch", version("6.8.0", ""), version("2.11.0", "opensearch"), true},
+		{"5.x to opensearch", version("5.6.0", ""), version("2.11.0", "opensearch"), false},
+		{"5.x to 6.x", version("5.6.0", ""), version("6.8.0", ""), false},
+		{"opensearch to 6.x", version("2.11.0", "opensearch"), version("6.8.0", ""), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isMappingCompatible(c.src, c.dst); got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestUnwrapMappingType(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"typed", `{"doc":{"properties":{"a":{"type":"keyword"}}}}`, `{"properties":{"a":{"type":"keyword"}}}`},
+		{"typeless", `{"properties":{"a":{"type":"keyword"}}}`, `{"properties":{"a":{"type":"keyword"}}}`},
+		{"typeless with settings", `{"dynamic":"strict","properties":{}}`, `{"dynamic":"strict","properties":{}}`},
+		{"type without properties", `{"doc":{"dynamic":"strict"}}`, `{"doc":{"dynamic":"strict"}}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mappings := map[string]interface{}{}
+			if err := DecodeJson(c.in, &mappings); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{}
+			if err := DecodeJson(c.want, &want); err != nil {
+				t.Fatal(err)
+			}
+			if got := unwrapMappingType(mappings); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBulkWorkerActions(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"_index": "src", "_type": "_doc", "_id": "a", "_routing": "r1", "_version": 3, "_seq_no": 11, "_source": map[string]interface{}{"v": 1}},
+		{"_index": "src", "_type": "_doc", "_id": "b", "_version": 1, "_seq_no": 12, "_source": map[string]interface{}{"v": 2}},
+	}
+
+	cases := []struct {
+		name        string
+		action      string
+		versionType string
+		versionFrom string
+		statuses    map[string][]int
+		actions     []string
+		conflicts   int64
+	}{
+		{
+			name:    "index",
+			action:  "index",
+			actions: []string{`{"index":{"_index":"dst","_type":"_doc","_id":"a","routing":"r1"}}`, `{"index":{"_index":"dst","_type":"_doc","_id":"b"}}`},
+		},
+		{
+			// the existing documents are skipped by target, counted as conflicts
+			name:      "create",
+			action:    "create",
+			statuses:  map[string][]int{"b": {409}},
+			actions:   []string{`{"create":{"_index":"dst","_type":"_doc","_id":"a","routing":"r1"}}`, `{"create":{"_index":"dst","_type":"_doc","_id":"b"}}`},
+			conflicts: 1,
+		},
+		{
+			name:        "external version",
+			action:      "index",
+			versionType: "external",
+			versionFrom: "version",
+			statuses:    map[string][]int{"a": {409}},
+			actions:     []string{`{"index":{"_index":"dst","_type":"_doc","_id":"a","routing":"r1","version":3,"version_type":"external"}}`, `{"index":{"_index":"dst","_type":"_doc","_id":"b","version":1,"version_type":"external"}}`},
+			conflicts:   1,
+		},
+		{
+			name:        "external_gte seq_no",
+			action:      "index",
+			versionType: "external_gte",
+			versionFrom: "seq_no",
+			actions:     []string{`{"index":{"_index":"dst","_type":"_doc","_id":"a","routing":"r1","version":11,"version_type":"external_gte"}}`, `{"index":{"_index":"dst","_type":"_doc","_id":"b","version":12,"version_type":"external_gte"}}`},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			api := &fakeBulkES{statuses: c.statuses}
+			m := &Migrator{
+				Config:      &Config{TargetIndexName: "dst", BulkAction: c.action, VersionType: c.versionType, VersionFrom: c.versionFrom, BulkSizeInMB: 10},
+				TargetESAPI: api,
+				DocChan:     make(chan map[string]interface{}, len(docs)),
+			}
+			for _, doc := range docs {
+				m.DocChan <- doc
+			}
+			close(m.DocChan)
+
+			docCount := 0
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			m.NewBulkWorker(&docCount, pb.New(0), &wg)
+
+			var actions []string
+			for _, body := range api.bodies {
+				for i, line := range strings.Split(strings.TrimSpace(body), "\n") {
+					if i%2 == 0 {
+						actions = append(actions, line)
+					}
+				}
+			}
+			sort.Strings(actions)
+			if !reflect.DeepEqual(actions, c.actions) {
+				t.Errorf("got actions:\n%s\nwant:\n%s", strings.Join(actions, "\n"), strings.Join(c.actions, "\n"))
+			}
+			if m.BulkStats.Conflicts != c.conflicts || m.BulkStats.Failed != 0 {
+				t.Errorf("got %d conflicts, %d failures, want %d conflicts", m.BulkStats.Conflicts, m.BulkStats.Failed, c.conflicts)
+			}
+		})
+	}
+}
+
+func TestDocVersionFields(t *testing.T) {
+	cases := []struct {
+		docVersion string
+		params     string
+	}{
+		{"", ""},
+		{"version", "&version=true"},
+		{"seq_no", "&seq_no_primary_term=true"},
+	}
+
+	for _, c := range cases {
+		api := &ESAPIV0{DocVersion: c.docVersion}
+		if got := api.docVersionParams(); got != c.params {
+			t.Errorf("%s: got params %s, want %s", c.docVersion, got, c.params)
+		}
+	}
+}
+
+func TestVersioningOptions(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{name: "unknown action", args: []string{"--bulk_action=update"}, err: "unknown bulk action: update"},
+		{name: "unknown version type", args: []string{"--version_type=internal"}, err: "unknown version type: internal"},
+		{name: "unknown version source", args: []string{"--version_type=external", "--version_from=term"}, err: "unknown version source: term"},
+		{name: "version with create", args: []string{"--version_type=external", "--bulk_action=create"}, err: "--version_type can't work with --bulk_action=create"},
+		{name: "version with regenerated id", args: []string{"--version_type=external", "-r"}, err: "--version_type can't work with --bulk_action=create or --regenerate_id"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			jobs, err := parseJobs(append([]string{"-i", "dump.json", "-d", "http://localhost:9201"}, c.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = runMigration(&Migrator{Config: jobs[0].Config})
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("got error %v, want %s", err, c.err)
+			}
+		})
+	}
+}
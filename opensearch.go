@@ -0,0 +1,72 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+)
+
+// ESAPIOpenSearch talks to opensearch 1.x and 2.x, which speak the 7.10 dialect,
+// mapping types were removed since 2.0
+type ESAPIOpenSearch struct {
+	ESAPIV7
+}
+
+func (s *ESAPIOpenSearch) Bulk(data *bytes.Buffer) (*BulkResponse, error) {
+	if s.Version.MajorVersion() >= 2 && data != nil && data.Len() > 0 {
+		if err := removeBulkTypes(data); err != nil {
+			data.Reset()
+			log.Error(err)
+			return nil, err
+		}
+	}
+	return s.ESAPIV7.Bulk(data)
+}
+
+func (s *ESAPIOpenSearch) NewScroll(indexNames string, scrollTime string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+	sort string, slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+	// without track_total_hits, hits.total stops at 10000
+	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d&track_total_hits=true%s", s.Host, indexNames, scrollTime, docBufferCount,
+		s.docVersionParams())
+
+	queryBody := newScrollQueryBody(query, filter, sort, slicedId, maxSlicedCount, fields)
+
+	jsonBody, err := json.Marshal(queryBody)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Trace("new scroll,", body)
+
+	scroll = &ScrollV7{}
+	err = DecodeJson(body, scroll)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return scroll, err
+}
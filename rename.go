@@ -0,0 +1,120 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// IndexRenameRule rename the source index which matches the pattern, ie: `src-*=>dst-$1-v2`.
+// The pattern is a wildcard, every `*` or `?` is a capture group, or a regular expression
+// between slashes, ie: `/logs-(\d+)\.(\d+)/=>logs-$1-$2`. The whole index name must match
+type IndexRenameRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// ParseIndexRenameRules parse the rules of --rename_index, the first matched rule wins
+func ParseIndexRenameRules(rules []string) ([]IndexRenameRule, error) {
+	result := make([]IndexRenameRule, 0, len(rules))
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=>", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, fmt.Errorf("invalid index rename rule: %s, should be like src-*=>dst-$1", rule)
+		}
+		pattern := strings.TrimSpace(parts[0])
+		replacement := strings.TrimSpace(parts[1])
+
+		var expr string
+		if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			expr = pattern[1 : len(pattern)-1]
+		} else {
+			expr = regexp.QuoteMeta(pattern)
+			expr = strings.Replace(expr, `\*`, "(.*)", -1)
+			expr = strings.Replace(expr, `\?`, "(.)", -1)
+		}
+
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid index rename rule: %s, %v", rule, err)
+		}
+		result = append(result, IndexRenameRule{pattern: re, replacement: replacement})
+	}
+	return result, nil
+}
+
+// renameIndex return the new name of index by the first matched rule
+func (m *Migrator) renameIndex(name string) (string, bool) {
+	for _, rule := range m.IndexRenameRules {
+		if rule.pattern.MatchString(name) {
+			return rule.pattern.ReplaceAllString(name, rule.replacement), true
+		}
+	}
+	return name, false
+}
+
+// getTargetIndexName return the target index of document from source index, renamed by
+// the rules if matched, otherwise -y is used if specified
+func (m *Migrator) getTargetIndexName(sourceIndex string) string {
+	if name, ok := m.renameIndex(sourceIndex); ok {
+		return name
+	}
+	if m.Config.TargetIndexName != "" {
+		return m.Config.TargetIndexName
+	}
+	return sourceIndex
+}
+
+// groupByTargetIndex group the comma separated source indexes by the target index they are copied into,
+// the target indexes are sorted
+func (m *Migrator) groupByTargetIndex(indexNames string) ([]string, map[string][]string) {
+	targets := map[string][]string{}
+	for _, name := range strings.Split(indexNames, ",") {
+		if len(name) == 0 {
+			continue
+		}
+		target := m.getTargetIndexName(name)
+		targets[target] = append(targets[target], name)
+	}
+	targetNames := make([]string, 0, len(targets))
+	for name, sources := range targets {
+		sort.Strings(sources)
+		targetNames = append(targetNames, name)
+	}
+	sort.Strings(targetNames)
+	return targetNames, targets
+}
+
+// renameIndexes rename the keys of index settings or mappings by the rules
+func (m *Migrator) renameIndexes(indexes *Indexes) {
+	if indexes == nil || len(m.IndexRenameRules) == 0 {
+		return
+	}
+	renamed := Indexes{}
+	for name, v := range *indexes {
+		target, ok := m.renameIndex(name)
+		if ok {
+			log.Debugf("rename index %s to %s", name, target)
+		}
+		renamed[target] = v
+	}
+	*indexes = renamed
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupByTargetIndex(t *testing.T) {
+	cases := []struct {
+		name        string
+		indexNames  string
+		targetIndex string
+		rules       []string
+		want        []string
+		groups      map[string][]string
+	}{
+		{
+			name:       "same names",
+			indexNames: "b,a",
+			want:       []string{"a", "b"},
+			groups:     map[string][]string{"a": {"a"}, "b": {"b"}},
+		},
+		{
+			name:        "all into -y",
+			indexNames:  "logs-2,logs-1",
+			targetIndex: "logs",
+			want:        []string{"logs"},
+			groups:      map[string][]string{"logs": {"logs-1", "logs-2"}},
+		},
+		{
+			name:        "renamed before -y",
+			indexNames:  "logs-2024.01,logs-2024.02,users",
+			targetIndex: "others",
+			rules:       []string{"logs-*.*=>archive-$1"},
+			want:        []string{"archive-2024", "others"},
+			groups:      map[string][]string{"archive-2024": {"logs-2024.01", "logs-2024.02"}, "others": {"users"}},
+		},
+		{
+			name:       "empty names",
+			indexNames: ",a,",
+			want:       []string{"a"},
+			groups:     map[string][]string{"a": {"a"}},
+		},
+		{
+			name:   "nothing",
+			want:   []string{},
+			groups: map[string][]string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rules, err := ParseIndexRenameRules(c.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{Config: &Config{TargetIndexName: c.targetIndex}, IndexRenameRules: rules}
+			targetNames, groups := m.groupByTargetIndex(c.indexNames)
+			if !reflect.DeepEqual(targetNames, c.want) {
+				t.Errorf("got targets %v, want %v", targetNames, c.want)
+			}
+			if !reflect.DeepEqual(groups, c.groups) {
+				t.Errorf("got groups %v, want %v", groups, c.groups)
+			}
+		})
+	}
+}
+
+func TestParseIndexRenameRules(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []string
+		// source index => renamed index, empty for not matched
+		want map[string]string
+		err  bool
+	}{
+		{
+			name:  "exact",
+			rules: []string{"users=>users_v2"},
+			want:  map[string]string{"users": "users_v2", "users-1": "", "old-users": ""},
+		},
+		{
+			name:  "wildcard",
+			rules: []string{"src-*=>dst-$1-v2"},
+			want:  map[string]string{"src-a": "dst-a-v2", "src-": "dst--v2", "src-a.b": "dst-a.b-v2", "xsrc-a": ""},
+		},
+		{
+			name:  "capture groups",
+			rules: []string{"logs-*.*=>logs-$2-$1", "app-??=>${1}${2}-app"},
+			want:  map[string]string{"logs-2024.01": "logs-01-2024", "app-eu": "eu-app", "app-e": "", "app-eu1": ""},
+		},
+		{
+			// dots and other regexp characters of wildcards are literal
+			name:  "literal dots",
+			rules: []string{"a.b*=>c$1"},
+			want:  map[string]string{"a.b1": "c1", "axb1": ""},
+		},
+		{
+			name:  "regex",
+			rules: []string{`/logs-(\d+)\.(\d+)/=>logs-$1-$2`},
+			want:  map[string]string{"logs-2024.01": "logs-2024-01", "logs-2024.x": "", "my-logs-2024.01": "", "logs-2024.01-old": ""},
+		},
+		{
+			name:  "regex alternatives match whole name",
+			rules: []string{`/a|b/=>c`},
+			want:  map[string]string{"a": "c", "b": "c", "ab": ""},
+		},
+		{
+			name:  "first matched wins",
+			rules: []string{"logs-old-*=>archive-$1", "logs-*=>new-$1"},
+			want:  map[string]string{"logs-old-1": "archive-1", "logs-1": "new-1"},
+		},
+		{
+			name:  "spaces are trimmed",
+			rules: []string{" src-* => dst-$1 "},
+			want:  map[string]string{"src-a": "dst-a"},
+		},
+		{name: "missing arrow", rules: []string{"src-*"}, err: true},
+		{name: "empty pattern", rules: []string{"=>dst"}, err: true},
+		{name: "empty replacement", rules: []string{"src=> "}, err: true},
+		{name: "invalid regex", rules: []string{"/logs-(/=>x"}, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rules, err := ParseIndexRenameRules(c.rules)
+			if c.err {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{Config: &Config{}, IndexRenameRules: rules}
+			for source, want := range c.want {
+				got, ok := m.renameIndex(source)
+				if len(want) == 0 {
+					if ok || got != source {
+						t.Errorf("%s: got renamed to %s, want not matched", source, got)
+					}
+					continue
+				}
+				if !ok || got != want {
+					t.Errorf("%s: got %s, want %s", source, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameIndexes(t *testing.T) {
+	rules, err := ParseIndexRenameRules([]string{"src-*=>dst-$1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Migrator{Config: &Config{TargetIndexName: "ignored"}, IndexRenameRules: rules}
+	indexes := &Indexes{"src-a": 1, "other": 2}
+	m.renameIndexes(indexes)
+	if want := (&Indexes{"dst-a": 1, "other": 2}); !reflect.DeepEqual(indexes, want) {
+		t.Errorf("got %v, want %v", *indexes, *want)
+	}
+}
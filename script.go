@@ -0,0 +1,204 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dop251/goja"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// scriptFunction is the function every --transform_script must define
+const scriptFunction = "transform"
+
+// scriptProcessor run the `transform(doc)` function of a javascript file on every document, doc is
+// the whole document, ie: {_index, _id, _routing, _source}, which can be changed in place. Return
+// false to drop the document, or an object to replace it, ie:
+//
+//	function transform(doc) {
+//	  if (doc._source.deleted) return false;
+//	  doc._id = doc._source.user + "-" + doc._source.seq;
+//	  doc._source.tags = doc._source.tags.split(",");
+//	}
+type scriptProcessor struct {
+	path    string
+	program *goja.Program
+	// the javascript runtime is not thread safe, every worker takes one from the pool
+	pool sync.Pool
+}
+
+type scriptRuntime struct {
+	vm *goja.Runtime
+	fn goja.Callable
+}
+
+func newScriptProcessor(path string) (*scriptProcessor, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	program, err := goja.Compile(path, string(code), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile transform script %s: %v", path, err)
+	}
+
+	p := &scriptProcessor{path: path, program: program}
+	// fail fast if the script is broken
+	runtime, err := p.newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	p.pool.Put(runtime)
+	return p, nil
+}
+
+func (p *scriptProcessor) newRuntime() (*scriptRuntime, error) {
+	vm := goja.New()
+	if _, err := vm.RunProgram(p.program); err != nil {
+		return nil, fmt.Errorf("failed to run transform script %s: %v", p.path, err)
+	}
+	fn, ok := goja.AssertFunction(vm.Get(scriptFunction))
+	if !ok {
+		return nil, fmt.Errorf("transform script %s should define function %s(doc)", p.path, scriptFunction)
+	}
+	return &scriptRuntime{vm: vm, fn: fn}, nil
+}
+
+func (p *scriptProcessor) Process(doc map[string]interface{}) (bool, error) {
+	runtime, ok := p.pool.Get().(*scriptRuntime)
+	if !ok {
+		var err error
+		if runtime, err = p.newRuntime(); err != nil {
+			return false, err
+		}
+	}
+	defer p.pool.Put(runtime)
+
+	arg := scriptValue(runtime.vm, doc)
+	result, err := runtime.fn(goja.Undefined(), arg)
+	if err != nil {
+		return false, err
+	}
+
+	switch v := result.Export().(type) {
+	case nil:
+		if !goja.IsUndefined(result) {
+			// null drops the document like false
+			return false, nil
+		}
+	case bool:
+		if !v {
+			return false, nil
+		}
+	}
+	// the document is changed in place, unless another object is returned
+	changed, ok := result.Export().(map[string]interface{})
+	if !ok {
+		changed, _ = arg.Export().(map[string]interface{})
+	}
+	if _, ok := changed["_source"].(map[string]interface{}); !ok {
+		return false, fmt.Errorf("_source of document should be an object, got %T", changed["_source"])
+	}
+
+	// replace the content only, the map is held by the output
+	original := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		original[key] = value
+		delete(doc, key)
+	}
+	for key, value := range changed {
+		// back to json.Number, so the documents are compared with target as they are decoded by --sync
+		doc[key] = jsonValues(value, original[key])
+	}
+	return true, nil
+}
+
+// scriptValue convert a document into native javascript values, json.Number is converted into
+// int64 or float64, which are numbers for javascript
+func scriptValue(vm *goja.Runtime, v interface{}) goja.Value {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		obj := vm.NewObject()
+		for k, item := range value {
+			obj.Set(k, scriptValue(vm, item))
+		}
+		return obj
+	case []interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = scriptValue(vm, item)
+		}
+		return vm.NewArray(items...)
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return vm.ToValue(i)
+		}
+		if f, err := value.Float64(); err == nil {
+			return vm.ToValue(f)
+		}
+	}
+	return vm.ToValue(v)
+}
+
+// jsonValues convert the numbers of document into json.Number, the numbers not changed by the script
+// are kept as the original ones, as javascript numbers can't hold longs beyond 2^53
+func jsonValues(v interface{}, original interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		obj, _ := original.(map[string]interface{})
+		for k, item := range value {
+			value[k] = jsonValues(item, obj[k])
+		}
+	case []interface{}:
+		items, _ := original.([]interface{})
+		for i, item := range value {
+			var originalItem interface{}
+			if i < len(items) {
+				originalItem = items[i]
+			}
+			value[i] = jsonValues(item, originalItem)
+		}
+	case int64:
+		return jsonNumber(float64(value), strconv.FormatInt(value, 10), original)
+	case int:
+		return jsonNumber(float64(value), strconv.Itoa(value), original)
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil
+		}
+		format := byte('g')
+		if value == math.Trunc(value) && math.Abs(value) < 1e21 {
+			// like javascript, integers are not written with exponent
+			format = 'f'
+		}
+		return jsonNumber(value, strconv.FormatFloat(value, format, -1, 64), original)
+	}
+	return v
+}
+
+func jsonNumber(value float64, text string, original interface{}) json.Number {
+	if n, ok := original.(json.Number); ok {
+		if f, err := n.Float64(); err == nil && f == value {
+			return n
+		}
+	}
+	return json.Number(text)
+}
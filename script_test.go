@@ -0,0 +1,106 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScriptTransform(t *testing.T) {
+	doc := `{"_id":"1","_index":"idx","_source":{"name":"me","n":9007199254740993,"tags":["a"]}}`
+
+	cases := []struct {
+		name   string
+		script string
+		keep   bool
+		want   string
+		reason string
+	}{
+		{
+			name:   "change in place",
+			script: `doc._source.name = doc._source.name.toUpperCase(); doc._source.tags.push("b"); doc._routing = "r";`,
+			keep:   true,
+			want:   `{"_id":"1","_index":"idx","_routing":"r","_source":{"name":"ME","n":9007199254740993,"tags":["a","b"]}}`,
+		},
+		{
+			name:   "return a new document",
+			script: `return {_id: doc._id + "-2", _index: "idx2", _source: {name: doc._source.name}};`,
+			keep:   true,
+			want:   `{"_id":"1-2","_index":"idx2","_source":{"name":"me"}}`,
+		},
+		{
+			name:   "numbers",
+			script: `doc._source.sum = doc._source.tags.length + 2; doc._source.half = 0.5; doc._source.big = 2e20; doc._source.n2 = doc._source.n;`,
+			keep:   true,
+			want:   `{"_id":"1","_index":"idx","_source":{"name":"me","n":9007199254740993,"tags":["a"],"sum":3,"half":0.5,"big":200000000000000000000,"n2":9007199254740992}}`,
+		},
+		{name: "dropped", script: `return false;`},
+		{name: "number id", script: `doc._id = 123;`, reason: "_id should be a string"},
+		{name: "deleted index", script: `delete doc._index;`, reason: "_index is removed by transform"},
+		{name: "thrown", script: `throw new Error("bad doc");`, reason: "bad doc"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "transform.js")
+			if err := os.WriteFile(path, []byte("function transform(doc) {\n"+c.script+"\n}\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			pipeline, err := ParsePipeline(nil, "", "", nil, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rejectedPath := filepath.Join(dir, "rejected.json")
+			rejected, err := NewDeadLetterWriter(rejectedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{Pipeline: pipeline, Rejected: rejected}
+
+			d := testSyncDoc(t, doc)
+			keep := m.transformDoc(d, 0)
+			rejected.Close()
+			data, err := os.ReadFile(rejectedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(c.reason) > 0 {
+				if keep {
+					t.Fatal("the document is kept")
+				}
+				if !strings.Contains(string(data), c.reason) || !strings.Contains(string(data), `"_index":"idx"`) {
+					t.Errorf("got rejected %s, want the original document with %s", data, c.reason)
+				}
+				return
+			}
+			if len(data) > 0 {
+				t.Errorf("rejected %s", data)
+			}
+			if keep != c.keep {
+				t.Fatalf("got keep %v, want %v", keep, c.keep)
+			}
+			if keep {
+				assertJsonEqual(t, d, c.want)
+			}
+		})
+	}
+}
@@ -18,8 +18,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/cheggaaa/pb"
 	log "github.com/cihub/seelog"
+	"os"
+	"strings"
 )
 
 type ScrollAPI interface {
@@ -28,6 +31,139 @@ type ScrollAPI interface {
 	GetDocs() []interface{}
 	ProcessScrollResult(c *Migrator, bar *pb.ProgressBar)
 	Next(c *Migrator, bar *pb.ProgressBar) (done bool)
+	SetCheckpoint(checkpoint *SliceCheckpoint)
+}
+
+// SearchQuery is the query of search requests, the query_string of --query, or the query dsl of --query_dsl
+type SearchQuery struct {
+	QueryString string
+	// the compact json of query clause, resolved by ParseQueryDSL
+	DSL string
+}
+
+// SearchQuery return the query of source searches
+func (c *Config) SearchQuery() SearchQuery {
+	return SearchQuery{QueryString: c.Query, DSL: c.QueryDSL}
+}
+
+func (q SearchQuery) IsEmpty() bool {
+	return len(q.QueryString) == 0 && len(q.DSL) == 0
+}
+
+// Clause return the query clause of search body, nil if the query is empty
+func (q SearchQuery) Clause() map[string]interface{} {
+	if len(q.DSL) > 0 {
+		clause := map[string]interface{}{}
+		if err := DecodeJson(q.DSL, &clause); err != nil {
+			log.Warn(err)
+		}
+		return clause
+	}
+	if len(q.QueryString) > 0 {
+		return map[string]interface{}{
+			"query_string": map[string]interface{}{
+				"query": q.QueryString,
+			},
+		}
+	}
+	return nil
+}
+
+// newScrollQueryBody build the search body of scroll request, filter is an optional clause
+// which documents must match along with the query
+func newScrollQueryBody(query SearchQuery, filter map[string]interface{}, sort string,
+	slicedId int, maxSlicedCount int, fields string) map[string]interface{} {
+	queryBody := map[string]interface{}{}
+
+	if len(fields) > 0 {
+		if !strings.Contains(fields, ",") {
+			queryBody["_source"] = fields
+		} else {
+			queryBody["_source"] = strings.Split(fields, ",")
+		}
+	}
+
+	queryClause := query.Clause()
+
+	if filter != nil {
+		boolClause := map[string]interface{}{
+			"filter": []interface{}{filter},
+		}
+		if queryClause != nil {
+			boolClause["must"] = []interface{}{queryClause}
+		}
+		queryClause = map[string]interface{}{
+			"bool": boolClause,
+		}
+	}
+
+	if queryClause != nil {
+		queryBody["query"] = queryClause
+	}
+
+	if spec := sortSpecOf(sort); len(spec) > 0 {
+		queryBody["sort"] = spec.Clause()
+	}
+
+	if maxSlicedCount > 1 {
+		log.Tracef("sliced scroll, %d of %d", slicedId, maxSlicedCount)
+		queryBody["slice"] = map[string]interface{}{}
+		queryBody["slice"].(map[string]interface{})["id"] = slicedId
+		queryBody["slice"].(map[string]interface{})["max"] = maxSlicedCount
+	}
+
+	return queryBody
+}
+
+// ParseQueryDSL read the query dsl of --query_dsl, inline json or @file.json, both the query
+// clause and a search body with `query` are accepted, the compact json of query clause is returned
+func ParseQueryDSL(dsl string) (string, error) {
+	data := []byte(dsl)
+	if strings.HasPrefix(dsl, "@") {
+		var err error
+		if data, err = os.ReadFile(dsl[1:]); err != nil {
+			return "", err
+		}
+	}
+
+	clause := map[string]interface{}{}
+	if err := DecodeJsonBytes(data, &clause); err != nil {
+		return "", fmt.Errorf("invalid query dsl %s: %v", dsl, err)
+	}
+	if query, ok := clause["query"].(map[string]interface{}); ok && len(clause) == 1 {
+		clause = query
+	}
+	if len(clause) == 0 {
+		return "", fmt.Errorf("invalid query dsl %s: the query is empty", dsl)
+	}
+
+	data, err := json.Marshal(clause)
+	return string(data), err
+}
+
+// docVersionFields return the search options to fetch the `_version` or `_seq_no` of documents
+func (s *ESAPIV0) docVersionFields() map[string]interface{} {
+	switch s.DocVersion {
+	case "version":
+		return map[string]interface{}{"version": true}
+	case "seq_no":
+		return map[string]interface{}{"seq_no_primary_term": true}
+	}
+	return nil
+}
+
+// docVersionParams return docVersionFields as url parameters
+func (s *ESAPIV0) docVersionParams() string {
+	params := ""
+	for k, v := range s.docVersionFields() {
+		params += fmt.Sprintf("&%s=%v", k, v)
+	}
+	return params
+}
+
+// SetCheckpoint track the documents of this scroll and the following ones in checkpoint
+func (scroll *Scroll) SetCheckpoint(checkpoint *SliceCheckpoint) {
+	scroll.checkpoint = checkpoint
 }
 
 func (scroll *Scroll) GetHitsTotal() int {
@@ -67,6 +203,8 @@ func (s *Scroll) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
 		log.Errorf(string(reason))
 	}
 
+	s.checkpoint.Track(s.Hits.Docs)
+
 	// write all the docs into a channel
 	for _, docI := range s.Hits.Docs {
 		c.DocChan <- docI.(map[string]interface{})
@@ -87,6 +225,7 @@ func (s *Scroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
 		return true
 	}
 
+	scroll.SetCheckpoint(s.checkpoint)
 	scroll.ProcessScrollResult(c, bar)
 
 	//update scrollId
@@ -108,6 +247,8 @@ func (s *ScrollV7) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
 		log.Errorf(string(reason))
 	}
 
+	s.checkpoint.Track(s.Hits.Docs)
+
 	// write all the docs into a channel
 	for _, docI := range s.Hits.Docs {
 		c.DocChan <- docI.(map[string]interface{})
@@ -128,6 +269,7 @@ func (s *ScrollV7) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
 		return true
 	}
 
+	scroll.SetCheckpoint(s.checkpoint)
 	scroll.ProcessScrollResult(c, bar)
 
 	//update scrollId
@@ -157,6 +299,10 @@ func (es *EmptyScroll) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
 
 }
 
+func (es *EmptyScroll) SetCheckpoint(checkpoint *SliceCheckpoint) {
+
+}
+
 func (es *EmptyScroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
 	return true
 }
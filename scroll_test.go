@@ -0,0 +1,103 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestNewScrollQueryBody(t *testing.T) {
+	ids := map[string]interface{}{"ids": map[string]interface{}{"values": []interface{}{"a"}}}
+
+	cases := []struct {
+		name   string
+		query  SearchQuery
+		filter map[string]interface{}
+		want   string
+	}{
+		{
+			name: "empty",
+			want: `{}`,
+		},
+		{
+			name:  "query string",
+			query: SearchQuery{QueryString: "name:medcl"},
+			want:  `{"query":{"query_string":{"query":"name:medcl"}}}`,
+		},
+		{
+			// a query string is never taken as json
+			name:  "query string like json",
+			query: SearchQuery{QueryString: `{"match_all":{}}`},
+			want:  `{"query":{"query_string":{"query":"{\"match_all\":{}}"}}}`,
+		},
+		{
+			name:  "query dsl",
+			query: SearchQuery{DSL: `{"range":{"ts":{"gte":"now-1d","format":"strict_date_optional_time"}}}`},
+			want:  `{"query":{"range":{"ts":{"gte":"now-1d","format":"strict_date_optional_time"}}}}`,
+		},
+		{
+			name:   "query dsl with filter",
+			query:  SearchQuery{DSL: `{"term":{"status":"active"}}`},
+			filter: ids,
+			want:   `{"query":{"bool":{"must":[{"term":{"status":"active"}}],"filter":[{"ids":{"values":["a"]}}]}}}`,
+		},
+		{
+			name:   "filter only",
+			filter: ids,
+			want:   `{"query":{"bool":{"filter":[{"ids":{"values":["a"]}}]}}}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assertJsonEqual(t, newScrollQueryBody(c.query, c.filter, "", 0, 0, ""), c.want)
+		})
+	}
+}
+
+func TestParseQueryDSL(t *testing.T) {
+	cases := []struct {
+		name string
+		dsl  string
+		want string
+		err  bool
+	}{
+		{name: "query clause", dsl: `{"term": {"status": "active"}}`, want: `{"term":{"status":"active"}}`},
+		{name: "search body", dsl: `{"query": {"term": {"status": "active"}}}`, want: `{"term":{"status":"active"}}`},
+		{name: "long", dsl: `{"term": {"n": 9007199254740993}}`, want: `{"term":{"n":9007199254740993}}`},
+		{name: "empty", dsl: `{}`, err: true},
+		{name: "invalid", dsl: `status:active`, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseQueryDSL(c.dsl)
+			if c.err {
+				if err == nil {
+					t.Fatalf("got %s, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
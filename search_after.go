@@ -0,0 +1,282 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cheggaaa/pb"
+	log "github.com/cihub/seelog"
+)
+
+// SearchAfterScroll page through documents with search_after, instead of holding a scroll context.
+// For 7.10+ the pages are read from a point in time, so they are consistent and can be sliced,
+// for older versions every page is a new search on the sort field
+type SearchAfterScroll struct {
+	api        *ESAPIV0
+	url        string
+	body       map[string]interface{}
+	keepAlive  string
+	pitId      string
+	total      int
+	docs       []interface{}
+	checkpoint *SliceCheckpoint
+}
+
+func (s *ESAPIV0) NewSearchAfter(indexNames string, keepAlive string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+	sort string, slicedId int, maxSlicedCount int, fields string, searchAfter []interface{}) (ScrollAPI, error) {
+
+	if !s.Version.IsOpenSearch() && s.Version.MajorVersion() < 5 {
+		return nil, errors.New("search_after is only supported since elasticsearch 5.0")
+	}
+	if len(sort) == 0 {
+		return nil, errors.New("search_after need the --sort field")
+	}
+
+	// opensearch has its own point in time api, just page on the sort field
+	usePit := !s.Version.IsOpenSearch() && s.Version.IsAtLeast(7, 10)
+	if maxSlicedCount > 1 && !usePit {
+		return nil, errors.New("sliced search_after need point in time, which is only supported since elasticsearch 7.10")
+	}
+
+	spec := sortSpecOf(sort)
+	if spec.Has("_id") && s.Version.MajorVersion() >= 8 {
+		// fielddata on _id is disabled by default since 8.0, the tiebreaker is enough
+		log.Debug("sort by _id is not allowed in 8.x, use _shard_doc instead")
+		spec = spec.Without("_id")
+	}
+	tiebreaker, err := searchAfterTiebreaker(s.Version, usePit)
+	if err != nil {
+		return nil, err
+	}
+	sortFields := spec.Clause()
+	if !spec.Has(tiebreaker) {
+		// documents with the same sort values are never skipped or read twice between pages
+		sortFields = append(sortFields, tiebreaker)
+	}
+
+	body := newScrollQueryBody(query, filter, "", slicedId, maxSlicedCount, fields)
+	body["sort"] = sortFields
+	body["size"] = docBufferCount
+	for k, v := range s.docVersionFields() {
+		body[k] = v
+	}
+
+	if len(searchAfter) > 0 {
+		after := append([]interface{}{}, searchAfter...)
+		if tiebreaker == "_shard_doc" && len(after) > len(spec) {
+			// _shard_doc only makes sense inside the point in time which was used to read it
+			after = after[:len(spec)]
+		}
+		// start before all the documents with the same sort values, whatever their tiebreaker is
+		for len(after) < len(sortFields) {
+			if tiebreaker == "_shard_doc" {
+				after = append(after, -1)
+			} else {
+				after = append(after, "")
+			}
+		}
+		body["search_after"] = after
+	}
+
+	scroll := &SearchAfterScroll{
+		api:       s,
+		body:      body,
+		keepAlive: keepAlive,
+	}
+
+	if usePit {
+		pitId, err := s.openPointInTime(indexNames, keepAlive)
+		if err != nil {
+			return nil, err
+		}
+		scroll.pitId = pitId
+		scroll.url = fmt.Sprintf("%s/_search", s.Host)
+	} else {
+		scroll.url = fmt.Sprintf("%s/%s/_search", s.Host, indexNames)
+	}
+
+	// only count the total hits once
+	if s.Version.IsOpenSearch() || s.Version.MajorVersion() >= 7 {
+		body["track_total_hits"] = true
+	}
+	err = scroll.fetch()
+	delete(body, "track_total_hits")
+	if err != nil {
+		scroll.close()
+		return nil, err
+	}
+
+	return scroll, nil
+}
+
+// searchAfterTiebreaker return the unique field appended to the sort, _shard_doc inside a point in time
+// since 7.12, which is the cheapest, otherwise _id, or _uid before 6.0
+func searchAfterTiebreaker(version *ClusterVersion, usePit bool) (string, error) {
+	switch {
+	case usePit && version.IsAtLeast(7, 12):
+		return "_shard_doc", nil
+	case version.IsOpenSearch():
+		return "_id", nil
+	case version.MajorVersion() >= 8:
+		return "", errors.New("search_after need a unique tiebreaker, _shard_doc need a point in time, sort by _id is not allowed in 8.x")
+	case version.MajorVersion() >= 6:
+		return "_id", nil
+	}
+	return "_uid", nil
+}
+
+func (s *ESAPIV0) openPointInTime(indexNames string, keepAlive string) (string, error) {
+	url := fmt.Sprintf("%s/%s/_pit?keep_alive=%s", s.Host, indexNames, keepAlive)
+	body, err := Request(s.Compress, "POST", url, s.Auth, nil, s.Client)
+	if err != nil {
+		return "", err
+	}
+
+	pit := struct {
+		Id string `json:"id"`
+	}{}
+	if err := DecodeJson(body, &pit); err != nil {
+		return "", err
+	}
+	log.Debug("open point in time, ", pit.Id)
+	return pit.Id, nil
+}
+
+func (s *ESAPIV0) closePointInTime(pitId string) error {
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"id": pitId,
+	})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/_pit", s.Host)
+	_, err = Request(false, "DELETE", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client)
+	return err
+}
+
+// fetch read the page after the current `search_after`
+func (scroll *SearchAfterScroll) fetch() error {
+	if len(scroll.pitId) > 0 {
+		scroll.body["pit"] = map[string]interface{}{
+			"id":         scroll.pitId,
+			"keep_alive": scroll.keepAlive,
+		}
+	}
+
+	jsonBody, err := json.Marshal(scroll.body)
+	if err != nil {
+		return err
+	}
+
+	api := scroll.api
+	body, err := Request(api.Compress, "POST", scroll.url, api.Auth, bytes.NewBuffer(jsonBody), api.Client)
+	if err != nil {
+		return err
+	}
+
+	var page ScrollAPI
+	var pitId string
+	if api.Version.IsOpenSearch() || api.Version.MajorVersion() >= 7 {
+		v7 := &ScrollV7{}
+		err = DecodeJson(body, v7)
+		page, pitId = v7, v7.PitId
+	} else {
+		v5 := &Scroll{}
+		err = DecodeJson(body, v5)
+		page, pitId = v5, v5.PitId
+	}
+	if err != nil {
+		return err
+	}
+
+	// the id of point in time may change between requests
+	if len(pitId) > 0 {
+		scroll.pitId = pitId
+	}
+	if scroll.total == 0 {
+		scroll.total = page.GetHitsTotal()
+	}
+	scroll.docs = page.GetDocs()
+	return nil
+}
+
+func (scroll *SearchAfterScroll) close() {
+	if len(scroll.pitId) == 0 {
+		return
+	}
+	if err := scroll.api.closePointInTime(scroll.pitId); err != nil {
+		log.Error(err)
+	}
+	scroll.pitId = ""
+}
+
+func (scroll *SearchAfterScroll) GetScrollId() string {
+	return scroll.pitId
+}
+
+func (scroll *SearchAfterScroll) GetHitsTotal() int {
+	return scroll.total
+}
+
+func (scroll *SearchAfterScroll) GetDocs() []interface{} {
+	return scroll.docs
+}
+
+func (scroll *SearchAfterScroll) SetCheckpoint(checkpoint *SliceCheckpoint) {
+	scroll.checkpoint = checkpoint
+}
+
+func (scroll *SearchAfterScroll) ProcessScrollResult(c *Migrator, bar *pb.ProgressBar) {
+
+	//update progress bar
+	bar.Add(len(scroll.docs))
+
+	scroll.checkpoint.Track(scroll.docs)
+
+	// write all the docs into a channel
+	for _, docI := range scroll.docs {
+		c.DocChan <- docI.(map[string]interface{})
+	}
+}
+
+func (scroll *SearchAfterScroll) Next(c *Migrator, bar *pb.ProgressBar) (done bool) {
+	if len(scroll.docs) == 0 {
+		scroll.close()
+		return true
+	}
+
+	last := scroll.docs[len(scroll.docs)-1].(map[string]interface{})
+	scroll.body["search_after"] = last["sort"]
+
+	if err := scroll.fetch(); err != nil {
+		log.Error(err)
+		return false
+	}
+
+	if len(scroll.docs) == 0 {
+		log.Debug("search_after result is empty")
+		scroll.close()
+		return true
+	}
+
+	scroll.ProcessScrollResult(c, bar)
+	return false
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSearchAfterTiebreaker(t *testing.T) {
+	cases := []struct {
+		version      string
+		distribution string
+		usePit       bool
+		want         string
+		err          bool
+	}{
+		{version: "5.6.16", want: "_uid"},
+		{version: "6.8.23", want: "_id"},
+		{version: "7.9.3", want: "_id"},
+		{version: "7.10.2", usePit: true, want: "_id"},
+		{version: "7.12.0", usePit: true, want: "_shard_doc"},
+		{version: "8.11.0", usePit: true, want: "_shard_doc"},
+		{version: "8.11.0", err: true},
+		{version: "2.11.0", distribution: "opensearch", want: "_id"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.distribution+c.version, func(t *testing.T) {
+			version := &ClusterVersion{}
+			version.Version.Number = c.version
+			version.Version.Distribution = c.distribution
+			got, err := searchAfterTiebreaker(version, c.usePit)
+			if c.err {
+				if err == nil {
+					t.Fatalf("got %s, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"strings"
+)
+
+// SortKey is a field of --sort with its order
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// SortSpec is the sort of search requests, parsed from --sort, ie: @timestamp:desc,_id:asc
+type SortSpec []SortKey
+
+// ParseSortSpec parse the fields separated by comma, every field can have an order after colon,
+// asc by default
+func ParseSortSpec(sort string) (SortSpec, error) {
+	spec := SortSpec{}
+	for _, item := range strings.Split(sort, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		key := SortKey{Field: item}
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			key.Field = strings.TrimSpace(item[:i])
+			switch strings.ToLower(strings.TrimSpace(item[i+1:])) {
+			case "asc":
+			case "desc":
+				key.Desc = true
+			default:
+				return nil, fmt.Errorf("invalid sort: %s, the order should be asc or desc", item)
+			}
+		}
+		if len(key.Field) == 0 {
+			return nil, fmt.Errorf("invalid sort: %s, the field is empty", item)
+		}
+		spec = append(spec, key)
+	}
+	return spec, nil
+}
+
+// String return the spec in the format of --sort
+func (spec SortSpec) String() string {
+	items := make([]string, 0, len(spec))
+	for _, key := range spec {
+		if key.Desc {
+			items = append(items, key.Field+":desc")
+		} else {
+			items = append(items, key.Field)
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// Clause return the sort of search body, the fields in ascending order are kept as plain names
+func (spec SortSpec) Clause() []interface{} {
+	clause := make([]interface{}, 0, len(spec))
+	for _, key := range spec {
+		if key.Desc {
+			clause = append(clause, map[string]interface{}{
+				key.Field: map[string]interface{}{"order": "desc"},
+			})
+		} else {
+			clause = append(clause, key.Field)
+		}
+	}
+	return clause
+}
+
+// Has return true if the field is in the spec
+func (spec SortSpec) Has(field string) bool {
+	for _, key := range spec {
+		if key.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Without return the spec without the field
+func (spec SortSpec) Without(field string) SortSpec {
+	result := SortSpec{}
+	for _, key := range spec {
+		if key.Field != field {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// sortSpecOf parse a sort which was validated already
+func sortSpecOf(sort string) SortSpec {
+	spec, err := ParseSortSpec(sort)
+	if err != nil {
+		log.Warn(err)
+	}
+	return spec
+}
+
+// compareSortValues compare the `sort` of two hits by the spec, like elasticsearch does, the
+// missing values are the last whatever the order is
+func compareSortValues(spec SortSpec, a []interface{}, b []interface{}) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y interface{}
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		c := compareSortValue(x, y)
+		if c == 0 {
+			continue
+		}
+		if i < len(spec) && spec[i].Desc && x != nil && y != nil {
+			c = -c
+		}
+		return c
+	}
+	return 0
+}
+
+// compareSortValue compare numbers by value, strings by bytes like keywords are sorted
+func compareSortValue(x interface{}, y interface{}) int {
+	switch {
+	case x == nil && y == nil:
+		return 0
+	case x == nil:
+		return 1
+	case y == nil:
+		return -1
+	}
+
+	switch a := x.(type) {
+	case json.Number:
+		if b, ok := y.(json.Number); ok {
+			return compareNumbers(a, b)
+		}
+	case string:
+		if b, ok := y.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case bool:
+		if b, ok := y.(bool); ok {
+			switch {
+			case a == b:
+				return 0
+			case b:
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(fmt.Sprint(x), fmt.Sprint(y))
+}
+
+// compareNumbers compare integers exactly, as longs and dates are beyond the precision of float
+func compareNumbers(a json.Number, b json.Number) int {
+	if x, err := a.Int64(); err == nil {
+		if y, err := b.Int64(); err == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	x, _ := a.Float64()
+	y, _ := b.Float64()
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseSortSpec(t *testing.T) {
+	cases := []struct {
+		sort   string
+		want   SortSpec
+		str    string
+		clause string
+		err    bool
+	}{
+		{sort: "", want: SortSpec{}, str: "", clause: `[]`},
+		{sort: "_id", want: SortSpec{{Field: "_id"}}, str: "_id", clause: `["_id"]`},
+		{
+			sort:   "@timestamp:desc,_id:asc",
+			want:   SortSpec{{Field: "@timestamp", Desc: true}, {Field: "_id"}},
+			str:    "@timestamp:desc,_id",
+			clause: `[{"@timestamp":{"order":"desc"}},"_id"]`,
+		},
+		{
+			sort:   " ts : DESC , , name ",
+			want:   SortSpec{{Field: "ts", Desc: true}, {Field: "name"}},
+			str:    "ts:desc,name",
+			clause: `[{"ts":{"order":"desc"}},"name"]`,
+		},
+		{
+			// only the last colon separates the order
+			sort:   "a:b:desc",
+			want:   SortSpec{{Field: "a:b", Desc: true}},
+			str:    "a:b:desc",
+			clause: `[{"a:b":{"order":"desc"}}]`,
+		},
+		{sort: "ts:down", err: true},
+		{sort: ":desc", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.sort, func(t *testing.T) {
+			spec, err := ParseSortSpec(c.sort)
+			if c.err {
+				if err == nil {
+					t.Fatalf("got %v, want error", spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(spec, c.want) {
+				t.Errorf("got %v, want %v", spec, c.want)
+			}
+			if spec.String() != c.str {
+				t.Errorf("got string %s, want %s", spec.String(), c.str)
+			}
+			assertJsonEqual(t, spec.Clause(), c.clause)
+
+			// the string form is parsed into the same spec, as it's saved in checkpoint
+			again, err := ParseSortSpec(spec.String())
+			if err != nil || !reflect.DeepEqual(again, spec) {
+				t.Errorf("got %v after round trip, want %v", again, spec)
+			}
+		})
+	}
+}
+
+func TestSortSpecWithout(t *testing.T) {
+	spec := SortSpec{{Field: "ts", Desc: true}, {Field: "_id"}}
+	if !spec.Has("_id") || spec.Has("name") {
+		t.Errorf("got Has(_id) %v, Has(name) %v", spec.Has("_id"), spec.Has("name"))
+	}
+	if got := spec.Without("_id"); !reflect.DeepEqual(got, SortSpec{{Field: "ts", Desc: true}}) {
+		t.Errorf("got %v without _id", got)
+	}
+	if got := spec.Without("name"); !reflect.DeepEqual(got, spec) {
+		t.Errorf("got %v without name", got)
+	}
+}
+
+func TestCompareSortValues(t *testing.T) {
+	n := func(s string) interface{} {
+		return json.Number(s)
+	}
+	asc := SortSpec{{Field: "a"}, {Field: "_id"}}
+	desc := SortSpec{{Field: "a", Desc: true}, {Field: "_id"}}
+
+	cases := []struct {
+		name string
+		spec SortSpec
+		a    []interface{}
+		b    []interface{}
+		want int
+	}{
+		{"equal", asc, []interface{}{n("1"), "x"}, []interface{}{n("1"), "x"}, 0},
+		{"numbers", asc, []interface{}{n("2"), "x"}, []interface{}{n("10"), "x"}, -1},
+		{"numbers desc", desc, []interface{}{n("2"), "x"}, []interface{}{n("10"), "x"}, 1},
+		{"floats", asc, []interface{}{n("1.5")}, []interface{}{n("1.25")}, 1},
+		{"integer and float", asc, []interface{}{n("2")}, []interface{}{n("1.5")}, 1},
+		{"longs beyond float64", asc, []interface{}{n("9007199254740993")}, []interface{}{n("9007199254740992")}, 1},
+		{"negative longs", asc, []interface{}{n("-9007199254740993")}, []interface{}{n("-9007199254740992")}, -1},
+		{"strings by bytes", asc, []interface{}{"B"}, []interface{}{"a"}, -1},
+		{"tiebreaker", asc, []interface{}{n("1"), "b"}, []interface{}{n("1"), "a"}, 1},
+		{"tiebreaker is asc in desc spec", desc, []interface{}{n("1"), "a"}, []interface{}{n("1"), "b"}, -1},
+		{"bools", asc, []interface{}{false}, []interface{}{true}, -1},
+		{"missing is last", asc, []interface{}{nil, "a"}, []interface{}{n("1"), "b"}, 1},
+		{"missing is last in desc", desc, []interface{}{nil, "a"}, []interface{}{n("1"), "b"}, 1},
+		{"value before missing in desc", desc, []interface{}{n("1"), "a"}, []interface{}{nil, "b"}, -1},
+		{"both missing", asc, []interface{}{nil, "a"}, []interface{}{nil, "b"}, -1},
+		{"shorter", asc, []interface{}{n("1")}, []interface{}{n("1"), "a"}, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := compareSortValues(c.spec, c.a, c.b); got != c.want {
+				t.Errorf("got %d, want %d", got, c.want)
+			}
+			// the order is antisymmetric
+			if got := compareSortValues(c.spec, c.b, c.a); got != -c.want {
+				t.Errorf("got %d after swapped, want %d", got, -c.want)
+			}
+		})
+	}
+}
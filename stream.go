@@ -0,0 +1,177 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	log "github.com/cihub/seelog"
+)
+
+// docStream iterate the documents of a scroll one by one, the next page is fetched on demand,
+// so only one page is held in memory
+type docStream struct {
+	api        ESAPI
+	scroll     ScrollAPI
+	scrollTime string
+	docs       []interface{}
+	pos        int
+	first      bool
+	count      int
+	total      int
+}
+
+func newDocStream(api ESAPI, indexNames string, scrollTime string, docBufferCount int, query SearchQuery,
+	filter map[string]interface{}, sort string, fields string) (*docStream, error) {
+	return newSlicedDocStream(api, indexNames, scrollTime, docBufferCount, query, filter, sort, 0, 1, fields)
+}
+
+// newSlicedDocStream iterate one slice of sliced scroll
+func newSlicedDocStream(api ESAPI, indexNames string, scrollTime string, docBufferCount int, query SearchQuery,
+	filter map[string]interface{}, sort string, slicedId int, maxSlicedCount int, fields string) (*docStream, error) {
+	scroll, err := api.NewScroll(indexNames, scrollTime, docBufferCount, query, filter, sort, slicedId, maxSlicedCount, fields)
+	if err != nil {
+		return nil, err
+	}
+	return &docStream{
+		api:        api,
+		scroll:     scroll,
+		scrollTime: scrollTime,
+		docs:       scroll.GetDocs(),
+		first:      true,
+		total:      scroll.GetHitsTotal(),
+	}, nil
+}
+
+// emptyDocStream is a stream without any document, ie: the index doesn't exist
+func emptyDocStream(api ESAPI) *docStream {
+	return &docStream{api: api, scroll: &EmptyScroll{}, first: true}
+}
+
+// Total return the total hits of the first page, which is kept even if the scroll is done
+func (s *docStream) Total() int {
+	return s.total
+}
+
+// Peek return the next document without moving forward, nil if there is no more
+func (s *docStream) Peek() (map[string]interface{}, error) {
+	for s.pos >= len(s.docs) {
+		// the first page of scan scroll is always empty
+		if len(s.docs) == 0 && !s.first {
+			return nil, nil
+		}
+		if len(s.scroll.GetScrollId()) == 0 {
+			return nil, nil
+		}
+
+		scroll, err := s.api.NextScroll(s.scrollTime, s.scroll.GetScrollId())
+		if err != nil {
+			return nil, err
+		}
+		s.scroll = scroll
+		s.docs = scroll.GetDocs()
+		s.pos = 0
+		s.first = false
+	}
+	return s.docs[s.pos].(map[string]interface{}), nil
+}
+
+// Next return the next document and move forward, nil if there is no more
+func (s *docStream) Next() (map[string]interface{}, error) {
+	doc, err := s.Peek()
+	if doc != nil {
+		s.pos++
+		s.count++
+	}
+	return doc, err
+}
+
+// Close release the scroll context
+func (s *docStream) Close() {
+	if err := s.api.DeleteScroll(s.scroll.GetScrollId()); err != nil {
+		log.Debug(err)
+	}
+}
+
+// lookupByIds read the documents of ids, which are the keys of docs, the found ones are returned by _id
+func lookupByIds(api ESAPI, indexNames string, scrollTime string, query SearchQuery, fields string, docs map[string]map[string]interface{}) (map[string]map[string]interface{}, error) {
+	ids := make([]interface{}, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	filter := map[string]interface{}{
+		"ids": map[string]interface{}{
+			"values": ids,
+		},
+	}
+	stream, err := newDocStream(api, indexNames, scrollTime, len(ids), query, filter, "", fields)
+	if err != nil {
+		return nil, fmt.Errorf("can not look up documents in %s, reason: %v", indexNames, err)
+	}
+	defer stream.Close()
+
+	found := make(map[string]map[string]interface{}, len(ids))
+	for {
+		doc, err := stream.Next()
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			return found, nil
+		}
+		id, _ := doc["_id"].(string)
+		found[id] = doc
+	}
+}
+
+// mergeJoinById walk the two streams sorted by `_id` together, fn is called with the documents
+// of the same `_id` from both sides, the side without it is nil
+func mergeJoinById(src *docStream, dst *docStream, fn func(id string, srcDoc map[string]interface{}, dstDoc map[string]interface{})) error {
+	for {
+		srcDoc, err := src.Peek()
+		if err != nil {
+			return err
+		}
+		dstDoc, err := dst.Peek()
+		if err != nil {
+			return err
+		}
+		if srcDoc == nil && dstDoc == nil {
+			return nil
+		}
+
+		var srcId, dstId string
+		if srcDoc != nil {
+			srcId, _ = srcDoc["_id"].(string)
+		}
+		if dstDoc != nil {
+			dstId, _ = dstDoc["_id"].(string)
+		}
+
+		switch {
+		case dstDoc == nil || (srcDoc != nil && srcId < dstId):
+			src.Next()
+			fn(srcId, srcDoc, nil)
+		case srcDoc == nil || dstId < srcId:
+			dst.Next()
+			fn(dstId, nil, dstDoc)
+		default:
+			src.Next()
+			dst.Next()
+			fn(srcId, srcDoc, dstDoc)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"io"
+	"os"
+)
+
+// syncKey return the typed sort values of a hit, both sides of sync are sorted and grouped by them
+func syncKey(doc map[string]interface{}) []interface{} {
+	sort, _ := doc["sort"].([]interface{})
+	return sort
+}
+
+func syncId(doc map[string]interface{}) string {
+	id, _ := doc["_id"].(string)
+	return id
+}
+
+// syncGroup is the documents of one side with the same sync key. Up to limit documents are
+// held in memory, the more are spilled into a temporary file under spillDir
+type syncGroup struct {
+	limit    int
+	spillDir string
+
+	docs  []map[string]interface{}
+	spill *os.File
+	w     *bufio.Writer
+	count int
+}
+
+// syncDocRef locate a document of group, in memory or by the offset in the spill file
+type syncDocRef struct {
+	doc    map[string]interface{}
+	offset int64
+	size   int
+}
+
+func newSyncGroup(limit int, spillDir string) *syncGroup {
+	return &syncGroup{limit: limit, spillDir: spillDir}
+}
+
+// readSyncGroup read all the following documents of stream with the key
+func readSyncGroup(stream *docStream, spec SortSpec, key []interface{}, limit int, spillDir string) (*syncGroup, error) {
+	group := newSyncGroup(limit, spillDir)
+	for {
+		doc, err := stream.Peek()
+		if err != nil {
+			group.Close()
+			return nil, err
+		}
+		if doc == nil || compareSortValues(spec, syncKey(doc), key) != 0 {
+			break
+		}
+		stream.Next()
+		if err := group.Add(doc); err != nil {
+			group.Close()
+			return nil, err
+		}
+	}
+	if err := group.flush(); err != nil {
+		group.Close()
+		return nil, err
+	}
+	return group, nil
+}
+
+// Add append a document, the group is spilled into disk once it's over the limit
+func (g *syncGroup) Add(doc map[string]interface{}) error {
+	g.count++
+	if g.spill == nil && len(g.docs) < g.limit {
+		g.docs = append(g.docs, doc)
+		return nil
+	}
+
+	if g.spill == nil {
+		if len(g.spillDir) == 0 {
+			return fmt.Errorf("more than %d documents have the same sort key %v, set --sync_spill_dir to spill them into disk, or increase --sync_buffer",
+				g.limit, syncKey(doc))
+		}
+		file, err := os.CreateTemp(g.spillDir, "esm-sync-*.json")
+		if err != nil {
+			return err
+		}
+		log.Debugf("spill documents of sort key %v into %s", syncKey(doc), file.Name())
+		g.spill = file
+		g.w = bufio.NewWriter(file)
+		for _, d := range g.docs {
+			if err := g.write(d); err != nil {
+				return err
+			}
+		}
+		g.docs = nil
+	}
+	return g.write(doc)
+}
+
+func (g *syncGroup) write(doc map[string]interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	g.w.Write(data)
+	return g.w.WriteByte('\n')
+}
+
+func (g *syncGroup) flush() error {
+	if g.w == nil {
+		return nil
+	}
+	return g.w.Flush()
+}
+
+// Each call fn with every document of group and where to find it again
+func (g *syncGroup) Each(fn func(doc map[string]interface{}, ref syncDocRef) error) error {
+	if g.spill == nil {
+		for _, doc := range g.docs {
+			if err := fn(doc, syncDocRef{doc: doc}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := g.spill.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(g.spill)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// numbers are json.Number like the documents in memory, or they are different from the other side
+		doc := map[string]interface{}{}
+		if err := DecodeJsonBytes(line, &doc); err != nil {
+			return err
+		}
+		if err := fn(doc, syncDocRef{offset: offset, size: len(line)}); err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// Get return the document of ref, it's read from the spill file if not in memory
+func (g *syncGroup) Get(ref syncDocRef) (map[string]interface{}, error) {
+	if ref.doc != nil {
+		return ref.doc, nil
+	}
+	line := make([]byte, ref.size)
+	if _, err := g.spill.ReadAt(line, ref.offset); err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	err := DecodeJsonBytes(line, &doc)
+	return doc, err
+}
+
+// Close remove the spill file
+func (g *syncGroup) Close() {
+	if g == nil || g.spill == nil {
+		return
+	}
+	g.spill.Close()
+	if err := os.Remove(g.spill.Name()); err != nil {
+		log.Debug(err)
+	}
+	g.spill = nil
+}
+
+// joinSyncGroups match the documents of source and target group by `_id`, fn is called with
+// both of them, the side without it is nil. Only the `_id` and position of target documents are
+// kept for a spilled group
+func joinSyncGroups(src *syncGroup, dst *syncGroup, fn func(id string, srcDoc map[string]interface{}, dstDoc map[string]interface{}) error) error {
+	// the most common case, one document of each side
+	if src.spill == nil && dst.spill == nil && len(src.docs) <= 1 && len(dst.docs) <= 1 {
+		switch {
+		case len(src.docs) == 0 && len(dst.docs) == 0:
+			return nil
+		case len(dst.docs) == 0:
+			return fn(syncId(src.docs[0]), src.docs[0], nil)
+		case len(src.docs) == 0:
+			return fn(syncId(dst.docs[0]), nil, dst.docs[0])
+		}
+		srcId := syncId(src.docs[0])
+		dstId := syncId(dst.docs[0])
+		if srcId == dstId {
+			return fn(srcId, src.docs[0], dst.docs[0])
+		}
+		if err := fn(srcId, src.docs[0], nil); err != nil {
+			return err
+		}
+		return fn(dstId, nil, dst.docs[0])
+	}
+
+	dstRefs := make(map[string]syncDocRef, dst.count)
+	err := dst.Each(func(doc map[string]interface{}, ref syncDocRef) error {
+		id := syncId(doc)
+		dstRefs[id] = ref
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = src.Each(func(doc map[string]interface{}, ref syncDocRef) error {
+		id := syncId(doc)
+		dstRef, ok := dstRefs[id]
+		if !ok {
+			return fn(id, doc, nil)
+		}
+		delete(dstRefs, id)
+		dstDoc, err := dst.Get(dstRef)
+		if err != nil {
+			return err
+		}
+		return fn(id, doc, dstDoc)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(dstRefs) == 0 {
+		return nil
+	}
+	return dst.Each(func(doc map[string]interface{}, ref syncDocRef) error {
+		id := syncId(doc)
+		if _, ok := dstRefs[id]; !ok {
+			return nil
+		}
+		delete(dstRefs, id)
+		return fn(id, nil, doc)
+	})
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testSyncDoc(t *testing.T, s string) map[string]interface{} {
+	doc := map[string]interface{}{}
+	if err := DecodeJsonBytes([]byte(s), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func testSyncGroup(t *testing.T, limit int, spillDir string, docs ...string) *syncGroup {
+	group := newSyncGroup(limit, spillDir)
+	for _, s := range docs {
+		if err := group.Add(testSyncDoc(t, s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := group.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+func TestJoinSyncGroups(t *testing.T) {
+	// longs beyond the precision of float64 must be kept as they are
+	srcDocs := []string{
+		`{"_id":"a","_source":{"n":9007199254740993,"f":1.5}}`,
+		`{"_id":"b","_source":{"n":1}}`,
+		`{"_id":"c","_source":{"n":2}}`,
+	}
+	dstDocs := []string{
+		`{"_id":"a","_source":{"n":9007199254740993,"f":1.5}}`,
+		`{"_id":"b","_source":{"n":2}}`,
+		`{"_id":"d","_source":{"n":3}}`,
+	}
+	want := []string{"a=same", "b=update", "c=add", "d=delete"}
+
+	cases := []struct {
+		name     string
+		srcLimit int
+		dstLimit int
+	}{
+		{"both in memory", 10, 10},
+		{"source spilled", 1, 10},
+		{"target spilled", 10, 1},
+		{"both spilled", 1, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := testSyncGroup(t, c.srcLimit, dir, srcDocs...)
+			defer src.Close()
+			dst := testSyncGroup(t, c.dstLimit, dir, dstDocs...)
+			defer dst.Close()
+
+			var got []string
+			err := joinSyncGroups(src, dst, func(id string, srcDoc map[string]interface{}, dstDoc map[string]interface{}) error {
+				switch {
+				case dstDoc == nil:
+					got = append(got, id+"=add")
+				case srcDoc == nil:
+					got = append(got, id+"=delete")
+				case reflect.DeepEqual(srcDoc["_source"], dstDoc["_source"]):
+					got = append(got, id+"=same")
+				default:
+					got = append(got, id+"=update")
+				}
+				for _, doc := range []map[string]interface{}{srcDoc, dstDoc} {
+					if doc == nil {
+						continue
+					}
+					if n, ok := doc["_source"].(map[string]interface{})["n"].(json.Number); !ok {
+						t.Errorf("%s: number is decoded as %T", id, doc["_source"].(map[string]interface{})["n"])
+					} else if id == "a" && n.String() != "9007199254740993" {
+						t.Errorf("%s: long is changed to %s", id, n)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSyncGroupSpill(t *testing.T) {
+	cases := []struct {
+		name     string
+		limit    int
+		spillDir bool
+		docs     int
+		spilled  bool
+		err      string
+	}{
+		{"under the limit", 3, false, 3, false, ""},
+		{"over the limit without spill dir", 3, false, 4, false, "more than 3 documents have the same sort key"},
+		{"over the limit", 3, true, 10, true, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := ""
+			if c.spillDir {
+				dir = t.TempDir()
+			}
+			group := newSyncGroup(c.limit, dir)
+			defer group.Close()
+
+			var err error
+			for i := 0; i < c.docs && err == nil; i++ {
+				err = group.Add(map[string]interface{}{
+					"_id":     strings.Repeat("x", i+1),
+					"_source": map[string]interface{}{"i": json.Number("1")},
+				})
+			}
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := group.flush(); err != nil {
+				t.Fatal(err)
+			}
+			if (group.spill != nil) != c.spilled {
+				t.Errorf("spilled: %v, want %v", group.spill != nil, c.spilled)
+			}
+
+			// every document can be read again by its ref
+			count := 0
+			err = group.Each(func(doc map[string]interface{}, ref syncDocRef) error {
+				count++
+				again, err := group.Get(ref)
+				if err != nil {
+					return err
+				}
+				if !reflect.DeepEqual(doc, again) {
+					t.Errorf("got %v by ref, want %v", again, doc)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != c.docs {
+				t.Errorf("got %d documents, want %d", count, c.docs)
+			}
+		})
+	}
+}
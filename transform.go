@@ -0,0 +1,532 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metadata of documents, the other field paths are in `_source`
+var docMetaFields = map[string]bool{
+	"_id":           true,
+	"_index":        true,
+	"_type":         true,
+	"_routing":      true,
+	"_version":      true,
+	"_seq_no":       true,
+	"_primary_term": true,
+	"_score":        true,
+}
+
+// Processor change a document in place, false is returned to drop the document
+type Processor interface {
+	Process(doc map[string]interface{}) (bool, error)
+}
+
+// Pipeline apply the processors to every document before output, in order
+type Pipeline struct {
+	processors []Processor
+}
+
+// Apply run the processors until a document is dropped, a nil pipeline keeps all the documents
+func (p *Pipeline) Apply(doc map[string]interface{}) (bool, error) {
+	if p == nil {
+		return true, nil
+	}
+	for _, processor := range p.processors {
+		keep, err := processor.Process(doc)
+		if err != nil || !keep {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Add append processors to the end of pipeline
+func (p *Pipeline) Add(processors ...Processor) {
+	p.processors = append(p.processors, processors...)
+}
+
+// Len return the number of processors
+func (p *Pipeline) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.processors)
+}
+
+// ParsePipeline build the pipeline from --filter, the legacy --rename and --skip flags, followed by
+// --transform and --transform_script
+func ParsePipeline(filters []string, renameFields string, skipFields string, transforms []string, script string) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+
+	// documents are filtered as they are read
+	if len(filters) > 0 {
+		processor, err := parseFilters(filters)
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Add(processor)
+	}
+
+	if len(renameFields) > 0 {
+		for _, kv := range strings.Split(renameFields, ",") {
+			fvs := strings.Split(kv, ":")
+			if len(fvs) != 2 {
+				return nil, fmt.Errorf("invalid rename field: %s, should be like old:new", kv)
+			}
+			oldField := strings.TrimSpace(fvs[0])
+			newField := strings.TrimSpace(fvs[1])
+			if oldField == "_type" {
+				// keep the type of document in _source
+				pipeline.Add(&typeProcessor{field: newField})
+			} else {
+				pipeline.Add(&renameProcessor{from: oldField, to: newField})
+			}
+		}
+	}
+
+	if len(skipFields) > 0 {
+		pipeline.Add(&removeProcessor{fields: splitFields(skipFields)})
+	}
+
+	for _, transform := range transforms {
+		processor, err := parseProcessor(transform)
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Add(processor)
+	}
+
+	if len(script) > 0 {
+		processor, err := newScriptProcessor(script)
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Add(processor)
+	}
+	return pipeline, nil
+}
+
+// parseProcessor parse one --transform, ie:
+//
+//	rename:user.name=>user.full_name
+//	copy:title=>title_raw
+//	remove:tmp,user.password
+//	set:migrated=true
+//	convert:price=>float
+//	date:created=>2006-01-02 15:04:05=>epoch_millis
+func parseProcessor(transform string) (Processor, error) {
+	parts := strings.SplitN(transform, ":", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[1])) == 0 {
+		return nil, fmt.Errorf("invalid transform: %s, should be like rename:old=>new", transform)
+	}
+	name := strings.TrimSpace(parts[0])
+	args := strings.TrimSpace(parts[1])
+
+	pair := func() (string, string, error) {
+		kv := strings.SplitN(args, "=>", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 || len(strings.TrimSpace(kv[1])) == 0 {
+			return "", "", fmt.Errorf("invalid transform: %s, should be like %s:from=>to", transform, name)
+		}
+		return strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]), nil
+	}
+
+	switch name {
+	case "rename":
+		from, to, err := pair()
+		return &renameProcessor{from: from, to: to}, err
+	case "copy":
+		from, to, err := pair()
+		return &copyProcessor{from: from, to: to}, err
+	case "remove":
+		return &removeProcessor{fields: splitFields(args)}, nil
+	case "set":
+		kv := strings.SplitN(args, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, fmt.Errorf("invalid transform: %s, should be like set:field=value", transform)
+		}
+		// json values keep their type, others are strings
+		var value interface{}
+		if err := DecodeJsonBytes([]byte(kv[1]), &value); err != nil {
+			value = kv[1]
+		}
+		return &setProcessor{field: strings.TrimSpace(kv[0]), value: value}, nil
+	case "convert":
+		field, typ, err := pair()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "int", "float", "string", "bool":
+		default:
+			return nil, fmt.Errorf("invalid transform: %s, unknown type %s, options: int, float, string, bool", transform, typ)
+		}
+		return &convertProcessor{field: field, typ: typ}, nil
+	case "date":
+		kv := strings.SplitN(args, "=>", 3)
+		if len(kv) < 2 || len(strings.TrimSpace(kv[0])) == 0 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid transform: %s, should be like date:field=>from_format[=>to_format]", transform)
+		}
+		processor := &dateProcessor{field: strings.TrimSpace(kv[0]), from: kv[1], to: "rfc3339"}
+		if len(kv) == 3 && len(kv[2]) > 0 {
+			processor.to = kv[2]
+		}
+		return processor, nil
+	}
+	return nil, fmt.Errorf("unknown transform: %s, options: rename, copy, remove, set, convert, date", name)
+}
+
+func splitFields(fields string) []string {
+	result := make([]string, 0)
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); len(field) > 0 {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+// docPath return the object holding the field and its key, a path is a field of `_source`
+// with dotted keys for nested objects, or a metadata field like `_id`. The missing objects
+// are created if create is true
+func docPath(doc map[string]interface{}, path string, create bool) (map[string]interface{}, string) {
+	if docMetaFields[path] {
+		return doc, path
+	}
+
+	obj, ok := doc["_source"].(map[string]interface{})
+	if !ok {
+		if !create {
+			return nil, ""
+		}
+		obj = map[string]interface{}{}
+		doc["_source"] = obj
+	}
+
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			if !create {
+				return nil, ""
+			}
+			next = map[string]interface{}{}
+			obj[key] = next
+		}
+		obj = next
+	}
+	return obj, keys[len(keys)-1]
+}
+
+func getDocField(doc map[string]interface{}, path string) (interface{}, bool) {
+	obj, key := docPath(doc, path, false)
+	if obj == nil {
+		return nil, false
+	}
+	v, ok := obj[key]
+	return v, ok
+}
+
+func setDocField(doc map[string]interface{}, path string, value interface{}) {
+	obj, key := docPath(doc, path, true)
+	obj[key] = value
+}
+
+func removeDocField(doc map[string]interface{}, path string) {
+	if obj, key := docPath(doc, path, false); obj != nil {
+		delete(obj, key)
+	}
+}
+
+type renameProcessor struct {
+	from string
+	to   string
+}
+
+func (p *renameProcessor) Process(doc map[string]interface{}) (bool, error) {
+	if v, ok := getDocField(doc, p.from); ok {
+		removeDocField(doc, p.from)
+		setDocField(doc, p.to, v)
+	}
+	return true, nil
+}
+
+type copyProcessor struct {
+	from string
+	to   string
+}
+
+func (p *copyProcessor) Process(doc map[string]interface{}) (bool, error) {
+	if v, ok := getDocField(doc, p.from); ok {
+		setDocField(doc, p.to, v)
+	}
+	return true, nil
+}
+
+// typeProcessor copy the type of document into a field, `_doc` for typeless documents
+type typeProcessor struct {
+	field string
+}
+
+func (p *typeProcessor) Process(doc map[string]interface{}) (bool, error) {
+	setDocField(doc, p.field, getDocType(doc))
+	return true, nil
+}
+
+type removeProcessor struct {
+	fields []string
+}
+
+func (p *removeProcessor) Process(doc map[string]interface{}) (bool, error) {
+	for _, field := range p.fields {
+		removeDocField(doc, field)
+	}
+	return true, nil
+}
+
+type setProcessor struct {
+	field string
+	value interface{}
+}
+
+func (p *setProcessor) Process(doc map[string]interface{}) (bool, error) {
+	setDocField(doc, p.field, p.value)
+	return true, nil
+}
+
+// convertProcessor change the type of field value, arrays are converted item by item
+type convertProcessor struct {
+	field string
+	typ   string
+}
+
+func (p *convertProcessor) Process(doc map[string]interface{}) (bool, error) {
+	v, ok := getDocField(doc, p.field)
+	if !ok || v == nil {
+		return true, nil
+	}
+
+	if items, ok := v.([]interface{}); ok {
+		result := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			converted, err := convertValue(item, p.typ)
+			if err != nil {
+				return false, fmt.Errorf("convert %s: %v", p.field, err)
+			}
+			result = append(result, converted)
+		}
+		setDocField(doc, p.field, result)
+		return true, nil
+	}
+
+	converted, err := convertValue(v, p.typ)
+	if err != nil {
+		return false, fmt.Errorf("convert %s: %v", p.field, err)
+	}
+	setDocField(doc, p.field, converted)
+	return true, nil
+}
+
+func convertValue(v interface{}, typ string) (interface{}, error) {
+	s := fmt.Sprint(v)
+	switch typ {
+	case "string":
+		if n, ok := v.(json.Number); ok {
+			return n.String(), nil
+		}
+		return s, nil
+	case "int":
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not a number", v)
+		}
+		return int64(f), nil
+	case "float":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not a number", v)
+		}
+		return f, nil
+	case "bool":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not a bool", v)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown type %s", typ)
+}
+
+// dateProcessor parse the date of field and format it again, the formats are epoch_millis, epoch_second,
+// rfc3339, or a go layout, ie: 2006-01-02 15:04:05
+type dateProcessor struct {
+	field string
+	from  string
+	to    string
+}
+
+func (p *dateProcessor) Process(doc map[string]interface{}) (bool, error) {
+	v, ok := getDocField(doc, p.field)
+	if !ok || v == nil {
+		return true, nil
+	}
+	t, err := parseDate(fmt.Sprint(v), p.from)
+	if err != nil {
+		return false, fmt.Errorf("date %s: %v", p.field, err)
+	}
+	setDocField(doc, p.field, formatDate(t, p.to))
+	return true, nil
+}
+
+func parseDate(s string, format string) (time.Time, error) {
+	switch format {
+	case "epoch_millis", "epoch_second":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s is not a number", s)
+		}
+		if format == "epoch_second" {
+			f *= 1000
+		}
+		return time.UnixMilli(int64(f)).UTC(), nil
+	case "rfc3339":
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return time.Parse(format, s)
+}
+
+func formatDate(t time.Time, format string) interface{} {
+	switch format {
+	case "epoch_millis":
+		return t.UnixMilli()
+	case "epoch_second":
+		return t.Unix()
+	case "rfc3339":
+		return t.Format(time.RFC3339Nano)
+	}
+	return t.Format(format)
+}
+
+// TransformStats count documents which were not output because of the pipeline
+type TransformStats struct {
+	Dropped int64
+	// failed to transform, written to --rejected_file
+	Rejected int64
+
+	// source index => documents dropped, for --verify
+	lock           sync.Mutex
+	droppedByIndex map[string]int64
+}
+
+func (s *TransformStats) addDropped(index string) {
+	atomic.AddInt64(&s.Dropped, 1)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.droppedByIndex == nil {
+		s.droppedByIndex = map[string]int64{}
+	}
+	s.droppedByIndex[index]++
+}
+
+// DroppedFrom return the number of documents dropped from the source indexes
+func (s *TransformStats) DroppedFrom(indexes []string) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dropped := int64(0)
+	for _, index := range indexes {
+		dropped += s.droppedByIndex[index]
+	}
+	return dropped
+}
+
+// transformDoc apply the pipeline to a document before output, the documents dropped or failed
+// are acknowledged to the checkpoint by seq at once, as they will never be written
+func (m *Migrator) transformDoc(doc map[string]interface{}, seq uint64) bool {
+	if m.Pipeline.Len() == 0 {
+		return true
+	}
+
+	// the document may be changed by processors before they fail
+	var original []byte
+	if m.Rejected != nil {
+		original, _ = json.Marshal(doc)
+	}
+
+	index, _ := doc["_index"].(string)
+	keep, err := m.Pipeline.Apply(doc)
+	if err == nil && keep {
+		err = validateDoc(doc)
+	}
+	if err != nil {
+		m.rejectDoc(original, doc["_id"], seq, err)
+		return false
+	}
+	if !keep {
+		m.TransformStats.addDropped(index)
+		m.Checkpoint.Ack(seq)
+	}
+	return keep
+}
+
+// validateDoc check the fields required by the outputs are still valid after transform,
+// ie: `set:_id=123` makes a number id, `remove:_index` drops the index
+func validateDoc(doc map[string]interface{}) error {
+	for _, field := range []string{"_id", "_index"} {
+		v, ok := doc[field]
+		if !ok {
+			return fmt.Errorf("%s is removed by transform", field)
+		}
+		if s, ok := v.(string); !ok {
+			return fmt.Errorf("%s should be a string, but it's %v(%T) after transform", field, v, v)
+		} else if field == "_index" && len(s) == 0 {
+			return fmt.Errorf("%s is empty after transform", field)
+		}
+	}
+	if v, ok := doc["_routing"]; ok && v != nil {
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("_routing should be a string, but it's %v(%T) after transform", v, v)
+		}
+	}
+	if _, ok := doc["_source"].(map[string]interface{}); !ok {
+		return fmt.Errorf("_source should be an object, but it's %v(%T) after transform", doc["_source"], doc["_source"])
+	}
+	return nil
+}
+
+// rejectDoc write the original of a document which can't be output to --rejected_file, and acknowledge
+// it to the checkpoint
+func (m *Migrator) rejectDoc(original []byte, id interface{}, seq uint64, err error) {
+	atomic.AddInt64(&m.TransformStats.Rejected, 1)
+	log.Warnf("reject document %v: %v", id, err)
+	if m.Rejected != nil {
+		if err := m.Rejected.WriteRejected(original, err.Error()); err != nil {
+			log.Error(err)
+		}
+	}
+	m.Checkpoint.Ack(seq)
+}
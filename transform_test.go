@@ -0,0 +1,231 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseProcessor(t *testing.T) {
+	cases := []struct {
+		transform string
+		err       string
+	}{
+		{transform: "rename:a=>b"},
+		{transform: "copy:a.b=>c"},
+		{transform: "remove:a, b.c"},
+		{transform: "set:a={\"x\":1}"},
+		{transform: "set:a="},
+		{transform: "convert:a=>int"},
+		{transform: "date:a=>2006-01-02=>epoch_millis"},
+		{transform: "date:a=>rfc3339"},
+		{transform: "rename", err: "should be like rename:old=>new"},
+		{transform: "rename:a", err: "should be like rename:from=>to"},
+		{transform: "copy:a=>", err: "should be like copy:from=>to"},
+		{transform: "set:=1", err: "should be like set:field=value"},
+		{transform: "convert:a=>long", err: "unknown type long"},
+		{transform: "date:a", err: "should be like date:field=>from_format[=>to_format]"},
+		{transform: "upper:a", err: "unknown transform: upper"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.transform, func(t *testing.T) {
+			_, err := parseProcessor(c.transform)
+			if len(c.err) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("got error %v, want %s", err, c.err)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	doc := `{"_id":"1","_index":"idx","_type":"log","_source":{"user":{"name":"me","age":"18"},"tags":["1","2"],"created":"2020-01-02","tmp":1}}`
+
+	cases := []struct {
+		name       string
+		filters    []string
+		rename     string
+		skip       string
+		transforms []string
+		keep       bool
+		want       string
+		err        string
+	}{
+		{name: "no processor", keep: true, want: doc},
+		{
+			name:       "rename and copy nested fields",
+			transforms: []string{"rename:user.name=>user.full_name", "copy:user.full_name=>owner"},
+			keep:       true,
+			want:       `{"_id":"1","_index":"idx","_type":"log","_source":{"user":{"full_name":"me","age":"18"},"owner":"me","tags":["1","2"],"created":"2020-01-02","tmp":1}}`,
+		},
+		{
+			name:       "remove and set",
+			transforms: []string{"remove:tmp,user.age,missing.field", "set:migrated=true", "set:meta.by=esm"},
+			keep:       true,
+			want:       `{"_id":"1","_index":"idx","_type":"log","_source":{"user":{"name":"me"},"tags":["1","2"],"created":"2020-01-02","migrated":true,"meta":{"by":"esm"}}}`,
+		},
+		{
+			name:       "convert values and arrays",
+			transforms: []string{"convert:user.age=>int", "convert:tags=>float", "convert:missing=>int"},
+			keep:       true,
+			want:       `{"_id":"1","_index":"idx","_type":"log","_source":{"user":{"name":"me","age":18},"tags":[1,2],"created":"2020-01-02","tmp":1}}`,
+		},
+		{
+			name:       "format date",
+			transforms: []string{"date:created=>2006-01-02=>epoch_millis"},
+			keep:       true,
+			want:       `{"_id":"1","_index":"idx","_type":"log","_source":{"user":{"name":"me","age":"18"},"tags":["1","2"],"created":1577923200000,"tmp":1}}`,
+		},
+		{
+			name:   "legacy rename and skip",
+			rename: "_type:doc_type,tmp:temp",
+			skip:   "tags",
+			keep:   true,
+			want:   `{"_id":"1","_index":"idx","_type":"log","_source":{"user":{"name":"me","age":"18"},"doc_type":"log","created":"2020-01-02","temp":1}}`,
+		},
+		{
+			name:       "metadata fields",
+			transforms: []string{"copy:_id=>doc_id", "set:_index=idx2"},
+			keep:       true,
+			want:       `{"_id":"1","_index":"idx2","_type":"log","_source":{"user":{"name":"me","age":"18"},"tags":["1","2"],"created":"2020-01-02","tmp":1,"doc_id":"1"}}`,
+		},
+		{name: "filtered before transform", filters: []string{"equals:user.name=you"}, transforms: []string{"set:a=1"}},
+		{name: "not a number", transforms: []string{"convert:user.name=>int"}, err: "convert user.name: me is not a number"},
+		{name: "invalid date", transforms: []string{"date:created=>epoch_millis"}, err: "date created: 2020-01-02 is not a number"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline, err := ParsePipeline(c.filters, c.rename, c.skip, c.transforms, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := testSyncDoc(t, doc)
+			keep, err := pipeline.Apply(d)
+			if len(c.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep != c.keep {
+				t.Fatalf("got keep %v, want %v", keep, c.keep)
+			}
+			if !keep {
+				return
+			}
+			assertJsonEqual(t, d, c.want)
+		})
+	}
+}
+
+func assertJsonEqual(t *testing.T, v interface{}, want string) {
+	t.Helper()
+	got, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// numbers are compared by their text, like longs beyond the precision of float64
+	var a, b interface{}
+	if err := DecodeJsonBytes(got, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeJsonBytes([]byte(want), &b); err != nil {
+		t.Fatal(err)
+	}
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	if string(x) != string(y) {
+		t.Errorf("got %s, want %s", x, y)
+	}
+}
+
+func TestTransformDocRejects(t *testing.T) {
+	cases := []struct {
+		name       string
+		transforms []string
+		reason     string
+	}{
+		{name: "number id", transforms: []string{"set:_id=123"}, reason: "_id should be a string, but it's 123(json.Number) after transform"},
+		{name: "converted id", transforms: []string{"convert:_id=>int"}, reason: "_id should be a string, but it's 1(int64) after transform"},
+		{name: "removed id", transforms: []string{"remove:_id"}, reason: "_id is removed by transform"},
+		{name: "removed index", transforms: []string{"remove:_index"}, reason: "_index is removed by transform"},
+		{name: "empty index", transforms: []string{"set:_index="}, reason: "_index is empty after transform"},
+		{name: "number routing", transforms: []string{"set:_routing=1"}, reason: "_routing should be a string"},
+		{name: "failed processor", transforms: []string{"convert:name=>bool"}, reason: "convert name: me is not a bool"},
+		{name: "valid", transforms: []string{"set:_id=\"2\"", "set:_routing=\"r\""}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline, err := ParsePipeline(nil, "", "", c.transforms, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "rejected.json")
+			rejected, err := NewDeadLetterWriter(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{Pipeline: pipeline, Rejected: rejected}
+
+			keep := m.transformDoc(testSyncDoc(t, `{"_id":"1","_index":"idx","_source":{"name":"me"}}`), 0)
+			rejected.Close()
+			if keep != (len(c.reason) == 0) {
+				t.Fatalf("got keep %v", keep)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.reason) == 0 {
+				if len(data) > 0 || m.TransformStats.Rejected > 0 {
+					t.Errorf("rejected a valid document: %s", data)
+				}
+				return
+			}
+			if m.TransformStats.Rejected != 1 {
+				t.Errorf("got %d rejected", m.TransformStats.Rejected)
+			}
+
+			// the original document is written with the reason
+			entry := map[string]interface{}{}
+			if err := DecodeJsonBytes(data, &entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry["_id"] != "1" || entry["_index"] != "idx" {
+				t.Errorf("got rejected document %s, want the original one", data)
+			}
+			if reason := entry["_error"].(map[string]interface{})["reason"].(string); !strings.Contains(reason, c.reason) {
+				t.Errorf("got reason %s, want %s", reason, c.reason)
+			}
+		})
+	}
+}
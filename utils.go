@@ -1,11 +1,6 @@
 package main
 
-import "fmt"
-
 func SubString(prim string, start int, end int) string {
-	if len(prim) == 0 {
-		fmt.Println("primitive str is empty")
-	}
 	if l := len(prim); l < end {
 		end = l
 	}
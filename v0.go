@@ -24,7 +24,8 @@ import (
 	log "github.com/cihub/seelog"
 	"io"
 	"io/ioutil"
-	"regexp"
+	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -34,6 +35,12 @@ type ESAPIV0 struct {
 	HttpProxy string //eg: http://proxyIp:proxyPort
 	Compress  bool
 	Version   *ClusterVersion
+
+	// the client of requests, with its own transport of HttpProxy
+	Client *http.Client
+
+	// fetch the `_version` or `_seq_no` of documents with scroll, used by --version_type
+	DocVersion string
 }
 
 func (s *ESAPIV0) ClusterHealth() *ClusterHealth {
@@ -67,31 +74,29 @@ func (s *ESAPIV0) ClusterVersion() *ClusterVersion {
 	return s.Version
 }
 
-func (s *ESAPIV0) Bulk(data *bytes.Buffer) error {
+func (s *ESAPIV0) Bulk(data *bytes.Buffer) (*BulkResponse, error) {
 	if data == nil || data.Len() == 0 {
 		log.Trace("data is empty, skip")
-		return nil
+		return &BulkResponse{}, nil
 	}
 	data.WriteRune('\n')
 	url := fmt.Sprintf("%s/_bulk", s.Host)
 
-	body, err := Request(s.Compress, "POST", url, s.Auth, data, s.HttpProxy)
+	body, err := Request(s.Compress, "POST", url, s.Auth, data, s.Client)
 
 	if err != nil {
 		data.Reset()
 		log.Error(err)
-		return err
+		return nil, err
 	}
-	response := BulkResponse{}
-	err = DecodeJson(body, &response)
-	if err == nil {
-		if response.Errors {
-			log.Warnf("bulk error:%s", body)
-		}
+	response := &BulkResponse{}
+	err = DecodeJson(body, response)
+	if err == nil && response.Errors {
+		log.Trace("bulk error:", body)
 	}
 
 	data.Reset()
-	return err
+	return response, err
 }
 
 func (s *ESAPIV0) GetIndexSettings(indexNames string) (*Indexes, error) {
@@ -120,7 +125,6 @@ func (s *ESAPIV0) GetIndexSettings(indexNames string) (*Indexes, error) {
 	err := json.Unmarshal([]byte(body), allSettings)
 	if err != nil {
 		panic(err)
-		return nil, err
 	}
 
 	return allSettings, nil
@@ -166,31 +170,8 @@ func (s *ESAPIV0) GetIndexMappings(copyAllIndexes bool, indexNames string) (stri
 	//              }
 	//      }
 
-	// if _all indexes limit the list of indexes to only these that we kept
-	// after looking at mappings
-	if indexNames == "_all" {
-
-		var newIndexes []string
-		for name := range idxs {
-			newIndexes = append(newIndexes, name)
-		}
-		indexNames = strings.Join(newIndexes, ",")
-
-	} else if strings.Contains(indexNames, "*") || strings.Contains(indexNames, "?") {
-
-		r, _ := regexp.Compile(indexNames)
-
-		//check index patterns
-		var newIndexes []string
-		for name := range idxs {
-			matched := r.MatchString(name)
-			if matched {
-				newIndexes = append(newIndexes, name)
-			}
-		}
-		indexNames = strings.Join(newIndexes, ",")
-
-	}
+	// _all and patterns are limited to the indexes we kept after looking at mappings
+	indexNames = resolvedIndexNames(indexNames, idxs)
 
 	i := 0
 	// wrap in mappings if moving from super old es
@@ -206,6 +187,20 @@ func (s *ESAPIV0) GetIndexMappings(copyAllIndexes bool, indexNames string) (stri
 	return indexNames, i, &idxs, nil
 }
 
+// resolvedIndexNames return the indexes of the _mapping response for _all or patterns, which were resolved
+// by the server, as patterns of -x can be comma separated, ie: logs-*,metrics-*
+func resolvedIndexNames(indexNames string, idxs Indexes) string {
+	if indexNames != "_all" && !strings.ContainsAny(indexNames, "*?") {
+		return indexNames
+	}
+	names := make([]string, 0, len(idxs))
+	for name := range idxs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
 func getEmptyIndexSettings() map[string]interface{} {
 	tempIndexSettings := map[string]interface{}{}
 	tempIndexSettings["settings"] = map[string]interface{}{}
@@ -232,19 +227,18 @@ func (s *ESAPIV0) UpdateIndexSettings(name string, settings map[string]interface
 			log.Debug("update static index settings: ", name)
 			staticIndexSettings := getEmptyIndexSettings()
 			staticIndexSettings["settings"].(map[string]interface{})["index"].(map[string]interface{})["analysis"] = set
-			Request(false, "POST", fmt.Sprintf("%s/%s/_close", s.Host, name), s.Auth, nil, s.HttpProxy)
+			Request(false, "POST", fmt.Sprintf("%s/%s/_close", s.Host, name), s.Auth, nil, s.Client)
 			//Post(fmt.Sprintf("%s/%s/_close", s.Host, name), s.Auth, "", s.HttpProxy)
 			body := bytes.Buffer{}
 			enc := json.NewEncoder(&body)
 			enc.Encode(staticIndexSettings)
-			bodyStr, err := Request(s.Compress, "PUT", url, s.Auth, &body, s.HttpProxy)
+			bodyStr, err := Request(s.Compress, "PUT", url, s.Auth, &body, s.Client)
 			if err != nil {
 				log.Error(bodyStr, err)
 				panic(err)
-				return err
 			}
 			delete(settings["settings"].(map[string]interface{})["index"].(map[string]interface{}), "analysis")
-			Request(false, "POST", fmt.Sprintf("%s/%s/_open", s.Host, name), s.Auth, nil, s.HttpProxy)
+			Request(false, "POST", fmt.Sprintf("%s/%s/_open", s.Host, name), s.Auth, nil, s.Client)
 			//Post(fmt.Sprintf("%s/%s/_open", s.Host, name), s.Auth, "", s.HttpProxy)
 		}
 	}
@@ -254,7 +248,7 @@ func (s *ESAPIV0) UpdateIndexSettings(name string, settings map[string]interface
 	body := bytes.Buffer{}
 	enc := json.NewEncoder(&body)
 	enc.Encode(settings)
-	_, err := Request(s.Compress, "PUT", url, s.Auth, &body, s.HttpProxy)
+	_, err := Request(s.Compress, "PUT", url, s.Auth, &body, s.Client)
 
 	return err
 }
@@ -272,7 +266,7 @@ func (s *ESAPIV0) UpdateIndexMapping(indexName string, settings map[string]inter
 		body := bytes.Buffer{}
 		enc := json.NewEncoder(&body)
 		enc.Encode(mapping)
-		res, err := Request(s.Compress, "POST", url, s.Auth, &body, s.HttpProxy)
+		res, err := Request(s.Compress, "POST", url, s.Auth, &body, s.Client)
 		if err != nil {
 			log.Error(url)
 			log.Error(body.String())
@@ -289,7 +283,7 @@ func (s *ESAPIV0) DeleteIndex(name string) (err error) {
 
 	url := fmt.Sprintf("%s/%s", s.Host, name)
 
-	Request(s.Compress, "DELETE", url, s.Auth, nil, s.HttpProxy)
+	Request(s.Compress, "DELETE", url, s.Auth, nil, s.Client)
 
 	log.Debug("delete index: ", name)
 
@@ -306,7 +300,7 @@ func (s *ESAPIV0) CreateIndex(name string, settings map[string]interface{}) (err
 
 	url := fmt.Sprintf("%s/%s", s.Host, name)
 
-	resp, err := Request(s.Compress, "PUT", url, s.Auth, &body, s.HttpProxy)
+	resp, err := Request(s.Compress, "PUT", url, s.Auth, &body, s.Client)
 	log.Debugf("response: %s", resp)
 
 	return err
@@ -318,7 +312,7 @@ func (s *ESAPIV0) Refresh(name string) (err error) {
 
 	url := fmt.Sprintf("%s/%s/_refresh", s.Host, name)
 
-	resp, err := Request(false, "POST", url, s.Auth, nil, s.HttpProxy)
+	resp, err := Request(false, "POST", url, s.Auth, nil, s.Client)
 	log.Infof("refresh resp=%s, err=%+v", resp, err)
 	//resp, _, _ := Post(url, s.Auth, "", s.HttpProxy)
 	//if resp != nil && resp.Body != nil {
@@ -329,34 +323,82 @@ func (s *ESAPIV0) Refresh(name string) (err error) {
 	return nil
 }
 
-func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-	slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
-
-	// curl -XGET 'http://es-0.9:9200/_search?search_type=scan&scroll=10m&size=50'
-	url := fmt.Sprintf("%s/%s/_search?search_type=scan&scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
+// Count return the number of documents matched the query, -q or --query_dsl, all documents if query is empty
+func (s *ESAPIV0) Count(indexNames string, query SearchQuery) (int, error) {
+	url := fmt.Sprintf("%s/%s/_count", s.Host, indexNames)
 
 	var jsonBody []byte
-	if len(query) > 0 || len(fields) > 0 {
-		queryBody := map[string]interface{}{}
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
+	if !query.IsEmpty() {
+		var err error
+		jsonBody, err = json.Marshal(newScrollQueryBody(query, nil, "", 0, 0, ""))
+		if err != nil {
+			return 0, err
 		}
+	}
 
-		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
-		}
+	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client)
+	if err != nil {
+		return 0, err
+	}
 
-		if len(sort) > 0 {
-			sortFields := make([]string, 0)
-			sortFields = append(sortFields, sort)
-			queryBody["sort"] = sortFields
-		}
+	count := struct {
+		Count int `json:"count"`
+	}{}
+	if err := DecodeJson(body, &count); err != nil {
+		return 0, err
+	}
+	return count.Count, nil
+}
+
+// MaxValue return the sort value of the max field value, nil if no document has the field
+func (s *ESAPIV0) MaxValue(indexNames string, field string, query SearchQuery) (interface{}, error) {
+	url := fmt.Sprintf("%s/%s/_search", s.Host, indexNames)
+
+	queryBody := newScrollQueryBody(query, map[string]interface{}{
+		"exists": map[string]interface{}{"field": field},
+	}, "", 0, 0, "")
+	queryBody["size"] = 1
+	queryBody["_source"] = false
+	queryBody["sort"] = []interface{}{
+		map[string]interface{}{field: map[string]interface{}{"order": "desc"}},
+	}
+	jsonBody, err := json.Marshal(queryBody)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	result := struct {
+		Hits struct {
+			Docs []struct {
+				Sort []interface{} `json:"sort"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}{}
+	if err := DecodeJson(body, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Hits.Docs) == 0 || len(result.Hits.Docs[0].Sort) == 0 {
+		return nil, nil
+	}
+	return result.Hits.Docs[0].Sort[0], nil
+}
+
+func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+	sort string, slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+
+	// curl -XGET 'http://es-0.9:9200/_search?search_type=scan&scroll=10m&size=50'
+	url := fmt.Sprintf("%s/%s/_search?search_type=scan&scroll=%s&size=%d%s", s.Host, indexNames, scrollTime, docBufferCount,
+		s.docVersionParams())
+
+	var jsonBody []byte
+	if !query.IsEmpty() || filter != nil || len(fields) > 0 {
+		// sliced scroll is not supported before 5.0
+		queryBody := newScrollQueryBody(query, filter, sort, 0, 0, fields)
 
 		jsonBody, err = json.Marshal(queryBody)
 		if err != nil {
@@ -366,7 +408,7 @@ func (s *ESAPIV0) NewScroll(indexNames string, scrollTime string, docBufferCount
 
 	}
 	//resp, body, errs := Post(url, s.Auth,jsonBody,s.HttpProxy)
-	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.HttpProxy)
+	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client)
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -386,7 +428,7 @@ func (s *ESAPIV0) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 	//  curl -XGET 'http://es-0.9:9200/_search/scroll?scroll=5m'
 	id := bytes.NewBufferString(scrollId)
 	url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
-	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
+	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.Client)
 
 	if err != nil {
 		log.Error(err)
@@ -408,7 +450,7 @@ func (s *ESAPIV0) DeleteScroll(scrollId string) error {
 	id := bytes.NewBufferString(scrollId)
 	url := fmt.Sprintf("%s/_search/scroll?scroll_id=%s", s.Host, id)
 	if len(scrollId) > 0 {
-		_, err := Request(false, "DELETE", url, s.Auth, nil, s.HttpProxy)
+		_, err := Request(false, "DELETE", url, s.Auth, nil, s.Client)
 		if err != nil {
 			log.Error(err)
 			return err
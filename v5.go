@@ -21,47 +21,20 @@ import (
 	"encoding/json"
 	"fmt"
 	log "github.com/cihub/seelog"
-	"strings"
 )
 
 type ESAPIV5 struct {
 	ESAPIV0
 }
 
-func (s *ESAPIV5) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-	slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
-	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
+func (s *ESAPIV5) NewScroll(indexNames string, scrollTime string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+	sort string, slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d%s", s.Host, indexNames, scrollTime, docBufferCount,
+		s.docVersionParams())
 
 	var jsonBody []byte
-	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 {
-		queryBody := map[string]interface{}{}
-
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
-		}
-
-		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
-		}
-
-		if len(sort) > 0 {
-			sortFields := make([]string, 0)
-			sortFields = append(sortFields, sort)
-			queryBody["sort"] = sortFields
-		}
-
-		if maxSlicedCount > 1 {
-			log.Tracef("sliced scroll, %d of %d", slicedId, maxSlicedCount)
-			queryBody["slice"] = map[string]interface{}{}
-			queryBody["slice"].(map[string]interface{})["id"] = slicedId
-			queryBody["slice"].(map[string]interface{})["max"] = maxSlicedCount
-		}
+	if !query.IsEmpty() || filter != nil || maxSlicedCount > 0 || len(fields) > 0 {
+		queryBody := newScrollQueryBody(query, filter, sort, slicedId, maxSlicedCount, fields)
 
 		jsonBody, err = json.Marshal(queryBody)
 		if err != nil {
@@ -69,7 +42,7 @@ func (s *ESAPIV5) NewScroll(indexNames string, scrollTime string, docBufferCount
 		}
 	}
 
-	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.HttpProxy)
+	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client)
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -90,7 +63,7 @@ func (s *ESAPIV5) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 
 	url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
 
-	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
+	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.Client)
 
 	// decode elasticsearch scroll response
 	scroll := &Scroll{}
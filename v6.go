@@ -24,8 +24,6 @@ import (
 	log "github.com/cihub/seelog"
 	"io"
 	"io/ioutil"
-	"regexp"
-	"strings"
 	//"infini.sh/framework/core/util"
 )
 
@@ -33,40 +31,14 @@ type ESAPIV6 struct {
 	ESAPIV5
 }
 
-func (s *ESAPIV6) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-	slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
-	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
+func (s *ESAPIV6) NewScroll(indexNames string, scrollTime string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+	sort string, slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d%s", s.Host, indexNames, scrollTime, docBufferCount,
+		s.docVersionParams())
 
 	var jsonBody []byte
-	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 {
-		queryBody := map[string]interface{}{}
-
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
-		}
-
-		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
-		}
-
-		if len(sort) > 0 {
-			sortFields := make([]string, 0)
-			sortFields = append(sortFields, sort)
-			queryBody["sort"] = sortFields
-		}
-
-		if maxSlicedCount > 1 {
-			log.Tracef("sliced scroll, %d of %d", slicedId, maxSlicedCount)
-			queryBody["slice"] = map[string]interface{}{}
-			queryBody["slice"].(map[string]interface{})["id"] = slicedId
-			queryBody["slice"].(map[string]interface{})["max"] = maxSlicedCount
-		}
+	if !query.IsEmpty() || filter != nil || maxSlicedCount > 0 || len(fields) > 0 {
+		queryBody := newScrollQueryBody(query, filter, sort, slicedId, maxSlicedCount, fields)
 
 		jsonBody, err = json.Marshal(queryBody)
 		if err != nil {
@@ -75,7 +47,7 @@ func (s *ESAPIV6) NewScroll(indexNames string, scrollTime string, docBufferCount
 		}
 	}
 
-	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.HttpProxy)
+	body, err := Request(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client)
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -95,7 +67,7 @@ func (s *ESAPIV6) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 	id := bytes.NewBufferString(scrollId)
 
 	url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
-	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
+	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.Client)
 
 	// decode elasticsearch scroll response
 	scroll := &Scroll{}
@@ -134,31 +106,8 @@ func (s *ESAPIV6) GetIndexMappings(copyAllIndexes bool, indexNames string) (stri
 		return "", 0, nil, er
 	}
 
-	// if _all indexes limit the list of indexes to only these that we kept
-	// after looking at mappings
-	if indexNames == "_all" {
-
-		var newIndexes []string
-		for name := range idxs {
-			newIndexes = append(newIndexes, name)
-		}
-		indexNames = strings.Join(newIndexes, ",")
-
-	} else if strings.Contains(indexNames, "*") || strings.Contains(indexNames, "?") {
-
-		r, _ := regexp.Compile(indexNames)
-
-		//check index patterns
-		var newIndexes []string
-		for name := range idxs {
-			matched := r.MatchString(name)
-			if matched {
-				newIndexes = append(newIndexes, name)
-			}
-		}
-		indexNames = strings.Join(newIndexes, ",")
-
-	}
+	// _all and patterns are limited to the indexes we kept after looking at mappings
+	indexNames = resolvedIndexNames(indexNames, idxs)
 
 	i := 0
 	// wrap in mappings if moving from super old es
@@ -189,7 +138,7 @@ func (s *ESAPIV6) UpdateIndexMapping(indexName string, settings map[string]inter
 		body := bytes.Buffer{}
 		enc := json.NewEncoder(&body)
 		enc.Encode(settings)
-		res, err := Request(s.Compress, "POST", url, s.Auth, &body, s.HttpProxy)
+		res, err := Request(s.Compress, "POST", url, s.Auth, &body, s.Client)
 		if err != nil {
 			log.Error(url)
 			log.Error(settings)
@@ -24,48 +24,20 @@ import (
 	log "github.com/cihub/seelog"
 	"io"
 	"io/ioutil"
-	"regexp"
-	"strings"
 )
 
 type ESAPIV7 struct {
 	ESAPIV6
 }
 
-func (s *ESAPIV7) NewScroll(indexNames string, scrollTime string, docBufferCount int, query string, sort string,
-	slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
-	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d", s.Host, indexNames, scrollTime, docBufferCount)
+func (s *ESAPIV7) NewScroll(indexNames string, scrollTime string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+	sort string, slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d%s", s.Host, indexNames, scrollTime, docBufferCount,
+		s.docVersionParams())
 
 	jsonBody := ""
-	if len(query) > 0 || maxSlicedCount > 0 || len(fields) > 0 {
-		queryBody := map[string]interface{}{}
-
-		if len(fields) > 0 {
-			if !strings.Contains(fields, ",") {
-				queryBody["_source"] = fields
-			} else {
-				queryBody["_source"] = strings.Split(fields, ",")
-			}
-		}
-
-		if len(query) > 0 {
-			queryBody["query"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"] = map[string]interface{}{}
-			queryBody["query"].(map[string]interface{})["query_string"].(map[string]interface{})["query"] = query
-		}
-
-		if len(sort) > 0 {
-			sortFields := make([]string, 0)
-			sortFields = append(sortFields, sort)
-			queryBody["sort"] = sortFields
-		}
-
-		if maxSlicedCount > 1 {
-			log.Tracef("sliced scroll, %d of %d", slicedId, maxSlicedCount)
-			queryBody["slice"] = map[string]interface{}{}
-			queryBody["slice"].(map[string]interface{})["id"] = slicedId
-			queryBody["slice"].(map[string]interface{})["max"] = maxSlicedCount
-		}
+	if !query.IsEmpty() || filter != nil || maxSlicedCount > 0 || len(fields) > 0 {
+		queryBody := newScrollQueryBody(query, filter, sort, slicedId, maxSlicedCount, fields)
 
 		jsonArray, err := json.Marshal(queryBody)
 		if err != nil {
@@ -76,7 +48,7 @@ func (s *ESAPIV7) NewScroll(indexNames string, scrollTime string, docBufferCount
 		}
 	}
 
-	body, errs := Request(false, "POST", url, s.Auth, bytes.NewBufferString(jsonBody), s.HttpProxy)
+	body, errs := Request(false, "POST", url, s.Auth, bytes.NewBufferString(jsonBody), s.Client)
 	//resp, body, errs := Post(url, s.Auth, jsonBody, s.HttpProxy)
 
 	//if resp != nil && resp.Body != nil {
@@ -114,7 +86,7 @@ func (s *ESAPIV7) NextScroll(scrollTime string, scrollId string) (ScrollAPI, err
 	id := bytes.NewBufferString(scrollId)
 
 	url := fmt.Sprintf("%s/_search/scroll?scroll=%s&scroll_id=%s", s.Host, scrollTime, id)
-	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.HttpProxy)
+	body, err := Request(s.Compress, "GET", url, s.Auth, nil, s.Client)
 
 	if err != nil {
 		//log.Error(errs)
@@ -157,37 +129,13 @@ func (s *ESAPIV7) GetIndexMappings(copyAllIndexes bool, indexNames string) (stri
 		return "", 0, nil, er
 	}
 
-	// if _all indexes limit the list of indexes to only these that we kept
-	// after looking at mappings
-	if indexNames == "_all" {
-
-		var newIndexes []string
-		for name := range idxs {
-			newIndexes = append(newIndexes, name)
-		}
-		indexNames = strings.Join(newIndexes, ",")
-
-	} else if strings.Contains(indexNames, "*") || strings.Contains(indexNames, "?") {
-
-		r, _ := regexp.Compile(indexNames)
-
-		//check index patterns
-		var newIndexes []string
-		for name := range idxs {
-			matched := r.MatchString(name)
-			if matched {
-				newIndexes = append(newIndexes, name)
-			}
-		}
-		indexNames = strings.Join(newIndexes, ",")
-
-	}
+	// _all and patterns are limited to the indexes we kept after looking at mappings
+	indexNames = resolvedIndexNames(indexNames, idxs)
 
 	i := 0
 	// wrap in mappings if moving from super old es
 	for name, idx := range idxs {
 		i++
-		fmt.Println(name)
 		if _, ok := idx.(map[string]interface{})["mappings"]; !ok {
 			(idxs)[name] = map[string]interface{}{
 				"mappings": idx,
@@ -202,6 +150,8 @@ func (s *ESAPIV7) UpdateIndexMapping(indexName string, settings map[string]inter
 
 	log.Debug("start update mapping: ", indexName, settings)
 
+	// mappings from 6.x may still be wrapped by type name
+	settings = unwrapMappingType(settings)
 	delete(settings, "dynamic_templates")
 
 	//for name, mapping := range settings {
@@ -213,7 +163,7 @@ func (s *ESAPIV7) UpdateIndexMapping(indexName string, settings map[string]inter
 	body := bytes.Buffer{}
 	enc := json.NewEncoder(&body)
 	enc.Encode(settings)
-	res, err := Request(s.Compress, "POST", url, s.Auth, &body, s.HttpProxy)
+	res, err := Request(s.Compress, "POST", url, s.Auth, &body, s.Client)
 	if err != nil {
 		log.Error(url)
 		log.Error(body.String())
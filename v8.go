@@ -0,0 +1,198 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+)
+
+// compatibility headers, make sure 8.x answers in 8.x format
+var v8Headers = map[string]string{
+	"Accept":       "application/vnd.elasticsearch+json;compatible-with=8",
+	"Content-Type": "application/vnd.elasticsearch+json;compatible-with=8",
+}
+
+var v8BulkHeaders = map[string]string{
+	"Accept":       "application/vnd.elasticsearch+json;compatible-with=8",
+	"Content-Type": "application/vnd.elasticsearch+x-ndjson;compatible-with=8",
+}
+
+type ESAPIV8 struct {
+	ESAPIV7
+}
+
+// removeBulkTypes drop the `_type` of every bulk action, types were removed in 8.x
+func removeBulkTypes(data *bytes.Buffer) error {
+	records, err := ParseBulkRecords(data.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		delete(record.Meta, "_type")
+	}
+	// the records are slices of data, write them into another buffer before data is reused
+	buf := bytes.Buffer{}
+	buf.Grow(data.Len())
+	if err := WriteBulkRecords(&buf, records); err != nil {
+		return err
+	}
+	data.Reset()
+	data.Write(buf.Bytes())
+	return nil
+}
+
+func (s *ESAPIV8) Bulk(data *bytes.Buffer) (*BulkResponse, error) {
+	if data == nil || data.Len() == 0 {
+		log.Trace("data is empty, skip")
+		return &BulkResponse{}, nil
+	}
+
+	err := removeBulkTypes(data)
+	if err != nil {
+		data.Reset()
+		log.Error(err)
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/_bulk", s.Host)
+	body, err := RequestWithHeaders(s.Compress, "POST", url, s.Auth, data, s.Client, v8BulkHeaders)
+	if err != nil {
+		data.Reset()
+		log.Error(err)
+		return nil, err
+	}
+	response := &BulkResponse{}
+	err = DecodeJson(body, response)
+	if err == nil && response.Errors {
+		log.Trace("bulk error:", body)
+	}
+
+	data.Reset()
+	return response, err
+}
+
+func (s *ESAPIV8) NewScroll(indexNames string, scrollTime string, docBufferCount int, query SearchQuery, filter map[string]interface{},
+	sort string, slicedId int, maxSlicedCount int, fields string) (scroll ScrollAPI, err error) {
+	// without track_total_hits, hits.total stops at 10000
+	url := fmt.Sprintf("%s/%s/_search?scroll=%s&size=%d&track_total_hits=true%s", s.Host, indexNames, scrollTime, docBufferCount,
+		s.docVersionParams())
+
+	// fielddata on _id is disabled by default since 8.0, fallback to index order
+	if spec := sortSpecOf(sort); spec.Has("_id") {
+		log.Debug("sort by _id is not allowed in 8.x, drop it from the sort")
+		if spec = spec.Without("_id"); len(spec) == 0 {
+			spec = SortSpec{{Field: "_doc"}}
+		}
+		sort = spec.String()
+	}
+	queryBody := newScrollQueryBody(query, filter, sort, slicedId, maxSlicedCount, fields)
+
+	jsonBody, err := json.Marshal(queryBody)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	body, err := RequestWithHeaders(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client, v8Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Trace("new scroll,", body)
+
+	scroll = &ScrollV7{}
+	err = DecodeJson(body, scroll)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return scroll, err
+}
+
+func (s *ESAPIV8) NextScroll(scrollTime string, scrollId string) (ScrollAPI, error) {
+	// pass scroll id in the body, it may be too long for the url
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"scroll":    scrollTime,
+		"scroll_id": scrollId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/_search/scroll", s.Host)
+	body, err := RequestWithHeaders(s.Compress, "POST", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client, v8Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode elasticsearch scroll response
+	scroll := &ScrollV7{}
+	err = DecodeJson(body, &scroll)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return scroll, nil
+}
+
+func (s *ESAPIV8) DeleteScroll(scrollId string) error {
+	if len(scrollId) == 0 {
+		return nil
+	}
+
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"scroll_id": []string{scrollId},
+	})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/_search/scroll", s.Host)
+	_, err = RequestWithHeaders(false, "DELETE", url, s.Auth, bytes.NewBuffer(jsonBody), s.Client, v8Headers)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (s *ESAPIV8) UpdateIndexMapping(indexName string, settings map[string]interface{}) error {
+
+	log.Debug("start update mapping: ", indexName, settings)
+
+	// mappings from 6.x may still be wrapped by type name
+	settings = unwrapMappingType(settings)
+
+	url := fmt.Sprintf("%s/%s/_mapping", s.Host, indexName)
+
+	body := bytes.Buffer{}
+	enc := json.NewEncoder(&body)
+	enc.Encode(settings)
+	res, err := RequestWithHeaders(s.Compress, "PUT", url, s.Auth, &body, s.Client, v8Headers)
+	if err != nil {
+		log.Error(url)
+		log.Error(body.String())
+		log.Error(err, res)
+		return err
+	}
+	return nil
+}
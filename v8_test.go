@@ -0,0 +1,90 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemoveBulkTypes(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "index with type",
+			in: `{"index":{"_index":"a","_type":"doc","_id":"1"}}
+{"v":1}
+`,
+			want: `{"index":{"_id":"1","_index":"a"}}
+{"v":1}
+`,
+		},
+		{
+			name: "escaped id and source",
+			in: `{"index":{"_index":"a","_type":"doc","_id":"<&> \"quoted\" \\ slash"}}
+{"html":"<b>&amp;</b>","text":"line\nbreak \"q\" \\ é"}
+{"delete":{"_index":"a","_type":"doc","_id":"<&>"}}
+{"create":{"_index":"a","_type":"doc","_id":"x","routing":"r"}}
+{"nested":{"a":[1,2.5,"x"]}}
+`,
+			want: `{"index":{"_id":"<&> \"quoted\" \\ slash","_index":"a"}}
+{"html":"<b>&amp;</b>","text":"line\nbreak \"q\" \\ é"}
+{"delete":{"_id":"<&>","_index":"a"}}
+{"create":{"_id":"x","_index":"a","routing":"r"}}
+{"nested":{"a":[1,2.5,"x"]}}
+`,
+		},
+		{
+			// the encoder always escapes U+2028, the rewritten line is longer than the original one
+			name: "longer after rewrite",
+			in:   strings.Repeat("{\"index\":{\"_index\":\"a\",\"_id\":\"\u2028\u2028\u2028\"}}\n{\"v\":\"<&>\"}\n", 20),
+			want: strings.Repeat(`{"index":{"_id":"\u2028\u2028\u2028","_index":"a"}}`+"\n"+`{"v":"<&>"}`+"\n", 20),
+		},
+		{
+			name: "many records reuse the buffer",
+			in:   strings.Repeat(`{"index":{"_index":"idx-with-a-long-name","_type":"_doc","_id":"<&>"}}`+"\n"+`{"v":"<&>"}`+"\n", 100),
+			want: strings.Repeat(`{"index":{"_id":"<&>","_index":"idx-with-a-long-name"}}`+"\n"+`{"v":"<&>"}`+"\n", 100),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data := bytes.NewBufferString(c.in)
+			if err := removeBulkTypes(data); err != nil {
+				t.Fatal(err)
+			}
+			if data.String() != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", data.String(), c.want)
+			}
+
+			// the result is still a valid bulk body with the same records
+			records, err := ParseBulkRecords(data.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, _ := ParseBulkRecords([]byte(c.want))
+			if !reflect.DeepEqual(records, expected) {
+				t.Errorf("records changed after round trip: %v", records)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"strings"
+)
+
+// max ids of every kind printed in the verification report
+const verifyMaxReportIds = 100
+
+// VerifyReport is the result of comparing one target index with its source indexes
+type VerifyReport struct {
+	SourceIndexes string
+	TargetIndex   string
+	SourceCount   int
+	TargetCount   int
+	// dropped by --filter or --transform_script, not expected in target
+	DroppedCount int
+
+	Missing    []string
+	Extra      []string
+	Mismatched []string
+
+	MissingCount    int
+	ExtraCount      int
+	MismatchedCount int
+}
+
+func (r *VerifyReport) OK() bool {
+	return r.SourceCount-r.DroppedCount == r.TargetCount && r.MissingCount == 0 && r.ExtraCount == 0 && r.MismatchedCount == 0
+}
+
+// sourceHash return the hash of `_source`, the keys of json objects are sorted by json.Marshal
+func sourceHash(source interface{}) string {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return ""
+	}
+	hash := sha1.Sum(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// verifyMigration compare the document counts of source and target indexes, with --verify_hash
+// the hash of `_source` of every document is compared too, by walking both sides sorted by `_id`,
+// or looking up the ids of every page on the other side for 8.x, which disallows sorting by `_id`
+func (m *Migrator) verifyMigration() error {
+	c := m.Config
+	indexNames, _, _, err := m.SourceESAPI.GetIndexMappings(c.CopyAllIndexes, c.SourceIndexNames)
+	if err != nil {
+		return err
+	}
+
+	targetNames, targets := m.groupByTargetIndex(indexNames)
+
+	log.Info("start verification..")
+	failed := 0
+	for _, target := range targetNames {
+		report := &VerifyReport{SourceIndexes: strings.Join(targets[target], ","), TargetIndex: target}
+
+		if err := m.verifyIndex(report); err != nil {
+			log.Errorf("verify %s => %s failed: %v", report.SourceIndexes, target, err)
+			failed++
+			continue
+		}
+		m.printVerifyReport(report)
+		if !report.OK() {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("verification failed, %d of %d target indexes are different from source", failed, len(targetNames))
+	}
+	log.Infof("verification passed, %d target indexes", len(targetNames))
+	return nil
+}
+
+func (m *Migrator) verifyIndex(report *VerifyReport) error {
+	c := m.Config
+
+	// make all the documents bulked visible
+	m.TargetESAPI.Refresh(report.TargetIndex)
+
+	var err error
+	report.SourceCount, err = m.SourceESAPI.Count(report.SourceIndexes, c.SearchQuery())
+	if err != nil {
+		return err
+	}
+	report.TargetCount, err = m.TargetESAPI.Count(report.TargetIndex, SearchQuery{})
+	if err != nil {
+		return err
+	}
+	report.DroppedCount = int(m.TransformStats.DroppedFrom(strings.Split(report.SourceIndexes, ",")))
+
+	if !c.VerifyHash {
+		return nil
+	}
+
+	sortById := true
+	for _, api := range []ESAPI{m.SourceESAPI, m.TargetESAPI} {
+		version := api.ClusterVersion()
+		if version.IsOpenSearch() {
+			continue
+		}
+		if version.MajorVersion() < 5 {
+			return errors.New("--verify_hash is not supported before elasticsearch 5.0")
+		}
+		if version.MajorVersion() >= 8 {
+			sortById = false
+		}
+	}
+
+	// the documents dropped by --filter are not expected in target
+	kept := func(srcDoc map[string]interface{}) bool {
+		keep, err := m.Pipeline.Apply(srcDoc)
+		return err == nil && keep
+	}
+	compare := func(id string, srcDoc map[string]interface{}, dstDoc map[string]interface{}) {
+		switch {
+		case srcDoc == nil && dstDoc == nil:
+		case dstDoc == nil:
+			report.MissingCount++
+			if len(report.Missing) < verifyMaxReportIds {
+				report.Missing = append(report.Missing, id)
+			}
+		case srcDoc == nil:
+			report.ExtraCount++
+			if len(report.Extra) < verifyMaxReportIds {
+				report.Extra = append(report.Extra, id)
+			}
+		case sourceHash(srcDoc["_source"]) != sourceHash(dstDoc["_source"]):
+			report.MismatchedCount++
+			if len(report.Mismatched) < verifyMaxReportIds {
+				report.Mismatched = append(report.Mismatched, id)
+			}
+		}
+	}
+
+	if !sortById {
+		// the source documents are compared with the ones of target, then the target documents not in source are extra
+		err := m.verifyByLookup(m.SourceESAPI, report.SourceIndexes, c.SearchQuery(), m.TargetESAPI, report.TargetIndex, SearchQuery{},
+			func(id string, srcDoc map[string]interface{}, dstDoc map[string]interface{}) {
+				if kept(srcDoc) {
+					compare(id, srcDoc, dstDoc)
+				}
+			})
+		if err != nil {
+			return err
+		}
+		return m.verifyByLookup(m.TargetESAPI, report.TargetIndex, SearchQuery{}, m.SourceESAPI, report.SourceIndexes, c.SearchQuery(),
+			func(id string, dstDoc map[string]interface{}, srcDoc map[string]interface{}) {
+				if srcDoc == nil || !kept(srcDoc) {
+					compare(id, nil, dstDoc)
+				}
+			})
+	}
+
+	src, err := newDocStream(m.SourceESAPI, report.SourceIndexes, c.ScrollTime, c.DocBufferCount, c.SearchQuery(), nil, "_id", c.Fields)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := newDocStream(m.TargetESAPI, report.TargetIndex, c.ScrollTime, c.DocBufferCount, SearchQuery{}, nil, "_id", c.Fields)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return mergeJoinById(src, dst, func(id string, srcDoc map[string]interface{}, dstDoc map[string]interface{}) {
+		if srcDoc != nil && !kept(srcDoc) {
+			srcDoc = nil
+		}
+		compare(id, srcDoc, dstDoc)
+	})
+}
+
+// verifyByLookup walk the documents of one side, and look up the ids of every page on the other side,
+// fn is called with every document and the one of the same _id on the other side, nil if not found
+func (m *Migrator) verifyByLookup(api ESAPI, indexNames string, query SearchQuery, otherApi ESAPI, otherIndexNames string, otherQuery SearchQuery,
+	fn func(id string, doc map[string]interface{}, otherDoc map[string]interface{})) error {
+	c := m.Config
+	stream, err := newDocStream(api, indexNames, c.ScrollTime, c.DocBufferCount, query, nil, "", c.Fields)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	page := map[string]map[string]interface{}{}
+	flush := func() error {
+		if len(page) == 0 {
+			return nil
+		}
+		found, err := lookupByIds(otherApi, otherIndexNames, c.ScrollTime, otherQuery, c.Fields, page)
+		if err != nil {
+			return err
+		}
+		for id, doc := range page {
+			fn(id, doc, found[id])
+		}
+		page = map[string]map[string]interface{}{}
+		return nil
+	}
+
+	for {
+		doc, err := stream.Next()
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return flush()
+		}
+		id, _ := doc["_id"].(string)
+		page[id] = doc
+		if len(page) >= c.DocBufferCount {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *Migrator) printVerifyReport(report *VerifyReport) {
+	status := "OK"
+	if !report.OK() {
+		status = "MISMATCH"
+	}
+	if report.DroppedCount > 0 {
+		log.Infof("verify %s => %s: %s, source count %d, %d dropped by --filter or --transform_script, target count %d",
+			report.SourceIndexes, report.TargetIndex, status, report.SourceCount, report.DroppedCount, report.TargetCount)
+	} else {
+		log.Infof("verify %s => %s: %s, source count %d, target count %d", report.SourceIndexes, report.TargetIndex,
+			status, report.SourceCount, report.TargetCount)
+	}
+
+	if !m.Config.VerifyHash {
+		return
+	}
+	log.Infof("verify %s => %s: missing %d, extra %d, mismatched %d", report.SourceIndexes, report.TargetIndex,
+		report.MissingCount, report.ExtraCount, report.MismatchedCount)
+
+	printIds := func(kind string, ids []string, count int) {
+		if count == 0 {
+			return
+		}
+		more := ""
+		if count > len(ids) {
+			more = fmt.Sprintf(" ... and %d more", count-len(ids))
+		}
+		log.Infof("  %s ids: %s%s", kind, strings.Join(ids, ", "), more)
+	}
+	printIds("missing", report.Missing, report.MissingCount)
+	printIds("extra", report.Extra, report.ExtraCount)
+	printIds("mismatched", report.Mismatched, report.MismatchedCount)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2016 Medcl (m AT medcl.net)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fakeVerifyES refresh the index of fakeSearchES
+type fakeVerifyES struct {
+	*fakeSearchES
+}
+
+func (f *fakeVerifyES) Refresh(name string) error {
+	return nil
+}
+
+func TestVerifyIndex(t *testing.T) {
+	srcDocs := []string{
+		`{"_id":"a","_index":"src","_source":{"v":1,"keep":true}}`,
+		`{"_id":"b","_index":"src","_source":{"v":2,"keep":true}}`,
+		`{"_id":"c","_index":"src","_source":{"v":3,"keep":true}}`,
+		`{"_id":"d","_index":"src","_source":{"v":4,"keep":false}}`,
+	}
+	dstDocs := []string{
+		`{"_id":"a","_index":"dst","_source":{"v":1,"keep":true}}`,
+		`{"_id":"b","_index":"dst","_source":{"v":20,"keep":true}}`,
+		`{"_id":"e","_index":"dst","_source":{"v":5,"keep":true}}`,
+	}
+
+	cases := []struct {
+		name      string
+		version   string
+		hash      bool
+		filters   []string
+		dropped   int64
+		src       []string
+		dst       []string
+		ok        bool
+		different []string
+	}{
+		{name: "same", version: "7.10.0", hash: true, src: srcDocs[:2], dst: []string{srcDocs[0], srcDocs[1]}, ok: true},
+		{name: "counts only", version: "7.10.0", src: srcDocs[:3], dst: dstDocs, ok: true},
+		{name: "counts with dropped", version: "7.10.0", src: srcDocs, dst: dstDocs, dropped: 1, ok: true},
+		{name: "counts without dropped", version: "7.10.0", src: srcDocs, dst: dstDocs},
+		{name: "sorted by _id", version: "7.10.0", hash: true, src: srcDocs[:3], dst: dstDocs,
+			different: []string{"extra e", "mismatched b", "missing c"}},
+		{name: "looked up for 8.x", version: "8.11.0", hash: true, src: srcDocs[:3], dst: dstDocs,
+			different: []string{"extra e", "mismatched b", "missing c"}},
+		{name: "filtered", version: "7.10.0", hash: true, filters: []string{"equals:keep=true"}, dropped: 1, src: srcDocs, dst: dstDocs,
+			different: []string{"extra e", "mismatched b", "missing c"}},
+		{name: "filtered for 8.x", version: "8.11.0", hash: true, filters: []string{"equals:keep=true"}, dropped: 1, src: srcDocs,
+			dst: append([]string{srcDocs[3]}, dstDocs...), different: []string{"extra d", "extra e", "mismatched b", "missing c"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline, err := ParsePipeline(c.filters, "", "", nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Migrator{
+				Config:      &Config{VerifyHash: c.hash, DocBufferCount: 2},
+				SourceESAPI: &fakeVerifyES{&fakeSearchES{version: c.version, docs: c.src}},
+				TargetESAPI: &fakeVerifyES{&fakeSearchES{version: c.version, docs: c.dst}},
+				Pipeline:    pipeline,
+			}
+			for i := int64(0); i < c.dropped; i++ {
+				m.TransformStats.addDropped("src")
+			}
+
+			report := &VerifyReport{SourceIndexes: "src", TargetIndex: "dst"}
+			if err := m.verifyIndex(report); err != nil {
+				t.Fatal(err)
+			}
+			var different []string
+			for kind, ids := range map[string][]string{"missing": report.Missing, "extra": report.Extra, "mismatched": report.Mismatched} {
+				for _, id := range ids {
+					different = append(different, kind+" "+id)
+				}
+			}
+			sort.Strings(different)
+			if !reflect.DeepEqual(different, c.different) {
+				t.Errorf("got %v, want %v", different, c.different)
+			}
+			if ok := report.OK(); ok != c.ok {
+				t.Errorf("got ok %v, want %v, report: %+v", ok, c.ok, report)
+			}
+		})
+	}
+}